@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// views are counted per local day in redis, a HyperLogLog of visitors, a
+// hit counter and a hash of referrers per article. The scheduler flushes
+// finished days into article_views and article_referrers.
+const (
+	viewsKey      = "views:"
+	viewsDaysKey  = "views:days"
+	viewsTTL      = 7 * 24 * time.Hour
+	viewDayLayout = "2006-01-02"
+
+	maxReferrerLength = 128
+	analyticsTopLimit = 10
+)
+
+var analyticsRanges = []int{7, 30, 90}
+
+// ViewDay is one point of a chart
+type ViewDay struct {
+	Day      time.Time
+	Visitors int64
+	Views    int64
+}
+
+type ArticleViews struct {
+	ArticleID uuid.UUID
+	Title     string
+	Slug      string
+	Visitors  int64
+	Views     int64
+}
+
+type Referrer struct {
+	Host  string
+	Views int64
+}
+
+// AnalyticsPage is the dashboard of an author, all their articles or the
+// one in Article
+type AnalyticsPage struct {
+	Days      int
+	Ranges    []int
+	Article   *ArticleViews
+	Series    []ViewDay
+	Articles  []ArticleViews
+	Referrers []Referrer
+	Visitors  int64
+	Views     int64
+}
+
+func viewDayKey(day string, articleID uuid.UUID, field string) string {
+	return viewsKey + day + ":" + articleID.String() + ":" + field
+}
+
+func viewArticlesKey(day string) string {
+	return viewsKey + day + ":articles"
+}
+
+// trackable leaves out Do-Not-Track and Global Privacy Control readers and
+// crawlers
+func trackable(r *http.Request) bool {
+	if r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1" {
+		return false
+	}
+
+	agent := strings.ToLower(r.UserAgent())
+	for _, bot := range []string{"bot", "crawl", "spider", "slurp", "preview"} {
+		if strings.Contains(agent, bot) {
+			return false
+		}
+	}
+	return agent != ""
+}
+
+// visitorID is the user for logged in readers, otherwise a hash of address,
+// agent and day so nobody can be followed from one day to the next
+func visitorID(r *http.Request, user DbUser, day string) string {
+	if user.Identifier != uuid.Nil {
+		return user.Identifier.String()
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(day + "|" + ip + "|" + r.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// referrerHost is the site a reader came from, links inside the site and
+// missing referrers count as direct
+func referrerHost(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || ref.Host == "" || strings.EqualFold(ref.Host, r.Host) {
+		return "direct"
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(ref.Hostname()), "www.")
+	if len(host) > maxReferrerLength {
+		host = host[:maxReferrerLength]
+	}
+	return host
+}
+
+// trackView counts a read of a published article, authors reading their
+// own work are not counted. It runs after the page is sent so redis never
+// slows down a read.
+func trackView(r *http.Request, article Article, user DbUser) {
+	if !article.IsPublished() || !trackable(r) || article.authorRole(user.Identifier) != 0 {
+		return
+	}
+
+	day := time.Now().Format(viewDayLayout)
+	visitor := visitorID(r, user, day)
+	referrer := referrerHost(r)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		visitors := viewDayKey(day, article.ID, "visitors")
+		hits := viewDayKey(day, article.ID, "hits")
+		referrers := viewDayKey(day, article.ID, "referrers")
+
+		pipe := database.RedisAllClients.Client1.Pipeline()
+		pipe.PFAdd(ctx, visitors, visitor)
+		pipe.Incr(ctx, hits)
+		pipe.HIncrBy(ctx, referrers, referrer, 1)
+		pipe.SAdd(ctx, viewArticlesKey(day), article.ID.String())
+		pipe.SAdd(ctx, viewsDaysKey, day)
+		for _, key := range []string{visitors, hits, referrers, viewArticlesKey(day)} {
+			pipe.Expire(ctx, key, viewsTTL)
+		}
+		_, err := pipe.Exec(ctx)
+		if err != nil {
+			log.Println("error tracking view of article", article.ID, err)
+		}
+	}()
+}
+
+// liveViews reads the counters of an article for a day still in redis
+func liveViews(ctx context.Context, day string, articleID uuid.UUID) (ViewDay, map[string]int64, error) {
+	pipe := database.RedisAllClients.Client1.Pipeline()
+	visitors := pipe.PFCount(ctx, viewDayKey(day, articleID, "visitors"))
+	hits := pipe.Get(ctx, viewDayKey(day, articleID, "hits"))
+	referrers := pipe.HGetAll(ctx, viewDayKey(day, articleID, "referrers"))
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return ViewDay{}, nil, err
+	}
+
+	v := ViewDay{Visitors: visitors.Val()}
+	v.Views, _ = strconv.ParseInt(hits.Val(), 10, 64)
+
+	counts := make(map[string]int64, len(referrers.Val()))
+	for host, n := range referrers.Val() {
+		counts[host], _ = strconv.ParseInt(n, 10, 64)
+	}
+	return v, counts, nil
+}
+
+// flushArticleViews moves every finished day from redis to postgres. Each
+// article is claimed with SPOP so instances never flush the same counters,
+// totals are written, not added, so a retried flush does not count twice.
+func flushArticleViews(ctx context.Context) error {
+	days, err := database.RedisAllClients.Client1.SMembers(ctx, viewsDaysKey).Result()
+	if err != nil {
+		return err
+	}
+
+	today := time.Now().Format(viewDayLayout)
+	for _, day := range days {
+		if day >= today {
+			continue
+		}
+
+		for {
+			ids, err := database.RedisAllClients.Client1.SPopN(ctx, viewArticlesKey(day), 100).Result()
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				break
+			}
+
+			for i, id := range ids {
+				articleID, err := uuid.Parse(id)
+				if err != nil {
+					continue
+				}
+
+				err = flushDayViews(ctx, day, articleID)
+				if err != nil {
+					// the rest of the batch waits for the next run
+					requeueDirty(viewArticlesKey(day), ids[i:])
+					return fmt.Errorf("views of article %s on %s: %w", id, day, err)
+				}
+			}
+		}
+
+		database.RedisAllClients.Client1.SRem(ctx, viewsDaysKey, day)
+	}
+	return nil
+}
+
+func flushDayViews(ctx context.Context, day string, articleID uuid.UUID) error {
+	v, referrers, err := liveViews(ctx, day, articleID)
+	if err != nil {
+		return err
+	}
+
+	hosts := make([]string, 0, len(referrers))
+	counts := make([]int64, 0, len(referrers))
+	for host, n := range referrers {
+		hosts = append(hosts, host)
+		counts = append(counts, n)
+	}
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// the article may be gone since, the insert then selects nothing
+	upsertViews := `
+	INSERT INTO article_views (article_id, day, visitors, views)
+	SELECT article_id, $2::date, $3::bigint, $4::bigint FROM articles WHERE article_id = $1
+	ON CONFLICT (article_id, day) DO UPDATE SET visitors = EXCLUDED.visitors, views = EXCLUDED.views;
+	`
+	_, err = tx.Exec(ctx, upsertViews, articleID, day, v.Visitors, v.Views)
+	if err != nil {
+		return err
+	}
+
+	upsertReferrers := `
+	INSERT INTO article_referrers (article_id, day, referrer, views)
+	SELECT a.article_id, $2::date, r.referrer, r.views
+	FROM articles a, unnest($3::text[], $4::bigint[]) AS r (referrer, views)
+	WHERE a.article_id = $1
+	ON CONFLICT (article_id, day, referrer) DO UPDATE SET views = EXCLUDED.views;
+	`
+	_, err = tx.Exec(ctx, upsertReferrers, articleID, day, hosts, counts)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return database.RedisAllClients.Client1.Del(ctx,
+		viewDayKey(day, articleID, "visitors"),
+		viewDayKey(day, articleID, "hits"),
+		viewDayKey(day, articleID, "referrers")).Err()
+}
+
+// analyticsHandler is the dashboard at /analytics, ?days=7|30|90 picks the
+// range and ?article= narrows it to one article
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	page := AnalyticsPage{Days: 30, Ranges: analyticsRanges}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, page, errs, "analytics.html")
+	}()
+
+	if days, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil {
+		for _, d := range analyticsRanges {
+			if d == days {
+				page.Days = days
+			}
+		}
+	}
+
+	page.Articles, err = authorArticleViews(ctx, user.Identifier)
+	if err != nil {
+		errs = append(errs, errors.New("error getting your articles, try again"))
+		return
+	}
+
+	ids := make([]uuid.UUID, len(page.Articles))
+	for i, a := range page.Articles {
+		ids[i] = a.ArticleID
+	}
+
+	// one article only counts its own views, the list shows the others as 0
+	articleID := r.URL.Query().Get("article")
+	if articleID != "" {
+		ids = nil
+		for _, a := range page.Articles {
+			if a.ArticleID.String() == articleID {
+				ids = []uuid.UUID{a.ArticleID}
+			}
+		}
+		if ids == nil {
+			errs = append(errs, errors.New("article not found"))
+			return
+		}
+	}
+
+	err = page.load(ctx, ids)
+	if err != nil {
+		log.Println("error loading analytics:", err)
+		errs = append(errs, errors.New("error getting views, try again"))
+		return
+	}
+
+	for i, a := range page.Articles {
+		if a.ArticleID.String() == articleID {
+			page.Article = &page.Articles[i]
+		}
+	}
+}
+
+// authorArticleViews lists the articles the user owns or edits
+func authorArticleViews(ctx context.Context, userIdentifier uuid.UUID) ([]ArticleViews, error) {
+	list := `
+	SELECT a.article_id, a.title, a.slug
+	FROM articles a JOIN article_authors aa ON aa.article_id = a.article_id
+	WHERE aa.user_identifier = $1 AND aa.accepted AND aa.role <> 'V' AND a.status = 'P' AND a.deleted_at IS NULL
+	ORDER BY a.published_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ArticleViews, error) {
+		var a ArticleViews
+		err := row.Scan(&a.ArticleID, &a.Title, &a.Slug)
+		return a, err
+	})
+}
+
+// load fills the chart, totals and referrers of ids from the rollup
+// tables plus today's live counters
+func (p *AnalyticsPage) load(ctx context.Context, ids []uuid.UUID) error {
+	today := time.Now().Format(viewDayLayout)
+	start := time.Now().AddDate(0, 0, -(p.Days - 1)).Format(viewDayLayout)
+
+	byID := make(map[uuid.UUID]*ArticleViews, len(p.Articles))
+	for i := range p.Articles {
+		byID[p.Articles[i].ArticleID] = &p.Articles[i]
+	}
+
+	days := make(map[string]*ViewDay, p.Days)
+	for i := 0; i < p.Days; i++ {
+		day := time.Now().AddDate(0, 0, -(p.Days - 1 - i))
+		p.Series = append(p.Series, ViewDay{Day: day})
+	}
+	for i := range p.Series {
+		days[p.Series[i].Day.Format(viewDayLayout)] = &p.Series[i]
+	}
+
+	add := func(articleID uuid.UUID, day string, visitors, views int64) {
+		if d, ok := days[day]; ok {
+			d.Visitors += visitors
+			d.Views += views
+		}
+		if a, ok := byID[articleID]; ok {
+			a.Visitors += visitors
+			a.Views += views
+		}
+		p.Visitors += visitors
+		p.Views += views
+	}
+
+	listViews := `
+	SELECT article_id, to_char(day, 'YYYY-MM-DD'), visitors, views
+	FROM article_views
+	WHERE article_id = ANY($1) AND day >= $2::date AND day < $3::date;
+	`
+	rows, err := database.Dbpool.Query(ctx, listViews, ids, start, today)
+	if err != nil {
+		return err
+	}
+	var articleID uuid.UUID
+	var day string
+	var visitors, views int64
+	_, err = pgx.ForEachRow(rows, []any{&articleID, &day, &visitors, &views}, func() error {
+		add(articleID, day, visitors, views)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	referrers := make(map[string]int64)
+	listReferrers := `
+	SELECT referrer, SUM(views)::bigint
+	FROM article_referrers
+	WHERE article_id = ANY($1) AND day >= $2::date AND day < $3::date
+	GROUP BY referrer;
+	`
+	rows, err = database.Dbpool.Query(ctx, listReferrers, ids, start, today)
+	if err != nil {
+		return err
+	}
+	var host string
+	_, err = pgx.ForEachRow(rows, []any{&host, &views}, func() error {
+		referrers[host] += views
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		v, live, err := liveViews(ctx, today, id)
+		if err != nil {
+			return err
+		}
+		add(id, today, v.Visitors, v.Views)
+		for host, n := range live {
+			referrers[host] += n
+		}
+	}
+
+	for host, n := range referrers {
+		p.Referrers = append(p.Referrers, Referrer{Host: host, Views: n})
+	}
+	sort.Slice(p.Referrers, func(i, j int) bool { return p.Referrers[i].Views > p.Referrers[j].Views })
+	if len(p.Referrers) > analyticsTopLimit {
+		p.Referrers = p.Referrers[:analyticsTopLimit]
+	}
+
+	sort.SliceStable(p.Articles, func(i, j int) bool { return p.Articles[i].Visitors > p.Articles[j].Visitors })
+	return nil
+}
+
+// chart size of the svg in analytics.html
+const (
+	chartWidth  = 600
+	chartHeight = 150
+)
+
+// ChartPoints is the svg polyline of daily visitors
+func (p AnalyticsPage) ChartPoints() string {
+	maxVisitors := p.MaxVisitors()
+	if maxVisitors == 0 {
+		maxVisitors = 1
+	}
+
+	step := float64(chartWidth)
+	if len(p.Series) > 1 {
+		step = float64(chartWidth) / float64(len(p.Series)-1)
+	}
+
+	points := make([]string, len(p.Series))
+	for i, d := range p.Series {
+		y := chartHeight - float64(d.Visitors)*chartHeight/float64(maxVisitors)
+		points[i] = fmt.Sprintf("%.1f,%.1f", float64(i)*step, y)
+	}
+	return strings.Join(points, " ")
+}
+
+func (p AnalyticsPage) MaxVisitors() int64 {
+	var m int64
+	for _, d := range p.Series {
+		if d.Visitors > m {
+			m = d.Visitors
+		}
+	}
+	return m
+}
+
+// ReferrerShare is the width in percent of a referrer bar
+func (p AnalyticsPage) ReferrerShare(views int64) int64 {
+	if len(p.Referrers) == 0 || p.Referrers[0].Views == 0 {
+		return 0
+	}
+	return views * 100 / p.Referrers[0].Views
+}
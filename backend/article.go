@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+const (
+	articleDraft       = 'D'
+	articlePublished   = 'P'
+	articleUnpublished = 'U'
+)
+
+// datetime-local input format, read in server local time
+const formTimeLayout = "2006-01-02T15:04"
+
+type Article struct {
+	ID               uuid.UUID
+	AuthorIdentifier uuid.UUID
+	Author           string
+	CategoryID       uuid.NullUUID
+	Title            string
+	Slug             string
+	Content          string
+	Status           rune
+	PublishAt        *time.Time
+	UnpublishAt      *time.Time
+	PublishedAt      *time.Time
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Tags             []Tag
+	Authors          []ArticleAuthor
+	Series           *SeriesNav
+	Reactions        Reactions
+}
+
+// ArticlesPage is the article list, filtered by tags, author or category
+type ArticlesPage struct {
+	Filter   ArticleFilter
+	Articles []Article
+}
+
+type ArticleFilter struct {
+	Tags     []string
+	MatchAll bool
+	Author   string
+	Category string
+}
+
+const articleColumns = `article_id, author_identifier, author, category_id, title, slug, content,
+	status, publish_at, unpublish_at, published_at, created_at, updated_at`
+
+func scanArticle(row pgx.Row) (Article, error) {
+	var a Article
+	var status string
+	err := row.Scan(&a.ID, &a.AuthorIdentifier, &a.Author, &a.CategoryID, &a.Title, &a.Slug, &a.Content,
+		&status, &a.PublishAt, &a.UnpublishAt, &a.PublishedAt, &a.CreatedAt, &a.UpdatedAt)
+	if err != nil {
+		return Article{}, err
+	}
+	a.Status = firstRune(status)
+	return a, nil
+}
+
+func (a Article) IsPublished() bool {
+	return a.Status == articlePublished
+}
+
+func (a Article) IsScheduled() bool {
+	return a.Status == articleDraft && a.PublishAt != nil
+}
+
+func (a Article) PublishAtInput() string {
+	if a.PublishAt == nil {
+		return ""
+	}
+	return a.PublishAt.Format(formTimeLayout)
+}
+
+func (a Article) UnpublishAtInput() string {
+	if a.UnpublishAt == nil {
+		return ""
+	}
+	return a.UnpublishAt.Format(formTimeLayout)
+}
+
+// Body is the escaped content with media picker embeds rendered
+func (a Article) Body() string {
+	return embedMedia(a.Content)
+}
+
+func listArticlesHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var page ArticlesPage
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, page, errs, "articles.html")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	page.Filter = articleFilterFromRequest(r)
+
+	articles, err := listArticles(ctx, page.Filter)
+	if err != nil {
+		errs = append(errs, errors.New("error getting articles, try again"))
+		return
+	}
+	page.Articles = articles
+}
+
+func viewArticleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, current, err := resolveSlug(ctx, slugArticle, r.PathValue("slug"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	article, err := getArticle(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	// drafts and unpublished articles are only visible to their authors
+	user, userErr := userInfoMiddleware(r)
+	if !article.IsPublished() && (userErr != nil || !user.canViewArticle(article)) {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	// renamed article, send the old link to the new one
+	if !current {
+		http.Redirect(w, r, articleURL(article.Slug), http.StatusMovedPermanently)
+		return
+	}
+
+	article.Series, err = getSeriesNav(ctx, article, user)
+	if err != nil {
+		log.Println("error getting series of article", article.ID, err)
+	}
+	viewer := uuid.Nil
+	if userErr == nil {
+		viewer = user.Identifier
+	}
+	article.Reactions, err = getReactions(ctx, article.ID, viewer)
+	if err != nil {
+		log.Println("error getting reactions of article", article.ID, err)
+	}
+
+	if article.Series != nil && userErr == nil && article.IsPublished() {
+		err = markSeriesRead(ctx, user.Identifier, article.ID)
+		if err != nil {
+			log.Println("error marking series read", article.ID, err)
+		}
+	}
+
+	renderHtml(w, r, article, nil, "article.html")
+	trackView(r, article, user)
+}
+
+func newArticleHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+	renderHtml(w, r, Article{}, nil, "articleEdit.html")
+}
+
+func createArticleHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var article Article
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, article, errs, "articleEdit.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, articleURL(article.Slug), http.StatusFound)
+		}
+	}()
+
+	article, errs = articleFromForm(r)
+	if errs != nil {
+		return
+	}
+
+	article.AuthorIdentifier = user.Identifier
+	article.Author = user.Username
+
+	created, err := article.create(ctx)
+	if err != nil {
+		errs = append(errs, errors.New("error creating article, try again"))
+		return
+	}
+	article = created
+}
+
+func editArticleHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var article Article
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, article, errs, "articleEdit.html")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	article, err = getArticle(ctx, Id)
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	if !user.canEditArticle(article) {
+		article = Article{}
+		errs = append(errs, errors.New("you are not allowed to edit this article"))
+		return
+	}
+}
+
+func updateArticleHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var article Article
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, article, errs, "articleEdit.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, articleURL(article.Slug), http.StatusFound)
+		}
+	}()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	existing, err := getArticle(ctx, Id)
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	if !user.canEditArticle(existing) {
+		errs = append(errs, errors.New("you are not allowed to edit this article"))
+		return
+	}
+
+	article, errs = articleFromForm(r)
+	article.ID = existing.ID
+	article.Slug = existing.Slug
+	if errs != nil {
+		return
+	}
+
+	// keep the first publish time when an already live article is saved again
+	article.PublishedAt = existing.PublishedAt
+
+	updated, err := article.update(ctx)
+	if err != nil {
+		errs = append(errs, errors.New("error saving article, try again"))
+		return
+	}
+	article = updated
+
+	if article.IsPublished() && !existing.IsPublished() {
+		notifyArticlePublished(article)
+	}
+}
+
+// articleFromForm reads the editor form, status is one of draft, publish or schedule
+func articleFromForm(r *http.Request) (Article, []error) {
+	var errs []error
+	var err error
+
+	article := Article{
+		Title:   strings.TrimSpace(r.FormValue("title")),
+		Content: r.FormValue("content"),
+		Status:  articleDraft,
+	}
+
+	if article.Title == "" {
+		errs = append(errs, errors.New("please provide title"))
+	} else if countCharacters(article.Title) > 256 {
+		errs = append(errs, errors.New("title should be less than 256 characters"))
+	}
+
+	if strings.TrimSpace(article.Content) == "" {
+		errs = append(errs, errors.New("please provide content"))
+	}
+
+	if c := r.FormValue("categoryId"); c != "" {
+		article.CategoryID.UUID, err = uuid.Parse(c)
+		if err != nil {
+			errs = append(errs, errors.New("category does not exists"))
+		}
+		article.CategoryID.Valid = err == nil
+	}
+
+	article.PublishAt, err = parseFormTime(r.FormValue("publishAt"))
+	if err != nil {
+		errs = append(errs, errors.New("invalid publish time"))
+	}
+
+	article.UnpublishAt, err = parseFormTime(r.FormValue("unpublishAt"))
+	if err != nil {
+		errs = append(errs, errors.New("invalid unpublish time"))
+	}
+
+	now := time.Now()
+	switch r.FormValue("status") {
+	case "publish":
+		article.Status = articlePublished
+		article.PublishAt = nil
+	case "schedule":
+		if article.PublishAt == nil || article.PublishAt.Before(now) {
+			errs = append(errs, errors.New("scheduled publish time should be in the future"))
+		}
+	default:
+		article.PublishAt = nil
+	}
+
+	if article.UnpublishAt != nil {
+		if article.UnpublishAt.Before(now) {
+			errs = append(errs, errors.New("unpublish time should be in the future"))
+		} else if article.PublishAt != nil && !article.UnpublishAt.After(*article.PublishAt) {
+			errs = append(errs, errors.New("unpublish time should be after publish time"))
+		}
+	}
+
+	return article, errs
+}
+
+func parseFormTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.ParseInLocation(formTimeLayout, value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// tags come as repeated ?tag= values, match=all switches OR to AND
+func articleFilterFromRequest(r *http.Request) ArticleFilter {
+	var filter ArticleFilter
+	seen := make(map[string]bool)
+	for _, t := range r.URL.Query()["tag"] {
+		slug := normalizeTag(t)
+		if slug != "" && !seen[slug] {
+			seen[slug] = true
+			filter.Tags = append(filter.Tags, slug)
+		}
+	}
+	filter.MatchAll = r.URL.Query().Get("match") == "all"
+	return filter
+}
+
+func (article Article) create(ctx context.Context) (Article, error) {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return Article{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	slug, err := uniqueSlug(ctx, tx, slugArticle, slugify(article.Title, 256), uuid.Nil, 256)
+	if err != nil {
+		return Article{}, err
+	}
+
+	insertArticle := `INSERT INTO articles (author_identifier, author, category_id, title, slug, content,
+                          status, publish_at, unpublish_at, published_at)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9,
+                          CASE WHEN $7 = 'P' THEN CURRENT_TIMESTAMP END)
+                      RETURNING ` + articleColumns
+	result, err := scanArticle(tx.QueryRow(ctx, insertArticle,
+		article.AuthorIdentifier, article.Author, article.CategoryID, article.Title, slug, article.Content,
+		string(article.Status), article.PublishAt, article.UnpublishAt))
+	if err != nil {
+		return Article{}, err
+	}
+
+	insertOwner := `INSERT INTO article_authors (article_id, user_identifier, role, position, accepted)
+                    VALUES ($1, $2, 'O', 0, TRUE)`
+	_, err = tx.Exec(ctx, insertOwner, result.ID, result.AuthorIdentifier)
+	if err != nil {
+		return Article{}, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return Article{}, err
+	}
+
+	if result.IsPublished() {
+		notifyArticlePublished(result)
+	}
+
+	return result, nil
+}
+
+func (article Article) update(ctx context.Context) (Article, error) {
+	updateArticle := `UPDATE articles SET category_id = $2, title = $3, content = $4, status = $5,
+                          publish_at = $6, unpublish_at = $7,
+                          published_at = CASE WHEN $5 = 'P' THEN COALESCE($8, CURRENT_TIMESTAMP) END,
+                          updated_at = CURRENT_TIMESTAMP
+                      WHERE article_id = $1
+                      RETURNING ` + articleColumns
+	result, err := scanArticle(database.Dbpool.QueryRow(ctx, updateArticle,
+		article.ID, article.CategoryID, article.Title, article.Content, string(article.Status),
+		article.PublishAt, article.UnpublishAt, article.PublishedAt))
+	if err != nil {
+		return Article{}, err
+	}
+
+	result.Tags, err = getArticleTags(ctx, result.ID)
+	if err != nil {
+		return Article{}, err
+	}
+
+	articles := []Article{result}
+	err = loadArticleAuthors(ctx, articles)
+	if err != nil {
+		return Article{}, err
+	}
+
+	return articles[0], nil
+}
+
+func getArticle(ctx context.Context, Id uuid.UUID) (Article, error) {
+	getbyId := `SELECT ` + articleColumns + ` FROM articles WHERE article_id = $1 AND deleted_at IS NULL;`
+	article, err := scanArticle(database.Dbpool.QueryRow(ctx, getbyId, Id))
+	if err != nil {
+		return Article{}, err
+	}
+
+	article.Tags, err = getArticleTags(ctx, article.ID)
+	if err != nil {
+		return Article{}, err
+	}
+
+	articles := []Article{article}
+	err = loadArticleAuthors(ctx, articles)
+	if err != nil {
+		return Article{}, err
+	}
+
+	return articles[0], nil
+}
+
+// listArticles only returns published articles
+func listArticles(ctx context.Context, filter ArticleFilter) ([]Article, error) {
+	list := `
+	SELECT ` + articleColumns + `
+	FROM articles
+	WHERE status = 'P' AND deleted_at IS NULL
+	  AND (coalesce(cardinality($1::text[]), 0) = 0
+	   OR article_id IN (
+	      SELECT at.article_id FROM article_tags at
+	      JOIN tags t ON t.tag_id = at.tag_id
+	      WHERE t.tag_slug = ANY($1)
+	      GROUP BY at.article_id
+	      HAVING NOT $2::boolean OR COUNT(DISTINCT t.tag_id) = cardinality($1::text[])))
+	  AND ($3 = '' OR EXISTS (
+	      SELECT 1 FROM article_authors aa JOIN users u ON u.user_identifier = aa.user_identifier
+	      WHERE aa.article_id = articles.article_id AND aa.accepted AND aa.role <> 'V' AND u.username = $3))
+	  AND ($4 = '' OR category_id = (SELECT category_id FROM categories WHERE category_name = $4))
+	ORDER BY published_at DESC
+	LIMIT 100;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, filter.Tags, filter.MatchAll, filter.Author, filter.Category)
+	if err != nil {
+		return nil, err
+	}
+
+	articles, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Article, error) {
+		return scanArticle(row)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = loadArticleAuthors(ctx, articles)
+	if err != nil {
+		return nil, err
+	}
+
+	return articles, nil
+}
+
+// owners and editors edit, site admins edit everything
+func (u DbUser) canEditArticle(article Article) bool {
+	role := article.authorRole(u.Identifier)
+	return u.Role == 'A' || role == authorOwner || role == authorEditor
+}
+
+// viewers only get to read drafts
+func (u DbUser) canViewArticle(article Article) bool {
+	return article.IsPublished() || u.canEditArticle(article) || article.authorRole(u.Identifier) == authorViewer
+}
+
+func (u DbUser) canManageAuthors(article Article) bool {
+	return u.Role == 'A' || article.authorRole(u.Identifier) == authorOwner
+}
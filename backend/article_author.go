@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+const (
+	authorOwner  = 'O'
+	authorEditor = 'E'
+	authorViewer = 'V'
+)
+
+var (
+	errLastOwner     = errors.New("article needs at least one owner")
+	errAlreadyAuthor = errors.New("user is already an author or invited")
+)
+
+type ArticleAuthor struct {
+	ArticleID  uuid.UUID
+	Identifier uuid.UUID
+	Username   string
+	Fullname   string
+	Role       rune
+	Position   int
+	Accepted   bool
+	CreatedAt  time.Time
+}
+
+type ArticleAuthorsPage struct {
+	Article   Article
+	CanManage bool
+	// the viewer's own pending invitation, if any
+	Invite *ArticleAuthor
+}
+
+type ArticleInvitation struct {
+	ArticleID uuid.UUID
+	Title     string
+	Slug      string
+	Role      rune
+	InvitedBy string
+	CreatedAt time.Time
+}
+
+func (au ArticleAuthor) RoleName() string {
+	return authorRoleName(au.Role)
+}
+
+func (inv ArticleInvitation) RoleName() string {
+	return authorRoleName(inv.Role)
+}
+
+func authorRoleName(role rune) string {
+	switch role {
+	case authorOwner:
+		return "owner"
+	case authorEditor:
+		return "editor"
+	case authorViewer:
+		return "viewer"
+	}
+	return ""
+}
+
+func parseAuthorRole(value string) (rune, error) {
+	switch value {
+	case "owner":
+		return authorOwner, nil
+	case "editor":
+		return authorEditor, nil
+	case "viewer":
+		return authorViewer, nil
+	}
+	return 0, errors.New("role should be owner, editor or viewer")
+}
+
+// Bylines are the accepted owners and editors in byline order, viewers are not credited
+func (a Article) Bylines() []ArticleAuthor {
+	var bylines []ArticleAuthor
+	for _, au := range a.Authors {
+		if au.Accepted && au.Role != authorViewer {
+			bylines = append(bylines, au)
+		}
+	}
+	return bylines
+}
+
+// Byline joins the credited usernames like "ann, bob and cid"
+func (a Article) Byline() string {
+	var names []string
+	for _, au := range a.Bylines() {
+		names = append(names, au.Username)
+	}
+	switch len(names) {
+	case 0:
+		return a.Author
+	case 1:
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// authorRole is the accepted role of identifier on the article, 0 for everyone else
+func (a Article) authorRole(identifier uuid.UUID) rune {
+	for _, au := range a.Authors {
+		if au.Identifier == identifier && au.Accepted {
+			return au.Role
+		}
+	}
+	return 0
+}
+
+func (a Article) pendingInvite(identifier uuid.UUID) *ArticleAuthor {
+	for i, au := range a.Authors {
+		if au.Identifier == identifier && !au.Accepted {
+			return &a.Authors[i]
+		}
+	}
+	return nil
+}
+
+func articleAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := articleAuthorsPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	renderHtml(w, r, page, nil, "articleAuthors.html")
+}
+
+// articleAuthorsPage loads the article for the authors page, only its
+// authors, invited users and site admins get to see it
+func articleAuthorsPage(ctx context.Context, r *http.Request, user DbUser) (ArticleAuthorsPage, error) {
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		return ArticleAuthorsPage{}, err
+	}
+
+	article, err := getArticle(ctx, Id)
+	if err != nil {
+		return ArticleAuthorsPage{}, err
+	}
+
+	page := ArticleAuthorsPage{
+		Article:   article,
+		CanManage: user.canManageAuthors(article),
+		Invite:    article.pendingInvite(user.Identifier),
+	}
+	if user.Role != 'A' && article.authorRole(user.Identifier) == 0 && page.Invite == nil {
+		return ArticleAuthorsPage{}, pgx.ErrNoRows
+	}
+
+	return page, nil
+}
+
+// authorsAction runs the shared part of every authors form, action gets the
+// loaded page and returns the errors to show
+func authorsAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, user DbUser, page ArticleAuthorsPage) []error) {
+	var errs []error
+	var page ArticleAuthorsPage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err = articleAuthorsPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	errs = action(ctx, user, page)
+	if len(errs) > 0 {
+		// show the current state next to the errors
+		if reloaded, err := articleAuthorsPage(ctx, r, user); err == nil {
+			page = reloaded
+		}
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "articleAuthors.html")
+		return
+	}
+
+	// declining or leaving may take the page away from the user
+	if _, err := articleAuthorsPage(ctx, r, user); err != nil {
+		http.Redirect(w, r, "/article/invitations", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/article/"+page.Article.ID.String()+"/authors", http.StatusFound)
+}
+
+func inviteArticleAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	authorsAction(w, r, func(ctx context.Context, user DbUser, page ArticleAuthorsPage) []error {
+		var errs []error
+
+		if !page.CanManage {
+			return append(errs, errors.New("only owners can invite authors"))
+		}
+
+		role, err := parseAuthorRole(r.FormValue("role"))
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		username := strings.TrimSpace(r.FormValue("username"))
+		if username == "" {
+			errs = append(errs, errors.New("please provide username"))
+		}
+		if errs != nil {
+			return errs
+		}
+
+		var invitee uuid.UUID
+		var email string
+		getUser := `SELECT user_identifier, email FROM users WHERE username = $1`
+		err = database.Dbpool.QueryRow(ctx, getUser, username).Scan(&invitee, &email)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return append(errs, errors.New("user does not exists"))
+		} else if err != nil {
+			return append(errs, errors.New("error finding user, try again"))
+		}
+
+		err = inviteArticleAuthor(ctx, page.Article.ID, invitee, role, user.Identifier)
+		if errors.Is(err, errAlreadyAuthor) {
+			return append(errs, err)
+		} else if err != nil {
+			return append(errs, errors.New("error inviting author, try again"))
+		}
+
+		body := fmt.Sprintf("Hello %s, %s invited you as %s of the article \"%s\".\r\n"+
+			"Accept or decline it at %s/article/invitations\r\n",
+			username, user.Username, authorRoleName(role), page.Article.Title, siteURL(r))
+		err = mailUser(email, "You are invited to an article", body)
+		if err != nil {
+			// the invitation still shows up on the invitations page
+			log.Println("error mailing article invitation:", err)
+		}
+		return nil
+	})
+}
+
+func respondArticleInviteHandler(w http.ResponseWriter, r *http.Request) {
+	authorsAction(w, r, func(ctx context.Context, user DbUser, page ArticleAuthorsPage) []error {
+		var errs []error
+
+		if page.Invite == nil {
+			return append(errs, errors.New("invitation not found"))
+		}
+
+		var err error
+		if r.FormValue("accept") == "true" {
+			err = acceptArticleInvite(ctx, page.Article.ID, user.Identifier)
+		} else {
+			err = removeArticleAuthor(ctx, page.Article.ID, user.Identifier)
+		}
+		if err != nil {
+			return append(errs, errors.New("error answering invitation, try again"))
+		}
+		return nil
+	})
+}
+
+func setArticleAuthorRoleHandler(w http.ResponseWriter, r *http.Request) {
+	authorsAction(w, r, func(ctx context.Context, user DbUser, page ArticleAuthorsPage) []error {
+		var errs []error
+
+		if !page.CanManage {
+			return append(errs, errors.New("only owners can change roles"))
+		}
+
+		role, err := parseAuthorRole(r.FormValue("role"))
+		if err != nil {
+			return append(errs, err)
+		}
+
+		author, ok := findArticleAuthor(page.Article, r.PathValue("username"))
+		if !ok {
+			return append(errs, errors.New("author not found"))
+		}
+
+		err = setArticleAuthorRole(ctx, page.Article.ID, author.Identifier, role)
+		if errors.Is(err, errLastOwner) {
+			return append(errs, err)
+		} else if err != nil {
+			return append(errs, errors.New("error changing role, try again"))
+		}
+		return nil
+	})
+}
+
+// removeArticleAuthorHandler lets owners remove anyone and everyone else leave
+func removeArticleAuthorHandler(w http.ResponseWriter, r *http.Request) {
+	authorsAction(w, r, func(ctx context.Context, user DbUser, page ArticleAuthorsPage) []error {
+		var errs []error
+
+		author, ok := findArticleAuthor(page.Article, r.PathValue("username"))
+		if !ok {
+			return append(errs, errors.New("author not found"))
+		}
+
+		if !page.CanManage && author.Identifier != user.Identifier {
+			return append(errs, errors.New("only owners can remove other authors"))
+		}
+
+		err := removeArticleAuthor(ctx, page.Article.ID, author.Identifier)
+		if errors.Is(err, errLastOwner) {
+			return append(errs, err)
+		} else if err != nil {
+			return append(errs, errors.New("error removing author, try again"))
+		}
+		return nil
+	})
+}
+
+// reorderArticleAuthorsHandler takes usernames as repeated author values in byline order
+func reorderArticleAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	authorsAction(w, r, func(ctx context.Context, user DbUser, page ArticleAuthorsPage) []error {
+		var errs []error
+
+		if !page.CanManage {
+			return append(errs, errors.New("only owners can reorder bylines"))
+		}
+
+		r.ParseMultipartForm(1 << 20)
+		var order []uuid.UUID
+		for _, username := range r.Form["author"] {
+			author, ok := findArticleAuthor(page.Article, username)
+			if !ok {
+				return append(errs, fmt.Errorf("author %s not found", username))
+			}
+			order = append(order, author.Identifier)
+		}
+
+		err := reorderArticleAuthors(ctx, page.Article.ID, order)
+		if err != nil {
+			return append(errs, errors.New("error reordering authors, try again"))
+		}
+		return nil
+	})
+}
+
+func articleInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var invitations []ArticleInvitation
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, invitations, errs, "articleInvitations.html")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	invitations, err = listArticleInvitations(ctx, user.Identifier)
+	if err != nil {
+		errs = append(errs, errors.New("error getting invitations, try again"))
+		return
+	}
+}
+
+func findArticleAuthor(article Article, username string) (ArticleAuthor, bool) {
+	for _, au := range article.Authors {
+		if au.Username == username {
+			return au, true
+		}
+	}
+	return ArticleAuthor{}, false
+}
+
+// loadArticleAuthors fills Authors of every article with one query,
+// accepted authors come first in byline order followed by invitations
+func loadArticleAuthors(ctx context.Context, articles []Article) error {
+	if len(articles) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(articles))
+	index := make(map[uuid.UUID]int, len(articles))
+	for i, a := range articles {
+		ids[i] = a.ID
+		index[a.ID] = i
+	}
+
+	getAuthors := `
+	SELECT aa.article_id, aa.user_identifier, u.username, u.fullname, aa.role, aa.position, aa.accepted, aa.created_at
+	FROM article_authors aa
+	JOIN users u ON u.user_identifier = aa.user_identifier
+	WHERE aa.article_id = ANY($1)
+	ORDER BY aa.accepted DESC, aa.position, aa.created_at;
+	`
+	rows, err := database.Dbpool.Query(ctx, getAuthors, ids)
+	if err != nil {
+		return err
+	}
+
+	authors, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ArticleAuthor, error) {
+		var au ArticleAuthor
+		var role string
+		err := row.Scan(&au.ArticleID, &au.Identifier, &au.Username, &au.Fullname, &role,
+			&au.Position, &au.Accepted, &au.CreatedAt)
+		au.Role = firstRune(role)
+		return au, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range articles {
+		articles[i].Authors = nil
+	}
+	for _, au := range authors {
+		i := index[au.ArticleID]
+		articles[i].Authors = append(articles[i].Authors, au)
+	}
+	return nil
+}
+
+func inviteArticleAuthor(ctx context.Context, articleID, invitee uuid.UUID, role rune, invitedBy uuid.UUID) error {
+	invite := `INSERT INTO article_authors (article_id, user_identifier, role, position, invited_by_identifier)
+               VALUES ($1, $2, $3,
+                   (SELECT COALESCE(MAX(position) + 1, 0) FROM article_authors WHERE article_id = $1), $4)
+               ON CONFLICT (article_id, user_identifier) DO NOTHING`
+	tag, err := database.Dbpool.Exec(ctx, invite, articleID, invitee, string(role), invitedBy)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errAlreadyAuthor
+	}
+	return nil
+}
+
+func acceptArticleInvite(ctx context.Context, articleID, identifier uuid.UUID) error {
+	accept := `UPDATE article_authors SET accepted = TRUE
+               WHERE article_id = $1 AND user_identifier = $2 AND NOT accepted`
+	tag, err := database.Dbpool.Exec(ctx, accept, articleID, identifier)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// lockArticleOwners locks the article so two owners can't demote each other
+// at once, it returns the current role of identifier and the accepted owners count
+func lockArticleOwners(ctx context.Context, tx pgx.Tx, articleID, identifier uuid.UUID) (rune, int, error) {
+	var role string
+	var owners int
+
+	lock := `SELECT 1 FROM articles WHERE article_id = $1 FOR UPDATE`
+	_, err := tx.Exec(ctx, lock, articleID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	getRole := `
+	SELECT role, (SELECT COUNT(*) FROM article_authors WHERE article_id = $1 AND role = 'O' AND accepted)
+	FROM article_authors
+	WHERE article_id = $1 AND user_identifier = $2;
+	`
+	err = tx.QueryRow(ctx, getRole, articleID, identifier).Scan(&role, &owners)
+	return firstRune(role), owners, err
+}
+
+func setArticleAuthorRole(ctx context.Context, articleID, identifier uuid.UUID, role rune) error {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	current, owners, err := lockArticleOwners(ctx, tx, articleID, identifier)
+	if err != nil {
+		return err
+	}
+	if current == authorOwner && role != authorOwner && owners <= 1 {
+		return errLastOwner
+	}
+
+	update := `UPDATE article_authors SET role = $3 WHERE article_id = $1 AND user_identifier = $2`
+	_, err = tx.Exec(ctx, update, articleID, identifier, string(role))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// removeArticleAuthor deletes an author or a pending invitation
+func removeArticleAuthor(ctx context.Context, articleID, identifier uuid.UUID) error {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	current, owners, err := lockArticleOwners(ctx, tx, articleID, identifier)
+	if err != nil {
+		return err
+	}
+
+	remove := `DELETE FROM article_authors WHERE article_id = $1 AND user_identifier = $2
+               RETURNING accepted`
+	var accepted bool
+	err = tx.QueryRow(ctx, remove, articleID, identifier).Scan(&accepted)
+	if err != nil {
+		return err
+	}
+	if accepted && current == authorOwner && owners <= 1 {
+		return errLastOwner
+	}
+
+	return tx.Commit(ctx)
+}
+
+// reorderArticleAuthors sets byline positions from order, the first one leads
+func reorderArticleAuthors(ctx context.Context, articleID uuid.UUID, order []uuid.UUID) error {
+	reorder := `
+	UPDATE article_authors aa
+	SET position = o.ord - 1
+	FROM unnest($2::uuid[]) WITH ORDINALITY AS o(id, ord)
+	WHERE aa.article_id = $1 AND aa.user_identifier = o.id;
+	`
+	_, err := database.Dbpool.Exec(ctx, reorder, articleID, order)
+	return err
+}
+
+func listArticleInvitations(ctx context.Context, identifier uuid.UUID) ([]ArticleInvitation, error) {
+	list := `
+	SELECT a.article_id, a.title, a.slug, aa.role, COALESCE(inviter.username, ''), aa.created_at
+	FROM article_authors aa
+	JOIN articles a ON a.article_id = aa.article_id
+	LEFT JOIN users inviter ON inviter.user_identifier = aa.invited_by_identifier
+	WHERE aa.user_identifier = $1 AND NOT aa.accepted AND a.deleted_at IS NULL
+	ORDER BY aa.created_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ArticleInvitation, error) {
+		var inv ArticleInvitation
+		var role string
+		err := row.Scan(&inv.ArticleID, &inv.Title, &inv.Slug, &role, &inv.InvitedBy, &inv.CreatedAt)
+		inv.Role = firstRune(role)
+		return inv, err
+	})
+}
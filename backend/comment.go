@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+const (
+	commentPageSize    = 20
+	maxCommentPageSize = 50
+	maxCommentLength   = 10000
+)
+
+// CommentPage is one page of top level comments with all their replies
+type CommentPage struct {
+	Sort       string    `json:"sort"`
+	Comments   []Message `json:"comments"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// commentCursor is the position after the last top level comment of a page,
+// replies is only used by the top sort
+type commentCursor struct {
+	replies   int
+	createdAt time.Time
+	id        uuid.UUID
+}
+
+func (c commentCursor) encode() string {
+	raw := fmt.Sprintf("%d|%d|%s", c.replies, c.createdAt.UnixNano(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCommentCursor(value string) (*commentCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid cursor")
+	}
+
+	replies, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.Parse(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return &commentCursor{replies: replies, createdAt: time.Unix(0, nanos).UTC(), id: id}, nil
+}
+
+// commentsApiHandler returns ?sort=oldest|newest|top comments of an article
+// as a tree, pass next_cursor back as ?cursor= for the next page
+func commentsApiHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	article, ok := commentArticle(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	sort := q.Get("sort")
+	switch sort {
+	case "":
+		sort = "oldest"
+	case "oldest", "newest", "top":
+	default:
+		renderJson(w, badCode, map[string]string{"error": "sort should be oldest, newest or top"})
+		return
+	}
+
+	cursor, err := decodeCommentCursor(q.Get("cursor"))
+	if err != nil {
+		renderJson(w, badCode, map[string]string{"error": "invalid cursor"})
+		return
+	}
+
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = commentPageSize
+	} else if limit > maxCommentPageSize {
+		limit = maxCommentPageSize
+	}
+
+	page, err := listCommentTree(ctx, article.ID, sort, cursor, limit)
+	if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error getting comments, try again"})
+		return
+	}
+
+	renderJson(w, statusOK, page)
+}
+
+// createCommentApiHandler takes {"content": "...", "parent_id": "..."},
+// parent_id is left out for top level comments
+func createCommentApiHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Content  string        `json:"content"`
+		ParentId uuid.NullUUID `json:"parent_id"`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		renderJson(w, unauthorized, map[string]string{"error": "please login to comment"})
+		return
+	}
+
+	article, ok := commentArticle(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body)
+	if err != nil {
+		renderJson(w, badCode, map[string]string{"error": "please provide comment content"})
+		return
+	}
+
+	body.Content = strings.TrimSpace(body.Content)
+	if body.Content == "" {
+		renderJson(w, badCode, map[string]string{"error": "comment is empty"})
+		return
+	} else if countCharacters(body.Content) > maxCommentLength {
+		renderJson(w, badCode, map[string]string{"error": fmt.Sprintf("comment should be less than %d characters", maxCommentLength)})
+		return
+	}
+
+	msg := Message{
+		AuthorUsername:   user.Username,
+		AuthorIdentifier: user.Identifier,
+		ParentId:         body.ParentId,
+		Content:          body.Content,
+		InTable:          'A',
+		InTableId:        article.ID,
+	}
+
+	msg, err = msg.insertMessage(ctx)
+	if errors.Is(err, errParentNotFound) || errors.Is(err, errTooDeep) {
+		renderJson(w, badCode, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error saving comment, try again"})
+		return
+	}
+
+	publishMessage(RoomKey{id: article.ID, roomtype: "article"}, "message_created", msg)
+	renderJson(w, statusOK, msg)
+}
+
+// commentArticle loads the article of a comments api call, drafts are only
+// commented on by the people who may read them
+func commentArticle(ctx context.Context, w http.ResponseWriter, r *http.Request) (Article, bool) {
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		renderJson(w, notFound, map[string]string{"error": "article not found"})
+		return Article{}, false
+	}
+
+	article, err := getArticle(ctx, Id)
+	if err != nil {
+		renderJson(w, notFound, map[string]string{"error": "article not found"})
+		return Article{}, false
+	}
+
+	if !article.IsPublished() {
+		user, err := userInfoMiddleware(r)
+		if err != nil || !user.canViewArticle(article) {
+			renderJson(w, notFound, map[string]string{"error": "article not found"})
+			return Article{}, false
+		}
+	}
+
+	return article, true
+}
+
+// the sort orders for top level comments, top is the most replied thread
+var commentOrders = map[string]struct{ after, order string }{
+	"oldest": {`(created_at, message_id) > ($3, $4)`, `created_at, message_id`},
+	"newest": {`(created_at, message_id) < ($3, $4)`, `created_at DESC, message_id DESC`},
+	"top":    {`(reply_count, created_at, message_id) < ($5, $3, $4)`, `reply_count DESC, created_at DESC, message_id DESC`},
+}
+
+// listCommentTree fetches a page of top level comments, then every reply
+// below them in one go and nests the replies in memory
+func listCommentTree(ctx context.Context, articleID uuid.UUID, sort string, cursor *commentCursor, limit int) (CommentPage, error) {
+	page := CommentPage{Sort: sort}
+	order := commentOrders[sort]
+
+	after := `TRUE`
+	args := []any{articleID, limit + 1}
+	if cursor != nil {
+		after = order.after
+		args = append(args, cursor.createdAt, cursor.id)
+		if sort == "top" {
+			args = append(args, cursor.replies)
+		}
+	}
+
+	listRoots := `
+	SELECT * FROM (
+	    SELECT ` + messageColumns + `,
+	           (SELECT COUNT(*) FROM messages d WHERE d.root_id = m.message_id AND d.deleted_at IS NULL)::int AS reply_count
+	    FROM messages m
+	    WHERE in_table = 'A' AND in_table_id = $1 AND parent_id IS NULL AND deleted_at IS NULL
+	) roots
+	WHERE ` + after + `
+	ORDER BY ` + order.order + `
+	LIMIT $2;
+	`
+	rows, err := database.Dbpool.Query(ctx, listRoots, args...)
+	if err != nil {
+		return CommentPage{}, err
+	}
+
+	roots, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Message, error) {
+		var replies int
+		m, err := scanMessage(row, &replies)
+		m.ReplyCount = replies
+		return m, err
+	})
+	if err != nil {
+		return CommentPage{}, err
+	}
+
+	// one extra row is fetched to know if there is a next page
+	if len(roots) > limit {
+		roots = roots[:limit]
+		last := roots[len(roots)-1]
+		page.NextCursor = commentCursor{replies: last.ReplyCount, createdAt: last.CreatedAt, id: last.MessageId}.encode()
+	}
+
+	if len(roots) == 0 {
+		page.Comments = []Message{}
+		return page, nil
+	}
+
+	rootIds := make([]uuid.UUID, len(roots))
+	for i, m := range roots {
+		rootIds[i] = m.MessageId
+	}
+
+	// trashed replies come along so the replies below them, which
+	// reply_count includes, still have a place in the tree
+	listReplies := `
+	SELECT ` + messageColumns + `, deleted_at IS NOT NULL
+	FROM messages
+	WHERE root_id = ANY($1)
+	ORDER BY depth, created_at;
+	`
+	rows, err = database.Dbpool.Query(ctx, listReplies, rootIds)
+	if err != nil {
+		return CommentPage{}, err
+	}
+
+	replies, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Message, error) {
+		var deleted bool
+		m, err := scanMessage(row, &deleted)
+		if deleted {
+			m = Message{MessageId: m.MessageId, ParentId: m.ParentId, Depth: m.Depth, CreatedAt: m.CreatedAt,
+				InTable: m.InTable, InTableId: m.InTableId, Deleted: true}
+		}
+		return m, err
+	})
+	if err != nil {
+		return CommentPage{}, err
+	}
+
+	children := make(map[uuid.UUID][]Message)
+	for _, m := range replies {
+		children[m.ParentId.UUID] = append(children[m.ParentId.UUID], m)
+	}
+
+	page.Comments = make([]Message, len(roots))
+	for i, root := range roots {
+		page.Comments[i] = nestReplies(root, children)
+	}
+	return page, nil
+}
+
+// nestReplies builds the tree below m, trashed replies stay as placeholders
+// only while something below them is not trashed
+func nestReplies(m Message, children map[uuid.UUID][]Message) Message {
+	for _, child := range children[m.MessageId] {
+		child = nestReplies(child, children)
+		if child.Deleted && len(child.Replies) == 0 {
+			continue
+		}
+		m.Replies = append(m.Replies, child)
+	}
+	if m.Depth > 0 {
+		m.ReplyCount = len(m.Replies)
+	}
+	return m
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sameer-gits/CMS/database"
+	"github.com/sameer-gits/CMS/storage"
+)
+
+// the export remembers when it last ran and how every forum looked here,
+// the next run only renders what changed since
+const exportStateFile = ".export-state"
+
+var siteLink = regexp.MustCompile(`(href|src|action)="(/[^/"][^"]*|/)"`)
+
+type exportState struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	Forums     map[string]string `json:"forums,omitempty"`
+}
+
+// exporter writes a static copy of the public site, every page links to
+// the others with relative paths so the folder works from disk as well
+type exporter struct {
+	out      string
+	since    time.Time
+	site     string
+	articles map[string]bool
+	forums   map[string]bool
+	// forum id to the fingerprint of its pages, last run's and this run's
+	oldForums  map[string]string
+	newForums  map[string]string
+	categories map[string]string
+	media      map[uuid.UUID]string
+	written    int
+	removed    int
+}
+
+// exportSite is the export command:
+//
+//	go run . export [-full] [-out ../export]
+//
+// it renders published articles, category pages and public forum
+// transcripts with the same views the server uses and copies frontend/public
+// next to them. Without -full only pages updated since the last export are
+// rendered again.
+func exportSite(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("out", "../export", "folder to write the site to")
+	full := flags.Bool("full", false, "render every page, not only the updated ones")
+	flags.Parse(args)
+
+	ex := &exporter{
+		out:        *out,
+		site:       strings.TrimSuffix(os.Getenv("SITE_URL"), "/"),
+		articles:   map[string]bool{},
+		forums:     map[string]bool{},
+		newForums:  map[string]string{},
+		categories: map[string]string{},
+		media:      map[uuid.UUID]string{},
+	}
+
+	// taken before reading anything so edits made during the export are
+	// picked up by the next one
+	startedAt := time.Now()
+
+	if !*full {
+		var state exportState
+		raw, err := os.ReadFile(filepath.Join(ex.out, exportStateFile))
+		if err == nil {
+			err = json.Unmarshal(raw, &state)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("reading export state: %w", err)
+		}
+		ex.since = state.ExportedAt
+		ex.oldForums = state.Forums
+	}
+
+	err := os.MkdirAll(ex.out, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = ex.copyPublic("../frontend/public", filepath.Join(ex.out, "public"))
+	if err != nil {
+		return fmt.Errorf("copying public assets: %w", err)
+	}
+
+	changedArticles, err := ex.loadArticles(ctx)
+	if err != nil {
+		return err
+	}
+	changedForums, err := ex.loadForums(ctx)
+	if err != nil {
+		return err
+	}
+	err = ex.loadCategories(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range changedArticles {
+		err = ex.exportArticle(ctx, id)
+		if err != nil {
+			return fmt.Errorf("article %s: %w", id, err)
+		}
+	}
+
+	for _, id := range changedForums {
+		err = ex.exportForum(ctx, id)
+		if err != nil {
+			return fmt.Errorf("forum %s: %w", id, err)
+		}
+	}
+
+	removed := ex.prune("a", ex.articles) + ex.prune("f", ex.forums)
+	categoryFiles := map[string]bool{}
+	for _, file := range ex.categories {
+		categoryFiles[strings.TrimPrefix(file, "category/")] = true
+	}
+	removed += ex.prune("category", categoryFiles)
+
+	// lists change whenever an article does
+	stale := len(changedArticles) > 0 || removed > 0 || !ex.exists("index.html")
+	for _, file := range ex.categories {
+		stale = stale || !ex.exists(file)
+	}
+	if stale {
+		err = ex.exportList(ctx, "index.html", ArticleFilter{})
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+		for name, file := range ex.categories {
+			err = ex.exportList(ctx, file, ArticleFilter{Category: name})
+			if err != nil {
+				return fmt.Errorf("category %s: %w", name, err)
+			}
+		}
+	}
+
+	raw, err := json.Marshal(exportState{ExportedAt: startedAt, Forums: ex.newForums})
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(ex.out, exportStateFile), raw, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("exported to %s: %d pages written, %d removed\n", ex.out, ex.written, ex.removed)
+	return nil
+}
+
+// loadArticles notes every published slug for link rewriting and returns
+// the articles that need rendering
+func (ex *exporter) loadArticles(ctx context.Context) ([]uuid.UUID, error) {
+	rows, err := database.Dbpool.Query(ctx, `SELECT article_id, slug, updated_at FROM articles WHERE status = 'P' AND deleted_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changed []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		var slug string
+		var updatedAt time.Time
+		err = rows.Scan(&id, &slug, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		ex.articles[slug+".html"] = true
+		if updatedAt.After(ex.since) || !ex.exists(filepath.Join("a", slug+".html")) {
+			changed = append(changed, id)
+		}
+	}
+	return changed, rows.Err()
+}
+
+// loadForums does the same for public forums and their topic pages. Pins,
+// locks and trashed messages leave no timestamp behind, so a forum changed
+// when the fingerprint of everything its pages show differs from last run's.
+func (ex *exporter) loadForums(ctx context.Context) ([]uuid.UUID, error) {
+	list := `
+	SELECT f.forum_id, f.forum_slug,
+	       ARRAY(SELECT t.topic_id FROM forum_topics t WHERE t.forum_id = f.forum_id),
+	       md5(concat_ws('|', f.forum_name, f.description, f.rules, f.forum_media_id, f.slow_mode_seconds, f.delete_at,
+	           (SELECT string_agg(concat_ws(',', t.topic_id, t.title, t.locked, t.pinned, t.last_reply_at), ';' ORDER BY t.topic_id)
+	            FROM forum_topics t WHERE t.forum_id = f.forum_id),
+	           (SELECT string_agg(concat_ws(',', p.message_id, p.pinned_at), ';' ORDER BY p.message_id)
+	            FROM forum_pins p WHERE p.forum_id = f.forum_id),
+	           (SELECT string_agg(a.announcement_id::text, ';' ORDER BY a.announcement_id)
+	            FROM forum_announcements a WHERE a.forum_id = f.forum_id),
+	           (SELECT concat_ws(',', COUNT(*) FILTER (WHERE m.deleted_at IS NULL), MAX(m.created_at), MAX(m.deleted_at))
+	            FROM messages m WHERE m.in_table = 'F' AND m.in_table_id = f.forum_id)))
+	FROM forums f
+	WHERE f.public AND f.deleted_at IS NULL;
+	`
+	rows, err := database.Dbpool.Query(ctx, list)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changed []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		var slug, fingerprint string
+		var topics []uuid.UUID
+		err = rows.Scan(&id, &slug, &topics, &fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		ex.forums[slug+".html"] = true
+		for _, topic := range topics {
+			ex.forums[slug+"/t/"+topic.String()+".html"] = true
+		}
+
+		ex.newForums[id.String()] = fingerprint
+		if ex.oldForums[id.String()] != fingerprint || !ex.exists(filepath.Join("f", slug+".html")) {
+			changed = append(changed, id)
+		}
+	}
+	return changed, rows.Err()
+}
+
+// loadCategories picks a file for every category with published articles
+func (ex *exporter) loadCategories(ctx context.Context) error {
+	list := `
+	SELECT DISTINCT c.category_name
+	FROM categories c JOIN articles a ON a.category_id = c.category_id
+	WHERE a.status = 'P' AND a.deleted_at IS NULL
+	ORDER BY c.category_name;
+	`
+	rows, err := database.Dbpool.Query(ctx, list)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+
+		slug := slugify(name, 64)
+		if slug == "" {
+			slug = "category"
+		}
+		file := "category/" + slug + ".html"
+		for n := 2; ex.categoryTaken(file); n++ {
+			file = fmt.Sprintf("category/%s-%d.html", slug, n)
+		}
+		ex.categories[name] = file
+	}
+	return rows.Err()
+}
+
+func (ex *exporter) categoryTaken(file string) bool {
+	for _, f := range ex.categories {
+		if f == file {
+			return true
+		}
+	}
+	return false
+}
+
+func (ex *exporter) exportArticle(ctx context.Context, id uuid.UUID) error {
+	article, err := getArticle(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	article.Series, err = getSeriesNav(ctx, article, DbUser{})
+	if err != nil {
+		log.Println("error getting series of article", article.ID, err)
+	}
+	article.Reactions, err = getReactions(ctx, article.ID, uuid.Nil)
+	if err != nil {
+		log.Println("error getting reactions of article", article.ID, err)
+	}
+
+	return ex.render(ctx, "a/"+article.Slug+".html", article, "article.html")
+}
+
+func (ex *exporter) exportForum(ctx context.Context, id uuid.UUID) error {
+	forum, err := getForum(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	topics, err := listForumTopics(ctx, forum.ID, uuid.Nil, 0)
+	if err != nil {
+		return err
+	}
+
+	// topics are noted first so the forum page links to their files
+	for _, topic := range topics {
+		ex.forums[forum.Slug+"/t/"+topic.ID.String()+".html"] = true
+	}
+
+	pins, err := listForumPins(ctx, forum.ID)
+	if err != nil {
+		return err
+	}
+	announcements, err := listForumAnnouncements(ctx, forum.ID)
+	if err != nil {
+		return err
+	}
+
+	auth := ForumAuth{CanRead: true}
+	for _, topic := range topics {
+		messages, err := listAllTopicMessages(ctx, topic.ID)
+		if err != nil {
+			return err
+		}
+
+		page := TopicPage{ForumAuth: auth, Forum: forum, Topic: topic, Messages: messages, Pins: pins, Announcements: announcements}
+		err = ex.render(ctx, "f/"+forum.Slug+"/t/"+topic.ID.String()+".html", page, "topic.html")
+		if err != nil {
+			return err
+		}
+	}
+
+	page := ForumPage{ForumAuth: auth, Forum: forum, Topics: topics, Pins: pins, Announcements: announcements}
+	return ex.render(ctx, "f/"+forum.Slug+".html", page, "forum.html")
+}
+
+func (ex *exporter) exportList(ctx context.Context, file string, filter ArticleFilter) error {
+	articles, err := listArticles(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	return ex.render(ctx, file, ArticlesPage{Filter: filter, Articles: articles}, "articles.html")
+}
+
+// render runs the views like renderHtml and writes the page with its links
+// rewritten, file is slash separated and relative to the export folder
+func (ex *exporter) render(ctx context.Context, file string, data interface{}, views ...string) error {
+	var buf bytes.Buffer
+	err := executeHtml(&buf, ex.site, data, nil, views...)
+	if err != nil {
+		return err
+	}
+
+	page, err := ex.rewriteLinks(ctx, file, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ex.out, filepath.FromSlash(file))
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	ex.written++
+	return os.WriteFile(path, page, 0644)
+}
+
+// rewriteLinks points site links at the exported files relative to file.
+// Links to pages that are not exported go to SITE_URL when it is set.
+func (ex *exporter) rewriteLinks(ctx context.Context, file string, page []byte) ([]byte, error) {
+	up := strings.Repeat("../", strings.Count(file, "/"))
+
+	var err error
+	page = siteLink.ReplaceAllFunc(page, func(m []byte) []byte {
+		parts := siteLink.FindSubmatch(m)
+		attr, link := string(parts[1]), string(parts[2])
+
+		target, linkErr := ex.target(ctx, link)
+		if linkErr != nil {
+			err = linkErr
+			return m
+		}
+
+		if target == "" {
+			if ex.site == "" {
+				return m
+			}
+			target = ex.site + link
+		} else {
+			target = up + target
+		}
+		return []byte(attr + `="` + target + `"`)
+	})
+	return page, err
+}
+
+// target is the exported file a site link points to, "" when there is none
+func (ex *exporter) target(ctx context.Context, link string) (string, error) {
+	path, fragment, _ := strings.Cut(link, "#")
+	if fragment != "" {
+		fragment = "#" + fragment
+	}
+	path, query, _ := strings.Cut(path, "?")
+
+	switch {
+	case path == "/" || path == "/articles":
+		q, _ := url.ParseQuery(query)
+		if c := q.Get("category"); c != "" {
+			if file, ok := ex.categories[c]; ok {
+				return file + fragment, nil
+			}
+			return "", nil
+		}
+		if query == "" {
+			return "index.html" + fragment, nil
+		}
+	case strings.HasPrefix(path, "/a/"):
+		if file := strings.TrimPrefix(path, "/a/") + ".html"; ex.articles[file] {
+			return "a/" + file + fragment, nil
+		}
+	case strings.HasPrefix(path, "/f/"):
+		if file := strings.TrimPrefix(path, "/f/") + ".html"; ex.forums[file] {
+			return "f/" + file + fragment, nil
+		}
+	case strings.HasPrefix(path, "/public/"):
+		return strings.TrimPrefix(path, "/"), nil
+	case strings.HasPrefix(path, "/media/"):
+		id, err := uuid.Parse(strings.TrimPrefix(path, "/media/"))
+		if err != nil {
+			return "", nil
+		}
+		return ex.copyMedia(ctx, id)
+	}
+	return "", nil
+}
+
+// copyMedia copies a media file once, media never changes for an id
+func (ex *exporter) copyMedia(ctx context.Context, id uuid.UUID) (string, error) {
+	if file, ok := ex.media[id]; ok {
+		return file, nil
+	}
+
+	media, err := getMedia(ctx, id)
+	if err != nil {
+		// a deleted file stays a dead link, like on the site
+		ex.media[id] = ""
+		return "", nil
+	}
+
+	file := "media/" + id.String() + allowedMediaTypes[media.ContentType]
+	ex.media[id] = file
+	if ex.exists(file) {
+		return file, nil
+	}
+
+	body, err := storage.Media.Get(ctx, media.StorageKey)
+	if err != nil {
+		return "", fmt.Errorf("reading media %s: %w", id, err)
+	}
+	defer body.Close()
+
+	return file, ex.writeFile(file, body)
+}
+
+func (ex *exporter) writeFile(file string, r io.Reader) error {
+	path := filepath.Join(ex.out, filepath.FromSlash(file))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (ex *exporter) exists(file string) bool {
+	_, err := os.Stat(filepath.Join(ex.out, filepath.FromSlash(file)))
+	return err == nil
+}
+
+// copyPublic copies stylesheets, scripts and images that are newer than
+// the exported copy
+func (ex *exporter) copyPublic(src, dst string) error {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if copied, err := os.Stat(target); err == nil && !info.ModTime().After(copied.ModTime()) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		rel, err = filepath.Rel(ex.out, target)
+		if err != nil {
+			return err
+		}
+		return ex.writeFile(filepath.ToSlash(rel), f)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Println("no public assets found in", src)
+		return nil
+	}
+	return err
+}
+
+// prune removes pages below dir that are no longer published, keep has
+// them slash separated and relative to dir. Folders left empty go as well.
+func (ex *exporter) prune(dir string, keep map[string]bool) int {
+	root := filepath.Join(ex.out, dir)
+
+	removed := 0
+	var folders []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != root {
+				folders = append(folders, path)
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || keep[filepath.ToSlash(rel)] || filepath.Ext(path) != ".html" {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			log.Println("error removing", path, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+
+	// deepest first, removing a folder that still has files fails harmlessly
+	for i := len(folders) - 1; i >= 0; i-- {
+		os.Remove(folders[i])
+	}
+
+	ex.removed += removed
+	return removed
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sameer-gits/CMS/database"
+)
+
+const (
+	feedSummaryLength = 300
+	forumFeedSize     = 50
+)
+
+type Feed struct {
+	Title       string
+	Description string
+	URL         string
+	FeedURL     string
+	Updated     time.Time
+	Items       []FeedItem
+}
+
+type FeedItem struct {
+	ID        uuid.UUID
+	Title     string
+	URL       string
+	Author    string
+	Content   string
+	Published time.Time
+	Updated   time.Time
+}
+
+// RSS 2.0
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DcNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	AtomLink      rssAtomLink `xml:"atom:link"`
+	LastBuildDate string      `xml:"lastBuildDate"`
+	Items         []rssItem   `xml:"item"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	Creator     string  `xml:"dc:creator"`
+	Guid        rssGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// Atom 1.0
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Sub     string      `xml:"subtitle,omitempty"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Links     []atomLink `xml:"link"`
+	Author    atomPerson `xml:"author"`
+	Summary   *atomText  `xml:"summary,omitempty"`
+	Content   *atomText  `xml:"content,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// siteURL is used for absolute links, SITE_URL wins over the request host
+func siteURL(r *http.Request) string {
+	if u := os.Getenv("SITE_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func articlesFeedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	feed, err := articlesFeed(ctx, siteURL(r), ArticleFilter{}, "Articles", "Latest articles")
+	if err != nil {
+		http.Error(w, "error building feed", serverCode)
+		return
+	}
+	writeFeed(w, r, feed)
+}
+
+func categoryFeedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	category := r.PathValue("category")
+	exists, err := rowExists(ctx, `SELECT EXISTS (SELECT 1 FROM categories WHERE category_name = $1)`, category)
+	if err != nil || !exists {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	filter := ArticleFilter{Category: category}
+	feed, err := articlesFeed(ctx, siteURL(r), filter, category, "Latest articles in "+category)
+	if err != nil {
+		http.Error(w, "error building feed", serverCode)
+		return
+	}
+	writeFeed(w, r, feed)
+}
+
+func authorFeedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	username := r.PathValue("username")
+	exists, err := rowExists(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)`, username)
+	if err != nil || !exists {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	filter := ArticleFilter{Author: username}
+	feed, err := articlesFeed(ctx, siteURL(r), filter, username, "Latest articles by "+username)
+	if err != nil {
+		http.Error(w, "error building feed", serverCode)
+		return
+	}
+	writeFeed(w, r, feed)
+}
+
+func forumFeedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, _, err := resolveSlug(ctx, slugForum, r.PathValue("slug"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	forum, err := getForum(ctx, Id)
+	if err != nil || !forum.Public {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	messages, err := listMessages(ctx, 'F', forum.ID, forumFeedSize)
+	if err != nil {
+		http.Error(w, "error building feed", serverCode)
+		return
+	}
+
+	base := siteURL(r)
+	feed := Feed{
+		Title:       forum.Name,
+		Description: "Latest messages in " + forum.Name,
+		URL:         base + forumURL(forum.Slug),
+		Updated:     forum.CreatedAt,
+	}
+	for _, m := range messages {
+		feed.Items = append(feed.Items, FeedItem{
+			ID:        m.MessageId,
+			Title:     m.AuthorUsername + " in " + forum.Name,
+			URL:       base + topicURL(forum.Slug, m.TopicId.UUID) + "#message-" + m.MessageId.String(),
+			Author:    m.AuthorUsername,
+			Content:   m.Content,
+			Published: m.CreatedAt,
+			Updated:   m.CreatedAt,
+		})
+		if m.CreatedAt.After(feed.Updated) {
+			feed.Updated = m.CreatedAt
+		}
+	}
+	writeFeed(w, r, feed)
+}
+
+func articlesFeed(ctx context.Context, base string, filter ArticleFilter, title, description string) (Feed, error) {
+	articles, err := listArticles(ctx, filter)
+	if err != nil {
+		return Feed{}, err
+	}
+
+	feed := Feed{
+		Title:       title,
+		Description: description,
+		URL:         base + "/articles",
+		Updated:     time.Unix(0, 0),
+	}
+	for _, a := range articles {
+		item := FeedItem{
+			ID:        a.ID,
+			Title:     a.Title,
+			URL:       base + articleURL(a.Slug),
+			Author:    a.Byline(),
+			Content:   a.Content,
+			Published: a.CreatedAt,
+			Updated:   a.UpdatedAt,
+		}
+		if a.PublishedAt != nil {
+			item.Published = *a.PublishedAt
+		}
+		if item.Updated.Before(item.Published) {
+			item.Updated = item.Published
+		}
+		if item.Updated.After(feed.Updated) {
+			feed.Updated = item.Updated
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return feed, nil
+}
+
+// writeFeed renders feed as rss or atom from the {format} path value, ?mode=summary
+// leaves out the full content. The ETag covers every item so readers skip
+// unchanged feeds, Last-Modified is only informative as deleting an item can
+// move it backwards.
+func writeFeed(w http.ResponseWriter, r *http.Request, feed Feed) {
+	format := r.PathValue("format")
+	summary := r.URL.Query().Get("mode") == "summary"
+	feed.FeedURL = siteURL(r) + r.URL.RequestURI()
+
+	if format != "rss" && format != "atom" {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	updated := feed.Updated.UTC().Truncate(time.Second)
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s|%s", feed.FeedURL, format)
+	for _, item := range feed.Items {
+		fmt.Fprintf(hash, "|%s:%d", item.ID, item.Updated.UnixNano())
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var doc interface{}
+	contentType := "application/rss+xml; charset=utf-8"
+	if format == "atom" {
+		doc = feed.atom(summary)
+		contentType = "application/atom+xml; charset=utf-8"
+	} else {
+		doc = feed.rss(summary)
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		http.Error(w, "error building feed", serverCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// notModified answers from If-None-Match only, If-Modified-Since can't tell
+// that an item was deleted
+func notModified(r *http.Request, etag string) bool {
+	for _, m := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if m = strings.TrimSpace(m); m == etag || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (feed Feed) rss(summary bool) rssFeed {
+	channel := rssChannel{
+		Title:         feed.Title,
+		Link:          feed.URL,
+		Description:   feed.Description,
+		AtomLink:      rssAtomLink{Href: feed.FeedURL, Rel: "self", Type: "application/rss+xml"},
+		LastBuildDate: feed.Updated.UTC().Format(time.RFC1123Z),
+	}
+	for _, item := range feed.Items {
+		description := item.Content
+		if summary {
+			description = summarize(item.Content, feedSummaryLength)
+		}
+		channel.Items = append(channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.URL,
+			Description: description,
+			Creator:     item.Author,
+			Guid:        rssGuid{IsPermaLink: false, Value: "urn:uuid:" + item.ID.String()},
+			PubDate:     item.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+
+	return rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DcNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: channel,
+	}
+}
+
+func (feed Feed) atom(summary bool) atomFeed {
+	doc := atomFeed{
+		Title:   feed.Title,
+		Sub:     feed.Description,
+		ID:      feed.FeedURL,
+		Updated: feed.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: feed.FeedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: feed.URL, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, item := range feed.Items {
+		entry := atomEntry{
+			Title:     item.Title,
+			ID:        "urn:uuid:" + item.ID.String(),
+			Updated:   item.Updated.UTC().Format(time.RFC3339),
+			Published: item.Published.UTC().Format(time.RFC3339),
+			Links:     []atomLink{{Href: item.URL, Rel: "alternate", Type: "text/html"}},
+			Author:    atomPerson{Name: item.Author},
+			Summary:   &atomText{Type: "text", Body: summarize(item.Content, feedSummaryLength)},
+		}
+		if !summary {
+			entry.Content = &atomText{Type: "text", Body: item.Content}
+		}
+		doc.Entries = append(doc.Entries, entry)
+	}
+	return doc
+}
+
+// summarize cuts s to about n characters without breaking a word
+func summarize(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if countCharacters(s) <= n {
+		return s
+	}
+	cut := string([]rune(s)[:n])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+func rowExists(ctx context.Context, query string, args ...any) (bool, error) {
+	var exists bool
+	err := database.Dbpool.QueryRow(ctx, query, args...).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
@@ -13,12 +13,47 @@ import (
 type Forum struct {
 	ID                  uuid.UUID
 	Name                string
-	ForumImage          []byte
+	Slug                string
+	ForumMediaID        uuid.NullUUID
+	Description         string
+	Rules               string
+	SlowModeSeconds     int
 	Public              bool
+	SectionID           uuid.NullUUID
 	CreatedAt           time.Time
 	CreatedByIdentifier uuid.UUID
+	// PendingOwnerIdentifier is set while ownership is offered to a member
+	PendingOwnerIdentifier uuid.NullUUID
+	DeleteAt               *time.Time
 }
 
+// ForumPage is a forum with its topics, pinned ones first and then by last
+// reply, its pinned messages and latest announcements. Those are only loaded
+// when CanRead. Requested tells a pending join request of a private forum.
+type ForumPage struct {
+	ForumAuth
+	Forum         Forum
+	Topics        []ForumTopic
+	Pins          []ForumPin
+	Announcements []ForumAnnouncement
+	User          DbUser
+	Requested     bool
+}
+
+// CanPost tells if the viewer may start topics
+func (p ForumPage) CanPost() bool {
+	return p.Can(permPost)
+}
+
+// OwnershipOffered tells if the viewer was offered the forum and has to
+// accept or decline
+func (p ForumPage) OwnershipOffered() bool {
+	return p.Forum.PendingOwnerIdentifier.Valid && p.Forum.PendingOwnerIdentifier.UUID == p.User.Identifier
+}
+
+// topics shown on a forum page
+const forumPageSize = 100
+
 func createForumHandler(w http.ResponseWriter, r *http.Request) {
 	var forum Forum
 	var errs []error
@@ -35,12 +70,13 @@ func createForumHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the form is on the profile, errors are shown there and a new forum
+	// is opened right away
 	defer func() {
 		if len(errs) > 0 {
-			w.WriteHeader(badCode)
-			renderHtml(w, forum, errs, "user.html")
-		} else if len(errs) == 0 {
-			renderHtml(w, forum, errs, "user.html")
+			renderUserPage(ctx, w, r, user, errs)
+		} else {
+			http.Redirect(w, r, forumURL(forum.Slug), http.StatusFound)
 		}
 	}()
 
@@ -48,6 +84,10 @@ func createForumHandler(w http.ResponseWriter, r *http.Request) {
 		errs = append(errs, errors.New("forum name should be less than 128 characters"))
 		return
 	}
+	if hasControlChars(forumName) {
+		errs = append(errs, errForumNameControl)
+		return
+	}
 
 	var public bool
 	if forumPublic == "true" {
@@ -62,6 +102,19 @@ func createForumHandler(w http.ResponseWriter, r *http.Request) {
 		Public:              public,
 	}
 
+	if sectionID := r.FormValue("section"); sectionID != "" {
+		section, err := getForumSection(ctx, sectionID)
+		if err != nil {
+			errs = append(errs, errors.New("section not found"))
+			return
+		}
+		if !section.canCreateForum(user) {
+			errs = append(errs, errors.New("only staff can create forums in this section"))
+			return
+		}
+		forum.SectionID = uuid.NullUUID{UUID: section.ID, Valid: true}
+	}
+
 	createForum, err := forum.create(ctx)
 	if err != nil {
 		errs = append(errs, errors.New("error creating forum, try again"))
@@ -80,11 +133,17 @@ func (forum Forum) create(ctx context.Context) (Forum, error) {
 	}
 	defer tx.Rollback(ctx)
 
-	insertForum := `INSERT INTO forums (forum_name, public, created_by_identifier)
-                    VALUES ($1, $2, $3)
-                    RETURNING forum_id, forum_name, forum_image, public, created_at, created_by_identifier`
-	err = tx.QueryRow(ctx, insertForum, forum.Name, forum.Public, forum.CreatedByIdentifier).Scan(
-		&result.ID, &result.Name, &result.ForumImage, &result.Public, &result.CreatedAt, &result.CreatedByIdentifier)
+	slug, err := uniqueSlug(ctx, tx, slugForum, slugify(forum.Name, 128), uuid.Nil, 128)
+	if err != nil {
+		return Forum{}, err
+	}
+
+	insertForum := `INSERT INTO forums (forum_name, forum_slug, public, section_id, created_by_identifier)
+                    VALUES ($1, $2, $3, $4, $5)
+                    RETURNING forum_id, forum_name, forum_slug, forum_media_id, public, section_id, created_at, created_by_identifier`
+	err = tx.QueryRow(ctx, insertForum, forum.Name, slug, forum.Public, forum.SectionID, forum.CreatedByIdentifier).Scan(
+		&result.ID, &result.Name, &result.Slug, &result.ForumMediaID, &result.Public, &result.SectionID, &result.CreatedAt,
+		&result.CreatedByIdentifier)
 	if err != nil {
 		return Forum{}, err
 	}
@@ -105,68 +164,114 @@ func (forum Forum) create(ctx context.Context) (Forum, error) {
 	if err != nil {
 		return Forum{}, err
 	}
+	forgetForumMember(ctx, result.ID, forum.CreatedByIdentifier)
 
 	return result, nil
 }
 
 func viewForumHandler(w http.ResponseWriter, r *http.Request) {
 	var errs []error
-	var forum_user struct {
-		forumData Forum
-		User      DbUser
+	var page ForumPage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, current, err := resolveSlug(ctx, slugForum, r.PathValue("slug"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	forum, err := getForum(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	// renamed forum, send the old link to the new one
+	if !current {
+		http.Redirect(w, r, forumURL(forum.Slug), http.StatusMovedPermanently)
+		return
 	}
 
 	defer func() {
 		if len(errs) > 0 {
 			http.Redirect(w, r, "/404", notFound)
 		} else if len(errs) == 0 {
-			renderHtml(w, forum_user, errs, "forum.html")
+			renderHtml(w, r, page, errs, "forum.html")
 		}
 	}()
 
-	user, err := userInfoMiddleware(r)
+	// visitors read public forums, private ones show members only
+	user, _ := userInfoMiddleware(r)
+
+	page, err = forumPage(ctx, forum, user)
 	if err != nil {
-		http.Redirect(w, r, "/logout", badCode)
+		errs = append(errs, errors.New("error getting topics, try again"))
 		return
 	}
+}
+
+// forumPage loads what user gets to see of forum
+func forumPage(ctx context.Context, forum Forum, user DbUser) (ForumPage, error) {
+	var err error
+	page := ForumPage{Forum: forum, User: user}
 
-	Id, err := uuid.Parse(r.PathValue("id"))
+	page.ForumAuth, err = authorizeForum(ctx, forum, user)
 	if err != nil {
-		errs = append(errs, err)
-		return
+		return ForumPage{}, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	if user.Identifier != uuid.Nil && !page.Member && !forum.Public {
+		page.Requested, err = rowExists(ctx,
+			`SELECT EXISTS (SELECT 1 FROM forum_join_requests WHERE forum_id = $1 AND user_identifier = $2)`,
+			forum.ID, user.Identifier)
+		if err != nil {
+			return ForumPage{}, err
+		}
+	}
 
-	forum, err := getForum(ctx, Id)
+	if !page.CanRead {
+		return page, nil
+	}
+
+	page.Topics, err = listForumTopics(ctx, forum.ID, user.Identifier, forumPageSize)
 	if err != nil {
-		errs = append(errs, errors.New("forum not found"))
-		return
+		return ForumPage{}, err
 	}
-	forum_user = struct {
-		forumData Forum
-		User      DbUser
-	}{
-		forumData: forum,
-		User:      user,
+	page.Pins, err = listForumPins(ctx, forum.ID)
+	if err != nil {
+		return ForumPage{}, err
+	}
+	page.Announcements, err = listForumAnnouncements(ctx, forum.ID)
+	if err != nil {
+		return ForumPage{}, err
 	}
+	return page, nil
 }
 
 func getForum(ctx context.Context, Id uuid.UUID) (Forum, error) {
 	var forum Forum
 
 	getbyId := `
-	SELECT forum_id, forum_name, forum_image, public, created_at, created_by_identifier
-	FROM forums WHERE forum_id = $1;
+	SELECT forum_id, forum_name, forum_slug, forum_media_id, description, rules, slow_mode_seconds, public,
+	       section_id, created_at, created_by_identifier, pending_owner_identifier, delete_at
+	FROM forums WHERE forum_id = $1 AND deleted_at IS NULL;
 	`
 	err := database.Dbpool.QueryRow(ctx, getbyId, Id).Scan(
 		&forum.ID,
 		&forum.Name,
-		&forum.ForumImage,
+		&forum.Slug,
+		&forum.ForumMediaID,
+		&forum.Description,
+		&forum.Rules,
+		&forum.SlowModeSeconds,
 		&forum.Public,
+		&forum.SectionID,
 		&forum.CreatedAt,
 		&forum.CreatedByIdentifier,
+		&forum.PendingOwnerIdentifier,
+		&forum.DeleteAt,
 	)
 
 	if err != nil {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// announcements shown on forum and topic pages, older ones stay in the database
+const forumAnnouncementsShown = 5
+
+// ForumAnnouncement is a notice to everyone in a forum, AuthorUsername is
+// empty once the author deleted their account
+type ForumAnnouncement struct {
+	ID             uuid.UUID `json:"announcement_id"`
+	AuthorUsername string    `json:"author_username"`
+	Content        string    `json:"content"`
+	Emailed        bool      `json:"emailed"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// AnnouncementEvent is sent to the forum and all its topics when an
+// announcement is made or removed
+type AnnouncementEvent struct {
+	Event        string            `json:"event"`
+	Announcement ForumAnnouncement `json:"announcement"`
+}
+
+// announceForumHandler pushes an announcement to every open page of the
+// forum, with email ticked it is also mailed to the members
+func announceForumHandler(w http.ResponseWriter, r *http.Request) {
+	forumAction(w, r, func(ctx context.Context, user DbUser, forum Forum) (string, []error) {
+		var errs []error
+
+		auth, err := authorizeForum(ctx, forum, user)
+		if err != nil {
+			return "", append(errs, errors.New("something went wrong in server try again"))
+		}
+		if !auth.Can(permAnnounce) {
+			return "", append(errs, errors.New("only forum mods and admins can make announcements"))
+		}
+
+		content := strings.TrimSpace(r.FormValue("content"))
+		if content == "" {
+			return "", append(errs, errors.New("announcement is empty try again"))
+		} else if countCharacters(content) > 2000 {
+			return "", append(errs, errors.New("announcement should be less than 2000 characters"))
+		}
+		email := r.FormValue("email") == "true"
+
+		announcement := ForumAnnouncement{AuthorUsername: user.Username, Content: content, Emailed: email}
+		insert := `
+		INSERT INTO forum_announcements (forum_id, author_identifier, content, emailed)
+		VALUES ($1, $2, $3, $4)
+		RETURNING announcement_id, created_at;
+		`
+		err = database.Dbpool.QueryRow(ctx, insert, forum.ID, user.Identifier, content, email).Scan(
+			&announcement.ID, &announcement.CreatedAt)
+		if err != nil {
+			return "", append(errs, errors.New("error making announcement, try again"))
+		}
+
+		publishAnnouncement(ctx, forum.ID, "announcement", announcement)
+
+		if email {
+			err = mailForumMembers(ctx, forum.ID, "Announcement in "+forum.Name,
+				content+"\r\n"+siteURL(r)+forumURL(forum.Slug)+"\r\n")
+			if err != nil {
+				log.Println("error mailing forum announcement:", err)
+			}
+		}
+		return forumURL(forum.Slug), nil
+	})
+}
+
+func removeAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	forumAction(w, r, func(ctx context.Context, user DbUser, forum Forum) (string, []error) {
+		var errs []error
+
+		auth, err := authorizeForum(ctx, forum, user)
+		if err != nil {
+			return "", append(errs, errors.New("something went wrong in server try again"))
+		}
+		if !auth.Can(permAnnounce) {
+			return "", append(errs, errors.New("only forum mods and admins can remove announcements"))
+		}
+
+		Id, err := uuid.Parse(r.PathValue("announcement"))
+		if err != nil {
+			return "", append(errs, errors.New("announcement not found"))
+		}
+
+		remove := `DELETE FROM forum_announcements WHERE announcement_id = $1 AND forum_id = $2`
+		tag, err := database.Dbpool.Exec(ctx, remove, Id, forum.ID)
+		if err != nil {
+			return "", append(errs, errors.New("error removing announcement, try again"))
+		}
+		if tag.RowsAffected() == 0 {
+			return "", append(errs, errors.New("announcement not found"))
+		}
+
+		publishAnnouncement(ctx, forum.ID, "announcement_removed", ForumAnnouncement{ID: Id})
+		return forumURL(forum.Slug), nil
+	})
+}
+
+func publishAnnouncement(ctx context.Context, forumID uuid.UUID, event string, announcement ForumAnnouncement) {
+	eventByte, err := json.Marshal(AnnouncementEvent{Event: event, Announcement: announcement})
+	if err != nil {
+		return
+	}
+	publishForum(ctx, forumID, eventByte)
+}
+
+// mailForumMembers mails every member who is not banned, smtp is slow so
+// the mails go out after the request
+func mailForumMembers(ctx context.Context, forumID uuid.UUID, subject, body string) error {
+	list := `
+	SELECT u.email
+	FROM forum_users fu
+	JOIN users u ON u.user_identifier = fu.user_identifier
+	WHERE fu.forum_id = $1 AND NOT EXISTS (
+	    SELECT 1 FROM forum_sanctions s
+	    WHERE s.forum_id = fu.forum_id AND s.user_identifier = fu.user_identifier AND s.kind = 'B'
+	      AND (s.expires_at IS NULL OR s.expires_at > CURRENT_TIMESTAMP));
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return err
+	}
+	emails, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for _, email := range emails {
+			err := mailUser(email, subject, body)
+			if err != nil {
+				log.Println("error mailing forum member:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// listForumAnnouncements returns the latest announcements of a forum
+func listForumAnnouncements(ctx context.Context, forumID uuid.UUID) ([]ForumAnnouncement, error) {
+	list := `
+	SELECT a.announcement_id, COALESCE(u.username, ''), a.content, a.emailed, a.created_at
+	FROM forum_announcements a
+	LEFT JOIN users u ON u.user_identifier = a.author_identifier
+	WHERE a.forum_id = $1
+	ORDER BY a.created_at DESC
+	LIMIT $2;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID, forumAnnouncementsShown)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumAnnouncement, error) {
+		var a ForumAnnouncement
+		err := row.Scan(&a.ID, &a.AuthorUsername, &a.Content, &a.Emailed, &a.CreatedAt)
+		return a, err
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// days between asking to delete a forum and it going to the trash, enough
+// for admins to export the messages or change their mind
+const forumDeletionDays = 7
+
+// ForumExport is the download admins get of a forum's messages, topics
+// carry their messages oldest first
+type ForumExport struct {
+	Name       string               `json:"name"`
+	Slug       string               `json:"slug"`
+	ExportedAt time.Time            `json:"exported_at"`
+	Topics     []ForumExportedTopic `json:"topics"`
+}
+
+type ForumExportedTopic struct {
+	ForumTopic
+	Messages []Message `json:"messages"`
+}
+
+// settingsAction loads the settings page for a settings form and runs
+// action, errors are shown on the settings page and success goes back to it
+func settingsAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, user DbUser, page ForumSettingsPage) []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := forumSettingsPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	errs := action(ctx, user, page)
+	if len(errs) > 0 {
+		if reloaded, err := forumSettingsPage(ctx, r, user); err == nil {
+			page = reloaded
+		}
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "forumSettings.html")
+		return
+	}
+
+	http.Redirect(w, r, "/forum/"+page.Forum.ID.String()+"/settings", http.StatusFound)
+}
+
+// scheduleForumDeletionHandler puts the forum up for deletion after
+// forumDeletionDays, the owner confirms by typing its name. Staff is told so
+// they can export the messages first.
+func scheduleForumDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	settingsAction(w, r, func(ctx context.Context, user DbUser, page ForumSettingsPage) []error {
+		var errs []error
+
+		if !page.Owner {
+			return append(errs, errors.New("only the forum owner can delete it"))
+		}
+		if page.Forum.DeleteAt != nil {
+			return append(errs, errors.New("the forum is already scheduled for deletion"))
+		}
+		if r.FormValue("confirmName") != page.Forum.Name {
+			return append(errs, errors.New("type the forum name exactly to confirm deletion"))
+		}
+
+		var deleteAt time.Time
+		schedule := `
+		UPDATE forums SET delete_at = CURRENT_TIMESTAMP + make_interval(days => $2)
+		WHERE forum_id = $1 AND delete_at IS NULL
+		RETURNING delete_at;
+		`
+		err := database.Dbpool.QueryRow(ctx, schedule, page.Forum.ID, forumDeletionDays).Scan(&deleteAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return append(errs, errors.New("the forum is already scheduled for deletion"))
+		} else if err != nil {
+			return append(errs, errors.New("error scheduling deletion, try again"))
+		}
+
+		content := fmt.Sprintf("%s scheduled the forum \"%s\" for deletion on %s, export its messages from the settings page before then.",
+			user.Username, page.Forum.Name, deleteAt.Format("2 Jan 2006 15:04"))
+		notifyForumStaff(ctx, page.Forum, user, "Forum scheduled for deletion", content, siteURL(r))
+		return nil
+	})
+}
+
+func cancelForumDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	settingsAction(w, r, func(ctx context.Context, user DbUser, page ForumSettingsPage) []error {
+		var errs []error
+
+		if !page.Owner {
+			return append(errs, errors.New("only the forum owner can cancel its deletion"))
+		}
+
+		cancel := `UPDATE forums SET delete_at = NULL WHERE forum_id = $1 AND delete_at IS NOT NULL`
+		tag, err := database.Dbpool.Exec(ctx, cancel, page.Forum.ID)
+		if err != nil {
+			return append(errs, errors.New("error cancelling deletion, try again"))
+		}
+		if tag.RowsAffected() == 0 {
+			return append(errs, errors.New("the forum is not scheduled for deletion"))
+		}
+
+		content := fmt.Sprintf("%s cancelled the deletion of the forum \"%s\".", user.Username, page.Forum.Name)
+		notifyForumStaff(ctx, page.Forum, user, "Forum deletion cancelled", content, siteURL(r))
+		return nil
+	})
+}
+
+// notifyForumStaff tells the forum's admins and mods, except user, about a
+// change to the whole forum
+func notifyForumStaff(ctx context.Context, forum Forum, user DbUser, subject, content, base string) {
+	staff, err := listForumStaff(ctx, forum.ID)
+	if err != nil {
+		log.Println("error getting forum staff:", err)
+		return
+	}
+	for _, s := range staff {
+		if s == user.Identifier {
+			continue
+		}
+		err = notifyUser(ctx, s, subject, content, forumURL(forum.Slug), base)
+		if err != nil {
+			log.Println("error notifying forum staff:", err)
+		}
+	}
+}
+
+// exportForumMessagesHandler downloads every topic of the forum with its
+// messages as json, trashed messages are left out
+func exportForumMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := forumSettingsPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	export, err := exportForumMessages(ctx, page.Forum)
+	if err != nil {
+		log.Println("error exporting forum:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		renderHtml(w, r, page, []error{errors.New("error exporting messages, try again")}, "forumSettings.html")
+		return
+	}
+
+	filename := page.Forum.Slug + "-messages.json"
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	renderJson(w, http.StatusOK, export)
+}
+
+func exportForumMessages(ctx context.Context, forum Forum) (ForumExport, error) {
+	export := ForumExport{Name: forum.Name, Slug: forum.Slug, ExportedAt: time.Now()}
+
+	topics, err := listForumTopics(ctx, forum.ID, uuid.Nil, 0)
+	if err != nil {
+		return ForumExport{}, err
+	}
+	for _, t := range topics {
+		messages, err := listAllTopicMessages(ctx, t.ID)
+		if err != nil {
+			return ForumExport{}, err
+		}
+		export.Topics = append(export.Topics, ForumExportedTopic{ForumTopic: t, Messages: messages})
+	}
+	return export, nil
+}
+
+// deleteDueForums moves forums whose cool-off ended to the trash, where
+// their admins can still restore them until purgeTrash. Everyone still on
+// one of their pages is disconnected.
+func deleteDueForums(ctx context.Context) error {
+	due := `
+	UPDATE forums SET deleted_at = CURRENT_TIMESTAMP, delete_at = NULL
+	WHERE forum_id IN (
+	    SELECT forum_id FROM forums
+	    WHERE delete_at <= CURRENT_TIMESTAMP AND deleted_at IS NULL
+	    ORDER BY delete_at
+	    LIMIT 100
+	    FOR UPDATE SKIP LOCKED)
+	RETURNING forum_id;
+	`
+	rows, err := database.Dbpool.Query(ctx, due)
+	if err != nil {
+		return err
+	}
+	deleted, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return err
+	}
+
+	for _, id := range deleted {
+		closeForumSubscribers(ctx, id, "this forum was deleted", func(DbUser) bool { return true })
+	}
+	return nil
+}
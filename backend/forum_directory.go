@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// forums per directory page
+const forumDirectoryPageSize = 30
+
+// forums per section on the grouped first page, the rest are a click away
+const forumsPerSection = 10
+
+// noSection is the ?section= of forums that are in none
+const noSection = "none"
+
+// ForumListing is a forum in the directory, LastActivity is its latest
+// message or its creation when nobody posted yet
+type ForumListing struct {
+	Forum
+	Members      int
+	LastActivity time.Time
+}
+
+// ForumsPage is the directory of public forums, Mine are the forums the
+// user is a member of, private ones included. Without a filter and once
+// sections exist the first page lists Groups, a section each, otherwise
+// Forums of the Section filter or all of them.
+type ForumsPage struct {
+	Query       string
+	Sort        string
+	Sorts       []string
+	Section     string
+	SectionName string
+	Cursor      string
+	NextCursor  string
+	Forums      []ForumListing
+	Groups      []ForumSectionGroup
+	Mine        []ForumListing
+	User        DbUser
+}
+
+// ForumSectionGroup is a section with its first forums on the directory,
+// Key is its ?section= and NextCursor continues on the section's own page
+type ForumSectionGroup struct {
+	ForumSection
+	Key        string
+	Forums     []ForumListing
+	NextCursor string
+}
+
+// the directory orders, each ends in forum_id so the keyset is unique
+var forumOrders = map[string]struct{ after, order string }{
+	"active":  {`(last_activity, forum_id) < ($4::timestamp, $5::uuid)`, `last_activity DESC, forum_id DESC`},
+	"members": {`(members, forum_id) < ($4::int, $5::uuid)`, `members DESC, forum_id DESC`},
+	"newest":  {`(created_at, forum_id) < ($4::timestamp, $5::uuid)`, `created_at DESC, forum_id DESC`},
+	"name":    {`(lower(forum_name), forum_id) > (lower($4::text), $5::uuid)`, `lower(forum_name), forum_id`},
+}
+
+var forumSorts = []string{"active", "members", "newest", "name"}
+
+const forumListingColumns = `f.forum_id, f.forum_name, f.forum_slug, f.forum_media_id, f.public, f.section_id,
+	f.created_at, f.created_by_identifier,
+	(SELECT COUNT(*) FROM forum_users fu WHERE fu.forum_id = f.forum_id)::int AS members,
+	COALESCE((SELECT MAX(m.created_at) FROM messages m
+	          WHERE m.in_table = 'F' AND m.in_table_id = f.forum_id AND m.deleted_at IS NULL), f.created_at) AS last_activity`
+
+func scanForumListing(row pgx.Row) (ForumListing, error) {
+	var l ForumListing
+	err := row.Scan(&l.ID, &l.Name, &l.Slug, &l.ForumMediaID, &l.Public, &l.SectionID,
+		&l.CreatedAt, &l.CreatedByIdentifier, &l.Members, &l.LastActivity)
+	return l, err
+}
+
+// forumCursor is the sort value and id of the last forum on a page
+type forumCursor struct {
+	value string
+	id    uuid.UUID
+}
+
+func (c forumCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.value + "|" + c.id.String()))
+}
+
+func decodeForumCursor(value string) (*forumCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// names may hold a |, the id never does
+	i := strings.LastIndex(string(raw), "|")
+	if i < 0 {
+		return nil, errors.New("invalid cursor")
+	}
+	id, err := uuid.Parse(string(raw[i+1:]))
+	if err != nil {
+		return nil, err
+	}
+	return &forumCursor{value: string(raw[:i]), id: id}, nil
+}
+
+// cursorFor returns the cursor after l in the given sort
+func (l ForumListing) cursorFor(sort string) forumCursor {
+	c := forumCursor{id: l.ID}
+	switch sort {
+	case "members":
+		c.value = strconv.Itoa(l.Members)
+	case "newest":
+		c.value = strconv.FormatInt(l.CreatedAt.UnixNano(), 10)
+	case "name":
+		c.value = l.Name
+	default:
+		c.value = strconv.FormatInt(l.LastActivity.UnixNano(), 10)
+	}
+	return c
+}
+
+// arg turns the cursor value back into what the sort compares against
+func (c forumCursor) arg(sort string) (any, error) {
+	switch sort {
+	case "members":
+		return strconv.Atoi(c.value)
+	case "name":
+		return c.value, nil
+	default:
+		nanos, err := strconv.ParseInt(c.value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(0, nanos).UTC(), nil
+	}
+}
+
+// forumsHandler lists public forums, ?q= filters by name, ?section= by
+// section, ?sort= is one of forumSorts and ?cursor= continues after the
+// previous page
+func forumsHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := r.URL.Query()
+	page := ForumsPage{
+		Query:   strings.TrimSpace(q.Get("q")),
+		Sort:    q.Get("sort"),
+		Sorts:   forumSorts,
+		Section: q.Get("section"),
+		Cursor:  q.Get("cursor"),
+	}
+	if _, ok := forumOrders[page.Sort]; !ok {
+		page.Sort = "active"
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, page, errs, "forums.html")
+	}()
+
+	cursor, err := decodeForumCursor(page.Cursor)
+	if err != nil {
+		errs = append(errs, errors.New("invalid page, start again from the first one"))
+		return
+	}
+
+	switch page.Section {
+	case "":
+	case noSection:
+		page.SectionName = "Other forums"
+	default:
+		section, err := getForumSection(ctx, page.Section)
+		if err != nil {
+			errs = append(errs, errors.New("section not found"))
+			return
+		}
+		page.SectionName = section.Name
+	}
+
+	if page.Query == "" && page.Section == "" && cursor == nil {
+		page.Groups, err = listSectionGroups(ctx, page.Sort)
+		if err != nil {
+			errs = append(errs, errors.New("error getting forums, try again"))
+			return
+		}
+	}
+	// without sections the directory is one list
+	if page.Groups == nil {
+		page.Forums, page.NextCursor, err = listPublicForums(ctx, page.Query, page.Sort, page.Section, cursor, forumDirectoryPageSize)
+		if err != nil {
+			errs = append(errs, errors.New("error getting forums, try again"))
+			return
+		}
+	}
+
+	// the directory is open to everyone, members also see their own forums
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		return
+	}
+	page.User = user
+
+	page.Mine, err = listUserForums(ctx, user.Identifier)
+	if err != nil {
+		errs = append(errs, errors.New("error getting your forums, try again"))
+		return
+	}
+}
+
+// listSectionGroups returns the first forums of every section that has
+// public ones, forums in no section come last. It returns nil when there
+// are no sections.
+func listSectionGroups(ctx context.Context, sort string) ([]ForumSectionGroup, error) {
+	sections, err := listForumSections(ctx)
+	if err != nil || len(sections) == 0 {
+		return nil, err
+	}
+
+	groups := []ForumSectionGroup{}
+	for _, s := range append(sections, ForumSection{Name: "Other forums"}) {
+		g := ForumSectionGroup{ForumSection: s, Key: s.ID.String()}
+		if s.ID == uuid.Nil {
+			g.Key = noSection
+		}
+		g.Forums, g.NextCursor, err = listPublicForums(ctx, "", sort, g.Key, nil, forumsPerSection)
+		if err != nil {
+			return nil, err
+		}
+		if len(g.Forums) > 0 {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// listPublicForums lists a page of public forums, section is a section id,
+// noSection or "" for all of them
+func listPublicForums(ctx context.Context, name, sort, section string, cursor *forumCursor, limit int) ([]ForumListing, string, error) {
+	order := forumOrders[sort]
+
+	after := `TRUE`
+	args := []any{name, limit + 1, section}
+	if cursor != nil {
+		value, err := cursor.arg(sort)
+		if err != nil {
+			return nil, "", err
+		}
+		after = order.after
+		args = append(args, value, cursor.id)
+	}
+
+	list := `
+	SELECT * FROM (
+	    SELECT ` + forumListingColumns + `
+	    FROM forums f
+	    WHERE f.public AND f.deleted_at IS NULL
+	      AND ($1 = '' OR strpos(lower(f.forum_name), lower($1)) > 0)
+	      AND ($3::text = '' OR ($3 = 'none' AND f.section_id IS NULL) OR f.section_id::text = $3)
+	) forums
+	WHERE ` + after + `
+	ORDER BY ` + order.order + `
+	LIMIT $2;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	forums, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumListing, error) {
+		return scanForumListing(row)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	// one extra row is fetched to know if there is a next page
+	next := ""
+	if len(forums) > limit {
+		forums = forums[:limit]
+		next = forums[len(forums)-1].cursorFor(sort).encode()
+	}
+	return forums, next, nil
+}
+
+// listUserForums returns the forums userIdentifier is a member of, latest activity first
+func listUserForums(ctx context.Context, userIdentifier uuid.UUID) ([]ForumListing, error) {
+	list := `
+	SELECT ` + forumListingColumns + `
+	FROM forums f JOIN forum_users fu ON fu.forum_id = f.forum_id
+	WHERE fu.user_identifier = $1 AND f.deleted_at IS NULL
+	ORDER BY last_activity DESC
+	LIMIT 100;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumListing, error) {
+		return scanForumListing(row)
+	})
+}
+
+// PageURL links to the directory keeping the name and section filters
+func (p ForumsPage) PageURL(sort, cursor string) string {
+	v := url.Values{"sort": {sort}}
+	if p.Query != "" {
+		v.Set("q", p.Query)
+	}
+	if p.Section != "" {
+		v.Set("section", p.Section)
+	}
+	if cursor != "" {
+		v.Set("cursor", cursor)
+	}
+	return "/forums?" + v.Encode()
+}
+
+// SectionURL links to the page of one section in the current sort
+func (p ForumsPage) SectionURL(section, cursor string) string {
+	return ForumsPage{Section: section}.PageURL(p.Sort, cursor)
+}
+
+func (p ForumsPage) pageMeta() PageMeta {
+	meta := PageMeta{
+		Title:       "Forums",
+		Description: "Browse the public forums",
+		Canonical:   "/forums",
+		Type:        "website",
+	}
+	if p.Section != "" {
+		meta.Title = p.SectionName + " - Forums"
+		meta.Canonical = "/forums?" + url.Values{"section": {p.Section}}.Encode()
+	}
+	// filtered and later pages repeat the first one
+	if p.Query != "" || p.Cursor != "" {
+		meta.Robots = "noindex"
+	}
+	return meta
+}
@@ -0,0 +1,912 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+var (
+	errAlreadyInvited    = errors.New("already invited to this forum")
+	errAlreadyMember     = errors.New("already a member of this forum")
+	errInviteLinkInvalid = errors.New("this invite link expired, was used up or revoked")
+)
+
+// ForumInvite is a pending invitation, InvitedBy is empty once the inviter
+// deleted their account
+type ForumInvite struct {
+	ID        uuid.UUID
+	ForumID   uuid.UUID
+	ForumName string
+	ForumSlug string
+	Email     string
+	InvitedBy string
+	CreatedAt time.Time
+}
+
+// ForumInviteLink is a shareable invitation, nil ExpiresAt and MaxUses mean
+// no limit
+type ForumInviteLink struct {
+	Code      string
+	ExpiresAt *time.Time
+	MaxUses   *int
+	Uses      int
+	CreatedAt time.Time
+}
+
+// Usable tells if the link still lets people in
+func (l ForumInviteLink) Usable() bool {
+	if l.ExpiresAt != nil && !time.Now().UTC().Before(*l.ExpiresAt) {
+		return false
+	}
+	return l.MaxUses == nil || l.Uses < *l.MaxUses
+}
+
+type ForumJoinRequest struct {
+	Identifier uuid.UUID
+	Username   string
+	Message    string
+	CreatedAt  time.Time
+}
+
+// ForumMember is a member of a forum, Role is 'A' for admins, 'M' for mods
+// and 0 for everyone else
+type ForumMember struct {
+	Identifier uuid.UUID
+	Username   string
+	Role       rune
+}
+
+// ForumMembersPage is where forum staff decide who gets in, mods answer join
+// requests and admins also invite and hand out roles
+type ForumMembersPage struct {
+	ForumAuth
+	Forum     Forum
+	User      DbUser
+	Base      string
+	Requests  []ForumJoinRequest
+	Invites   []ForumInvite
+	Links     []ForumInviteLink
+	Members   []ForumMember
+	Sanctions []ForumSanction
+}
+
+// ForumInvitePage is the landing page of an invite link
+type ForumInvitePage struct {
+	Forum  Forum
+	Link   ForumInviteLink
+	Member bool
+}
+
+func forumMembersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := forumMembersPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	renderHtml(w, r, page, nil, "forumMembers.html")
+}
+
+// forumMembersPage loads the members page for those allowed permMembers
+func forumMembersPage(ctx context.Context, r *http.Request, user DbUser) (ForumMembersPage, error) {
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		return ForumMembersPage{}, err
+	}
+
+	forum, err := getForum(ctx, Id)
+	if err != nil {
+		return ForumMembersPage{}, err
+	}
+
+	page := ForumMembersPage{Forum: forum, User: user, Base: siteURL(r)}
+
+	page.ForumAuth, err = authorizeForum(ctx, forum, user)
+	if err != nil {
+		return ForumMembersPage{}, err
+	}
+	if !page.Can(permMembers) {
+		return ForumMembersPage{}, pgx.ErrNoRows
+	}
+
+	page.Requests, err = listForumJoinRequests(ctx, forum.ID)
+	if err != nil {
+		return ForumMembersPage{}, err
+	}
+	page.Members, err = listForumMembers(ctx, forum.ID)
+	if err != nil {
+		return ForumMembersPage{}, err
+	}
+	if page.Can(permBan) {
+		page.Sanctions, err = listForumSanctions(ctx, forum.ID)
+		if err != nil {
+			return ForumMembersPage{}, err
+		}
+	}
+	if !page.Can(permEditSettings) {
+		return page, nil
+	}
+
+	page.Invites, err = listForumInvites(ctx, forum.ID)
+	if err != nil {
+		return ForumMembersPage{}, err
+	}
+	page.Links, err = listForumInviteLinks(ctx, forum.ID)
+	if err != nil {
+		return ForumMembersPage{}, err
+	}
+	return page, nil
+}
+
+// membersAction runs the shared part of every members page form, action
+// gets the loaded page and returns the errors to show
+func membersAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, user DbUser, page ForumMembersPage) []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := forumMembersPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	errs := action(ctx, user, page)
+	if len(errs) > 0 {
+		// show the current state next to the errors
+		if reloaded, err := forumMembersPage(ctx, r, user); err == nil {
+			page = reloaded
+		}
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "forumMembers.html")
+		return
+	}
+
+	http.Redirect(w, r, "/forum/"+page.Forum.ID.String()+"/members", http.StatusFound)
+}
+
+// inviteForumUserHandler invites by username or email, people without an
+// account get a mail telling them to sign up with that email first
+func inviteForumUserHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permEditSettings) {
+			return append(errs, errors.New("only forum admins can invite"))
+		}
+
+		invitee := strings.TrimSpace(r.FormValue("invitee"))
+		if invitee == "" {
+			return append(errs, errors.New("please provide username or email"))
+		}
+
+		var identifier uuid.UUID
+		var email string
+		if strings.Contains(invitee, "@") {
+			email = strings.ToLower(invitee)
+			if len(email) > 128 {
+				return append(errs, errors.New("email is too long"))
+			}
+			getUser := `SELECT user_identifier FROM users WHERE lower(email) = $1`
+			err := database.Dbpool.QueryRow(ctx, getUser, email).Scan(&identifier)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return append(errs, errors.New("error finding user, try again"))
+			}
+		} else {
+			getUser := `SELECT user_identifier, lower(email) FROM users WHERE username = $1`
+			err := database.Dbpool.QueryRow(ctx, getUser, invitee).Scan(&identifier, &email)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return append(errs, errors.New("user does not exists"))
+			} else if err != nil {
+				return append(errs, errors.New("error finding user, try again"))
+			}
+		}
+
+		if identifier != uuid.Nil {
+			member, err := isForumMember(ctx, page.Forum.ID, identifier)
+			if err != nil {
+				return append(errs, errors.New("error inviting user, try again"))
+			}
+			if member {
+				return append(errs, errAlreadyMember)
+			}
+		}
+
+		err := inviteForumEmail(ctx, page.Forum.ID, email, user.Identifier)
+		if errors.Is(err, errAlreadyInvited) {
+			return append(errs, err)
+		} else if err != nil {
+			return append(errs, errors.New("error inviting user, try again"))
+		}
+
+		subject := "You are invited to a forum"
+		content := fmt.Sprintf("%s invited you to the forum \"%s\".", user.Username, page.Forum.Name)
+		if identifier != uuid.Nil {
+			err = notifyUser(ctx, identifier, subject, content, "/forums/invitations", page.Base)
+			if err != nil {
+				// the invitation still shows up on the invitations page
+				log.Println("error notifying forum invitation:", err)
+			}
+			return nil
+		}
+
+		body := fmt.Sprintf("Hello, %s\r\nSign up with this email at %s/login, "+
+			"then accept or decline it at %s/forums/invitations\r\n", content, page.Base, page.Base)
+		err = mailUser(email, subject, body)
+		if err != nil {
+			log.Println("error mailing forum invitation:", err)
+		}
+		return nil
+	})
+}
+
+func revokeForumInviteHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permEditSettings) {
+			return append(errs, errors.New("only forum admins can revoke invitations"))
+		}
+
+		inviteID, err := uuid.Parse(r.PathValue("invite"))
+		if err != nil {
+			return append(errs, errors.New("invitation not found"))
+		}
+
+		revoke := `DELETE FROM forum_invites WHERE invite_id = $1 AND forum_id = $2`
+		_, err = database.Dbpool.Exec(ctx, revoke, inviteID, page.Forum.ID)
+		if err != nil {
+			return append(errs, errors.New("error revoking invitation, try again"))
+		}
+		return nil
+	})
+}
+
+// createInviteLinkHandler makes a link, days and uses are optional limits,
+// 0 or empty means none
+func createInviteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permEditSettings) {
+			return append(errs, errors.New("only forum admins can create invite links"))
+		}
+
+		days, err := optionalInt(r.FormValue("days"))
+		if err != nil || days < 0 || days > 365 {
+			errs = append(errs, errors.New("expiry must be between 0 and 365 days"))
+		}
+		uses, err := optionalInt(r.FormValue("uses"))
+		if err != nil || uses < 0 || uses > 10000 {
+			errs = append(errs, errors.New("max uses must be between 0 and 10000"))
+		}
+		if errs != nil {
+			return errs
+		}
+
+		code, err := newInviteCode()
+		if err != nil {
+			return append(errs, errors.New("error creating invite link, try again"))
+		}
+
+		create := `
+		INSERT INTO forum_invite_links (code, forum_id, created_by_identifier, expires_at, max_uses)
+		VALUES ($1, $2, $3,
+		        CASE WHEN $4::int > 0 THEN CURRENT_TIMESTAMP + make_interval(days => $4::int) END,
+		        NULLIF($5::int, 0));
+		`
+		_, err = database.Dbpool.Exec(ctx, create, code, page.Forum.ID, user.Identifier, days, uses)
+		if err != nil {
+			return append(errs, errors.New("error creating invite link, try again"))
+		}
+		return nil
+	})
+}
+
+func revokeInviteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permEditSettings) {
+			return append(errs, errors.New("only forum admins can revoke invite links"))
+		}
+
+		revoke := `DELETE FROM forum_invite_links WHERE code = $1 AND forum_id = $2`
+		_, err := database.Dbpool.Exec(ctx, revoke, r.PathValue("code"), page.Forum.ID)
+		if err != nil {
+			return append(errs, errors.New("error revoking invite link, try again"))
+		}
+		return nil
+	})
+}
+
+// requestJoinForumHandler queues a join request of a private forum and lets
+// its admins and mods know
+func requestJoinForumHandler(w http.ResponseWriter, r *http.Request) {
+	forumAction(w, r, func(ctx context.Context, user DbUser, forum Forum) (string, []error) {
+		var errs []error
+
+		if forum.Public {
+			errs = append(errs, errors.New("public forums can be joined right away"))
+			return "", errs
+		}
+
+		member, err := isForumMember(ctx, forum.ID, user.Identifier)
+		if err != nil {
+			errs = append(errs, errors.New("error requesting to join, try again"))
+			return "", errs
+		}
+		if member {
+			errs = append(errs, errAlreadyMember)
+			return "", errs
+		}
+
+		message := strings.TrimSpace(r.FormValue("message"))
+		if len(message) > 512 {
+			errs = append(errs, errors.New("message is too long"))
+			return "", errs
+		}
+
+		request := `
+		INSERT INTO forum_join_requests (forum_id, user_identifier, message)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (forum_id, user_identifier) DO UPDATE SET message = EXCLUDED.message;
+		`
+		_, err = database.Dbpool.Exec(ctx, request, forum.ID, user.Identifier, message)
+		if err != nil {
+			errs = append(errs, errors.New("error requesting to join, try again"))
+			return "", errs
+		}
+
+		staff, err := listForumStaff(ctx, forum.ID)
+		if err != nil {
+			// the request still waits in the queue
+			log.Println("error getting forum staff:", err)
+		}
+		content := fmt.Sprintf("%s asked to join the forum \"%s\".", user.Username, forum.Name)
+		for _, s := range staff {
+			err = notifyUser(ctx, s, "New request to join a forum", content,
+				"/forum/"+forum.ID.String()+"/members", siteURL(r))
+			if err != nil {
+				log.Println("error notifying join request:", err)
+			}
+		}
+		return forumURL(forum.Slug), nil
+	})
+}
+
+// decideJoinRequestHandler approves or denies a join request, the requester
+// hears about it either way
+func decideJoinRequestHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		var request *ForumJoinRequest
+		for i, req := range page.Requests {
+			if req.Username == r.PathValue("username") {
+				request = &page.Requests[i]
+				break
+			}
+		}
+		if request == nil {
+			return append(errs, errors.New("join request not found"))
+		}
+
+		approve := r.FormValue("approve") == "true"
+		err := decideJoinRequest(ctx, page.Forum.ID, request.Identifier, approve)
+		if err != nil {
+			return append(errs, errors.New("error answering join request, try again"))
+		}
+
+		subject := "Your request to join a forum was declined"
+		content := fmt.Sprintf("%s declined your request to join the forum \"%s\".", user.Username, page.Forum.Name)
+		link := "/forums"
+		if approve {
+			subject = "Your request to join a forum was approved"
+			content = fmt.Sprintf("%s approved your request to join the forum \"%s\".", user.Username, page.Forum.Name)
+			link = forumURL(page.Forum.Slug)
+		}
+		err = notifyUser(ctx, request.Identifier, subject, content, link, page.Base)
+		if err != nil {
+			log.Println("error notifying join request decision:", err)
+		}
+		return nil
+	})
+}
+
+func forumInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var invitations []ForumInvite
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, invitations, errs, "forumInvitations.html")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	invitations, err = listUserForumInvites(ctx, user.Email)
+	if err != nil {
+		errs = append(errs, errors.New("error getting invitations, try again"))
+		return
+	}
+}
+
+// respondForumInviteHandler accepts or declines an invitation sent to the
+// email of the user and tells the inviter
+func respondForumInviteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	inviteID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	accept := r.FormValue("accept") == "true"
+	forumID, inviter, err := respondForumInvite(ctx, inviteID, user, accept)
+	if err != nil {
+		var errs []error
+		if errors.Is(err, pgx.ErrNoRows) {
+			errs = append(errs, errors.New("invitation not found"))
+		} else {
+			errs = append(errs, errors.New("error answering invitation, try again"))
+		}
+		invitations, _ := listUserForumInvites(ctx, user.Email)
+		w.WriteHeader(badCode)
+		renderHtml(w, r, invitations, errs, "forumInvitations.html")
+		return
+	}
+
+	forum, err := getForum(ctx, forumID)
+	if err != nil {
+		http.Redirect(w, r, "/forums/invitations", http.StatusFound)
+		return
+	}
+
+	if inviter.Valid {
+		subject := "Your forum invitation was declined"
+		content := fmt.Sprintf("%s declined your invitation to the forum \"%s\".", user.Username, forum.Name)
+		if accept {
+			subject = "Your forum invitation was accepted"
+			content = fmt.Sprintf("%s accepted your invitation to the forum \"%s\".", user.Username, forum.Name)
+		}
+		err = notifyUser(ctx, inviter.UUID, subject, content, "/forum/"+forum.ID.String()+"/members", siteURL(r))
+		if err != nil {
+			log.Println("error notifying invitation answer:", err)
+		}
+	}
+
+	if accept {
+		http.Redirect(w, r, forumURL(forum.Slug), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/forums/invitations", http.StatusFound)
+}
+
+// inviteLinkHandler shows where an invite link leads before joining
+func inviteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var page ForumInvitePage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page.Forum, page.Link, err = getInviteLink(ctx, r.PathValue("code"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, page, errs, "forumInvite.html")
+	}()
+
+	page.Member, err = isForumMember(ctx, page.Forum.ID, user.Identifier)
+	if err != nil {
+		errs = append(errs, errors.New("error getting invite link, try again"))
+		return
+	}
+	if !page.Member && !page.Link.Usable() {
+		errs = append(errs, errInviteLinkInvalid)
+	}
+}
+
+func redeemInviteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	forum, link, err := getInviteLink(ctx, r.PathValue("code"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	err = redeemInviteLink(ctx, link.Code, user.Identifier)
+	if err != nil {
+		errs := []error{errInviteLinkInvalid}
+		if !errors.Is(err, errInviteLinkInvalid) {
+			errs = []error{errors.New("error joining forum, try again")}
+		}
+		w.WriteHeader(badCode)
+		renderHtml(w, r, ForumInvitePage{Forum: forum, Link: link}, errs, "forumInvite.html")
+		return
+	}
+
+	http.Redirect(w, r, forumURL(forum.Slug), http.StatusFound)
+}
+
+// inviteForumEmail stores the invitation, email is already lower cased
+func inviteForumEmail(ctx context.Context, forumID uuid.UUID, email string, invitedBy uuid.UUID) error {
+	invite := `
+	INSERT INTO forum_invites (forum_id, email, invited_by_identifier)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (forum_id, email) DO NOTHING;
+	`
+	tag, err := database.Dbpool.Exec(ctx, invite, forumID, email, invitedBy)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errAlreadyInvited
+	}
+	return nil
+}
+
+// respondForumInvite drops the invitation of user and joins the forum when
+// accepted, it returns the forum and who invited
+func respondForumInvite(ctx context.Context, inviteID uuid.UUID, user DbUser, accept bool) (uuid.UUID, uuid.NullUUID, error) {
+	var forumID uuid.UUID
+	var inviter uuid.NullUUID
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, inviter, err
+	}
+	defer tx.Rollback(ctx)
+
+	remove := `
+	DELETE FROM forum_invites
+	WHERE invite_id = $1 AND email = lower($2)
+	RETURNING forum_id, invited_by_identifier;
+	`
+	err = tx.QueryRow(ctx, remove, inviteID, user.Email).Scan(&forumID, &inviter)
+	if err != nil {
+		return uuid.Nil, inviter, err
+	}
+
+	if accept {
+		join := `INSERT INTO forum_users (user_identifier, forum_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+		_, err = tx.Exec(ctx, join, user.Identifier, forumID)
+		if err != nil {
+			return uuid.Nil, inviter, err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM forum_join_requests WHERE forum_id = $1 AND user_identifier = $2`,
+			forumID, user.Identifier)
+		if err != nil {
+			return uuid.Nil, inviter, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return uuid.Nil, inviter, err
+	}
+	forgetForumMember(ctx, forumID, user.Identifier)
+	return forumID, inviter, nil
+}
+
+func decideJoinRequest(ctx context.Context, forumID, userIdentifier uuid.UUID, approve bool) error {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	remove := `DELETE FROM forum_join_requests WHERE forum_id = $1 AND user_identifier = $2`
+	tag, err := tx.Exec(ctx, remove, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	if approve {
+		join := `INSERT INTO forum_users (user_identifier, forum_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+		_, err = tx.Exec(ctx, join, userIdentifier, forumID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	forgetForumMember(ctx, forumID, userIdentifier)
+	return nil
+}
+
+// redeemInviteLink joins the forum of the link, members do not use it up
+func redeemInviteLink(ctx context.Context, code string, userIdentifier uuid.UUID) error {
+	var forumID uuid.UUID
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `SELECT forum_id FROM forum_invite_links WHERE code = $1`, code).Scan(&forumID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errInviteLinkInvalid
+	} else if err != nil {
+		return err
+	}
+
+	var member bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM forum_users WHERE forum_id = $1 AND user_identifier = $2)`,
+		forumID, userIdentifier).Scan(&member)
+	if err != nil || member {
+		return err
+	}
+
+	// the row lock of the update keeps concurrent redeems under max_uses
+	use := `
+	UPDATE forum_invite_links SET uses = uses + 1
+	WHERE code = $1
+	  AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+	  AND (max_uses IS NULL OR uses < max_uses);
+	`
+	tag, err := tx.Exec(ctx, use, code)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errInviteLinkInvalid
+	}
+
+	join := `INSERT INTO forum_users (user_identifier, forum_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err = tx.Exec(ctx, join, userIdentifier, forumID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM forum_join_requests WHERE forum_id = $1 AND user_identifier = $2`,
+		forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	forgetForumMember(ctx, forumID, userIdentifier)
+	return nil
+}
+
+func getInviteLink(ctx context.Context, code string) (Forum, ForumInviteLink, error) {
+	var forumID uuid.UUID
+	var link ForumInviteLink
+
+	get := `
+	SELECT code, forum_id, expires_at, max_uses, uses, created_at
+	FROM forum_invite_links WHERE code = $1;
+	`
+	err := database.Dbpool.QueryRow(ctx, get, code).Scan(
+		&link.Code, &forumID, &link.ExpiresAt, &link.MaxUses, &link.Uses, &link.CreatedAt)
+	if err != nil {
+		return Forum{}, link, err
+	}
+
+	forum, err := getForum(ctx, forumID)
+	return forum, link, err
+}
+
+func listForumInviteLinks(ctx context.Context, forumID uuid.UUID) ([]ForumInviteLink, error) {
+	list := `
+	SELECT code, expires_at, max_uses, uses, created_at
+	FROM forum_invite_links
+	WHERE forum_id = $1
+	ORDER BY created_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumInviteLink, error) {
+		var l ForumInviteLink
+		err := row.Scan(&l.Code, &l.ExpiresAt, &l.MaxUses, &l.Uses, &l.CreatedAt)
+		return l, err
+	})
+}
+
+const forumInviteColumns = `i.invite_id, f.forum_id, f.forum_name, f.forum_slug, i.email,
+	COALESCE(u.username, ''), i.created_at`
+
+func scanForumInvite(row pgx.Row) (ForumInvite, error) {
+	var i ForumInvite
+	err := row.Scan(&i.ID, &i.ForumID, &i.ForumName, &i.ForumSlug, &i.Email, &i.InvitedBy, &i.CreatedAt)
+	return i, err
+}
+
+func listForumInvites(ctx context.Context, forumID uuid.UUID) ([]ForumInvite, error) {
+	list := `
+	SELECT ` + forumInviteColumns + `
+	FROM forum_invites i
+	JOIN forums f ON f.forum_id = i.forum_id
+	LEFT JOIN users u ON u.user_identifier = i.invited_by_identifier
+	WHERE i.forum_id = $1
+	ORDER BY i.created_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumInvite, error) {
+		return scanForumInvite(row)
+	})
+}
+
+// listUserForumInvites returns the invitations sent to email
+func listUserForumInvites(ctx context.Context, email string) ([]ForumInvite, error) {
+	list := `
+	SELECT ` + forumInviteColumns + `
+	FROM forum_invites i
+	JOIN forums f ON f.forum_id = i.forum_id
+	LEFT JOIN users u ON u.user_identifier = i.invited_by_identifier
+	WHERE i.email = lower($1) AND f.deleted_at IS NULL
+	ORDER BY i.created_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, email)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumInvite, error) {
+		return scanForumInvite(row)
+	})
+}
+
+func listForumJoinRequests(ctx context.Context, forumID uuid.UUID) ([]ForumJoinRequest, error) {
+	list := `
+	SELECT u.user_identifier, u.username, r.message, r.created_at
+	FROM forum_join_requests r
+	JOIN users u ON u.user_identifier = r.user_identifier
+	WHERE r.forum_id = $1
+	ORDER BY r.created_at;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumJoinRequest, error) {
+		var req ForumJoinRequest
+		err := row.Scan(&req.Identifier, &req.Username, &req.Message, &req.CreatedAt)
+		return req, err
+	})
+}
+
+// listForumMembers returns the members, admins first, then mods
+func listForumMembers(ctx context.Context, forumID uuid.UUID) ([]ForumMember, error) {
+	list := `
+	SELECT u.user_identifier, u.username,
+	       CASE WHEN a.user_identifier IS NOT NULL THEN 'A'
+	            WHEN m.user_identifier IS NOT NULL THEN 'M'
+	            ELSE '' END AS role
+	FROM forum_users fu
+	JOIN users u ON u.user_identifier = fu.user_identifier
+	LEFT JOIN forum_admins a ON a.forum_id = fu.forum_id AND a.user_identifier = fu.user_identifier
+	LEFT JOIN forum_mods m ON m.forum_id = fu.forum_id AND m.user_identifier = fu.user_identifier
+	WHERE fu.forum_id = $1
+	ORDER BY a.user_identifier IS NULL, m.user_identifier IS NULL, u.username;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumMember, error) {
+		var m ForumMember
+		var role string
+		err := row.Scan(&m.Identifier, &m.Username, &role)
+		if role != "" {
+			m.Role = firstRune(role)
+		}
+		return m, err
+	})
+}
+
+// listForumStaff returns the admins and mods of a forum
+func listForumStaff(ctx context.Context, forumID uuid.UUID) ([]uuid.UUID, error) {
+	list := `
+	SELECT user_identifier FROM forum_admins WHERE forum_id = $1
+	UNION
+	SELECT user_identifier FROM forum_mods WHERE forum_id = $1;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+}
+
+// newInviteCode returns a random url safe code of 16 characters
+func newInviteCode() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// optionalInt parses a form number, empty is 0
+func optionalInt(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
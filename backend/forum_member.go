@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sameer-gits/CMS/database"
+)
+
+const (
+	// forum:member:<forum id>:<user identifier> holds "1" for members and "0" for everyone else
+	forumMemberKey = "forum:member:"
+	forumMemberTTL = 10 * time.Minute
+)
+
+var errPrivateForum = errors.New("this forum is private, only members can read and post")
+
+func forumMemberCacheKey(forumID, userIdentifier uuid.UUID) string {
+	return forumMemberKey + forumID.String() + ":" + userIdentifier.String()
+}
+
+// isForumMember checks forum_users, answers are cached in redis and
+// forgotten whenever the membership changes
+func isForumMember(ctx context.Context, forumID, userIdentifier uuid.UUID) (bool, error) {
+	key := forumMemberCacheKey(forumID, userIdentifier)
+
+	cached, err := database.RedisAllClients.Client1.Get(ctx, key).Result()
+	if err == nil {
+		return cached == "1", nil
+	}
+
+	member, err := rowExists(ctx,
+		`SELECT EXISTS (SELECT 1 FROM forum_users WHERE forum_id = $1 AND user_identifier = $2)`,
+		forumID, userIdentifier)
+	if err != nil {
+		return false, err
+	}
+
+	value := "0"
+	if member {
+		value = "1"
+	}
+	err = database.RedisAllClients.Client1.Set(ctx, key, value, forumMemberTTL).Err()
+	if err != nil {
+		log.Println("error caching forum membership:", err)
+	}
+	return member, nil
+}
+
+// forgetForumMember drops the cached answer after forum_users changed
+func forgetForumMember(ctx context.Context, forumID, userIdentifier uuid.UUID) {
+	err := database.RedisAllClients.Client1.Del(ctx, forumMemberCacheKey(forumID, userIdentifier)).Err()
+	if err != nil {
+		log.Println("error forgetting forum membership:", err)
+	}
+}
+
+// canRead tells if user may read the forum, everyone reads public forums,
+// private ones are for members and site admins. A zero user is a visitor.
+func (forum Forum) canRead(ctx context.Context, user DbUser) (bool, error) {
+	if forum.Public || user.Role == 'A' {
+		return true, nil
+	}
+	if user.Identifier == uuid.Nil {
+		return false, nil
+	}
+	return isForumMember(ctx, forum.ID, user.Identifier)
+}
+
+func joinForumHandler(w http.ResponseWriter, r *http.Request) {
+	forumAction(w, r, func(ctx context.Context, user DbUser, forum Forum) (string, []error) {
+		var errs []error
+
+		if !forum.Public {
+			errs = append(errs, errors.New("this forum is private, ask one of its admins for an invitation"))
+			return "", errs
+		}
+
+		err := joinForum(ctx, forum.ID, user.Identifier)
+		if err != nil {
+			errs = append(errs, errors.New("error joining forum, try again"))
+			return "", errs
+		}
+		return forumURL(forum.Slug), nil
+	})
+}
+
+// leaveForumHandler drops the membership, the last admin has to hand the
+// forum over first. A private forum is gone from view afterwards so the user
+// lands in the directory.
+func leaveForumHandler(w http.ResponseWriter, r *http.Request) {
+	forumAction(w, r, func(ctx context.Context, user DbUser, forum Forum) (string, []error) {
+		var errs []error
+
+		// the owner keeps the forum's transfer and deletion, they hand it over first
+		if forum.CreatedByIdentifier == user.Identifier {
+			return "", append(errs, errors.New("the owner can not leave the forum, transfer ownership first"))
+		}
+
+		err := leaveForum(ctx, forum.ID, user.Identifier)
+		if errors.Is(err, errLastForumAdmin) {
+			errs = append(errs, err)
+			return "", errs
+		} else if err != nil {
+			errs = append(errs, errors.New("error leaving forum, try again"))
+			return "", errs
+		}
+
+		if !forum.Public {
+			// the forum's live updates are for members only
+			closeForumSubscribers(ctx, forum.ID, "you left this forum",
+				func(u DbUser) bool { return u.Identifier == user.Identifier })
+			return "/forums", nil
+		}
+		return forumURL(forum.Slug), nil
+	})
+}
+
+// forumAction loads the forum of a forum form for a logged in user, action
+// returns where to go next or the errors shown on the forum page
+func forumAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, user DbUser, forum Forum) (string, []error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	forum, err := getForum(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	next, errs := action(ctx, user, forum)
+	if len(errs) > 0 {
+		page, err := forumPage(ctx, forum, user)
+		if err != nil {
+			page = ForumPage{Forum: forum, User: user}
+		}
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "forum.html")
+		return
+	}
+
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+func joinForum(ctx context.Context, forumID, userIdentifier uuid.UUID) error {
+	join := `INSERT INTO forum_users (user_identifier, forum_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err := database.Dbpool.Exec(ctx, join, userIdentifier, forumID)
+	if err != nil {
+		return err
+	}
+	forgetForumMember(ctx, forumID, userIdentifier)
+	return nil
+}
+
+// leaveForum also drops admin and mod roles, they only mean something to
+// members
+func leaveForum(ctx context.Context, forumID, userIdentifier uuid.UUID) error {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	last, err := lockForumAdmins(ctx, tx, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+	if last {
+		return errLastForumAdmin
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM forum_admins WHERE forum_id = $1 AND user_identifier = $2`, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM forum_mods WHERE forum_id = $1 AND user_identifier = $2`, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM forum_users WHERE forum_id = $1 AND user_identifier = $2`, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	forgetForumMember(ctx, forumID, userIdentifier)
+	return nil
+}
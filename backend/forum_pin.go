@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// most messages a forum keeps in its pinned panel
+const maxForumPins = 10
+
+var errTooManyPins = fmt.Errorf("a forum can have at most %d pinned messages, unpin one first", maxForumPins)
+
+// ForumPin is a pinned message with the topic it was posted in, PinnedBy is
+// empty once the moderator deleted their account
+type ForumPin struct {
+	MessageId      uuid.UUID `json:"message_id"`
+	TopicID        uuid.UUID `json:"topic_id"`
+	TopicTitle     string    `json:"topic_title"`
+	AuthorUsername string    `json:"author_username"`
+	Content        string    `json:"content"`
+	PinnedBy       string    `json:"pinned_by"`
+	PinnedAt       time.Time `json:"pinned_at"`
+}
+
+// PinEvent is sent to the forum and all its topics when a message is pinned
+// or unpinned
+type PinEvent struct {
+	Event string   `json:"event"`
+	Pin   ForumPin `json:"pin"`
+}
+
+// Pinned tells if m is in the pinned panel
+func (p TopicPage) Pinned(m Message) bool {
+	for _, pin := range p.Pins {
+		if pin.MessageId == m.MessageId {
+			return true
+		}
+	}
+	return false
+}
+
+func pinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	topicAction(w, r, func(ctx context.Context, user DbUser, page TopicPage) []error {
+		var errs []error
+
+		if !page.Can(permPin) {
+			return append(errs, errors.New("only forum mods and admins can pin messages"))
+		}
+
+		messageID, err := uuid.Parse(r.PathValue("message"))
+		if err != nil {
+			return append(errs, errors.New("message not found"))
+		}
+
+		pin, err := pinMessage(ctx, page.Forum.ID, page.Topic.ID, messageID, user.Identifier)
+		if errors.Is(err, errTooManyPins) {
+			return append(errs, err)
+		} else if errors.Is(err, pgx.ErrNoRows) {
+			return append(errs, errors.New("message not found"))
+		} else if err != nil {
+			return append(errs, errors.New("error pinning message, try again"))
+		}
+
+		publishPin(ctx, page.Forum.ID, "message_pinned", pin)
+		return nil
+	})
+}
+
+func unpinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	topicAction(w, r, func(ctx context.Context, user DbUser, page TopicPage) []error {
+		var errs []error
+
+		if !page.Can(permPin) {
+			return append(errs, errors.New("only forum mods and admins can unpin messages"))
+		}
+
+		messageID, err := uuid.Parse(r.PathValue("message"))
+		if err != nil {
+			return append(errs, errors.New("message not found"))
+		}
+
+		unpin := `DELETE FROM forum_pins WHERE message_id = $1 AND forum_id = $2`
+		_, err = database.Dbpool.Exec(ctx, unpin, messageID, page.Forum.ID)
+		if err != nil {
+			return append(errs, errors.New("error unpinning message, try again"))
+		}
+
+		publishPin(ctx, page.Forum.ID, "message_unpinned", ForumPin{MessageId: messageID, TopicID: page.Topic.ID})
+		return nil
+	})
+}
+
+func publishPin(ctx context.Context, forumID uuid.UUID, event string, pin ForumPin) {
+	eventByte, err := json.Marshal(PinEvent{Event: event, Pin: pin})
+	if err != nil {
+		return
+	}
+	publishForum(ctx, forumID, eventByte)
+}
+
+// pinMessage pins a message of the topic, the forum row is locked so two
+// moderators pinning at once can not go past maxForumPins. Pinning a pinned
+// message again changes nothing.
+func pinMessage(ctx context.Context, forumID, topicID, messageID, moderator uuid.UUID) (ForumPin, error) {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return ForumPin{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT 1 FROM forums WHERE forum_id = $1 FOR UPDATE`, forumID)
+	if err != nil {
+		return ForumPin{}, err
+	}
+
+	var pins int
+	var pinned bool
+	count := `
+	SELECT COUNT(*)::int, COALESCE(BOOL_OR(p.message_id = $2), FALSE)
+	FROM forum_pins p JOIN messages m ON m.message_id = p.message_id
+	WHERE p.forum_id = $1 AND m.deleted_at IS NULL;
+	`
+	err = tx.QueryRow(ctx, count, forumID, messageID).Scan(&pins, &pinned)
+	if err != nil {
+		return ForumPin{}, err
+	}
+	if !pinned && pins >= maxForumPins {
+		return ForumPin{}, errTooManyPins
+	}
+
+	insert := `
+	INSERT INTO forum_pins (message_id, forum_id, pinned_by_identifier)
+	SELECT message_id, $2, $3 FROM messages
+	WHERE message_id = $1 AND topic_id = $4 AND deleted_at IS NULL
+	ON CONFLICT (message_id) DO NOTHING;
+	`
+	tag, err := tx.Exec(ctx, insert, messageID, forumID, moderator, topicID)
+	if err != nil {
+		return ForumPin{}, err
+	}
+	if tag.RowsAffected() == 0 && !pinned {
+		return ForumPin{}, pgx.ErrNoRows
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return ForumPin{}, err
+	}
+
+	getPin := `
+	SELECT ` + forumPinColumns + `
+	FROM forum_pins p
+	JOIN messages m ON m.message_id = p.message_id
+	JOIN forum_topics t ON t.topic_id = m.topic_id
+	LEFT JOIN users u ON u.user_identifier = p.pinned_by_identifier
+	WHERE p.message_id = $1;
+	`
+	return scanForumPin(database.Dbpool.QueryRow(ctx, getPin, messageID))
+}
+
+const forumPinColumns = `m.message_id, t.topic_id, t.title, m.author, m.content, COALESCE(u.username, ''), p.pinned_at`
+
+func scanForumPin(row pgx.Row) (ForumPin, error) {
+	var p ForumPin
+	err := row.Scan(&p.MessageId, &p.TopicID, &p.TopicTitle, &p.AuthorUsername, &p.Content, &p.PinnedBy, &p.PinnedAt)
+	return p, err
+}
+
+// listForumPins returns the pinned messages of a forum, newest pin first,
+// trashed messages leave the panel
+func listForumPins(ctx context.Context, forumID uuid.UUID) ([]ForumPin, error) {
+	list := `
+	SELECT ` + forumPinColumns + `
+	FROM forum_pins p
+	JOIN messages m ON m.message_id = p.message_id
+	JOIN forum_topics t ON t.topic_id = m.topic_id
+	LEFT JOIN users u ON u.user_identifier = p.pinned_by_identifier
+	WHERE p.forum_id = $1 AND m.deleted_at IS NULL
+	ORDER BY p.pinned_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumPin, error) {
+		return scanForumPin(row)
+	})
+}
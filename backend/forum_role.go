@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// forumRole is the standing of a user in a forum, every role may do
+// everything the ones below it can
+type forumRole int
+
+const (
+	forumGuest forumRole = iota
+	forumMember
+	forumMod
+	forumAdmin
+)
+
+// forumPermission is something only some roles may do in a forum, the
+// values are what templates pass to Can
+type forumPermission string
+
+const (
+	permPost         forumPermission = "post"
+	permPin          forumPermission = "pin"
+	permLock         forumPermission = "lock"
+	permAnnounce     forumPermission = "announce"
+	permDeleteOthers forumPermission = "delete"
+	permBan          forumPermission = "ban"
+	permMembers      forumPermission = "members"
+	permEditSettings forumPermission = "settings"
+)
+
+// forumPermissions is the permission matrix, the lowest role allowed to do each
+var forumPermissions = map[forumPermission]forumRole{
+	permPost:         forumMember,
+	permPin:          forumMod,
+	permLock:         forumMod,
+	permAnnounce:     forumMod,
+	permDeleteOthers: forumMod,
+	permBan:          forumMod,
+	permMembers:      forumMod,
+	permEditSettings: forumAdmin,
+}
+
+var errLastForumAdmin = errors.New("you are the last admin of this forum, make another member admin or transfer ownership first")
+
+// ForumAuth is what a user may do in a forum, authorizeForum works it out
+// once per request and handlers ask it with Can. Ban and Mute are set while
+// the user is sanctioned. Owner is the creator or whoever accepted ownership
+// from them, only they hand the forum over or delete it.
+type ForumAuth struct {
+	Role    forumRole
+	Member  bool
+	CanRead bool
+	Owner   bool
+	Ban     *ForumSanction
+	Mute    *ForumSanction
+}
+
+// authorizeForum is the one place forum handlers get permissions from. Site
+// admins act as forum admins and owners, people logged in act as members of
+// public forums, those take messages from everyone. Banned users can not read
+// the forum and muted ones can not post, staff is never sanctioned. A zero
+// user is a visitor.
+func authorizeForum(ctx context.Context, forum Forum, user DbUser) (ForumAuth, error) {
+	var auth ForumAuth
+	var err error
+
+	auth.CanRead, err = forum.canRead(ctx, user)
+	if err != nil {
+		return ForumAuth{}, err
+	}
+	if user.Identifier == uuid.Nil {
+		return auth, nil
+	}
+	auth.Owner = forum.CreatedByIdentifier == user.Identifier || user.Role == 'A'
+
+	auth.Member, err = isForumMember(ctx, forum.ID, user.Identifier)
+	if err != nil {
+		return ForumAuth{}, err
+	}
+
+	var admin, mod bool
+	roles := `
+	SELECT EXISTS (SELECT 1 FROM forum_admins WHERE forum_id = $1 AND user_identifier = $2),
+	       EXISTS (SELECT 1 FROM forum_mods WHERE forum_id = $1 AND user_identifier = $2);
+	`
+	err = database.Dbpool.QueryRow(ctx, roles, forum.ID, user.Identifier).Scan(&admin, &mod)
+	if err != nil {
+		return ForumAuth{}, err
+	}
+
+	auth.Role = forumRoleFor(forum, user, auth.Member, admin, mod)
+	if auth.Role >= forumMod {
+		return auth, nil
+	}
+
+	sanctions, err := userForumSanctions(ctx, forum.ID, user.Identifier)
+	if err != nil {
+		return ForumAuth{}, err
+	}
+	auth.sanction(sanctions)
+	return auth, nil
+}
+
+// forumRoleFor picks the highest role the user holds, site admins are forum
+// admins everywhere
+func forumRoleFor(forum Forum, user DbUser, member, admin, mod bool) forumRole {
+	switch {
+	case admin || user.Role == 'A':
+		return forumAdmin
+	case mod:
+		return forumMod
+	case member || forum.Public:
+		return forumMember
+	}
+	return forumGuest
+}
+
+// sanction applies the user's active sanctions, a ban takes reading away
+func (a *ForumAuth) sanction(sanctions []ForumSanction) {
+	for i, s := range sanctions {
+		switch s.Kind {
+		case 'B':
+			a.Ban = &sanctions[i]
+			a.CanRead = false
+		case 'M':
+			a.Mute = &sanctions[i]
+		}
+	}
+}
+
+// Can checks the permission matrix, nothing is allowed without reading and
+// muted users do not post
+func (a ForumAuth) Can(p forumPermission) bool {
+	if p == permPost && a.Mute != nil {
+		return false
+	}
+	need, ok := forumPermissions[p]
+	return ok && a.CanRead && a.Role >= need
+}
+
+// forumRoleNames are the roles the members page hands out
+var forumRoleNames = map[string]forumRole{
+	"member": forumMember,
+	"mod":    forumMod,
+	"admin":  forumAdmin,
+}
+
+// setForumRoleHandler promotes or demotes a member, the last admin can not
+// step down and the owner stays admin until they hand the forum over
+func setForumRoleHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permEditSettings) {
+			return append(errs, errors.New("only forum admins can change roles"))
+		}
+
+		role, ok := forumRoleNames[r.FormValue("role")]
+		if !ok {
+			return append(errs, errors.New("unknown role"))
+		}
+
+		member, ok := findForumMember(page.Members, r.PathValue("username"))
+		if !ok {
+			return append(errs, errors.New("member not found"))
+		}
+		if member.Identifier == page.Forum.CreatedByIdentifier && role != forumAdmin {
+			return append(errs, errors.New("the owner can not be demoted, they can transfer ownership first"))
+		}
+
+		err := setForumRole(ctx, page.Forum.ID, member.Identifier, role)
+		if errors.Is(err, errLastForumAdmin) {
+			return append(errs, errors.New("the last admin can not be demoted, make another member admin first"))
+		} else if err != nil {
+			return append(errs, errors.New("error changing role, try again"))
+		}
+
+		if member.Identifier != user.Identifier {
+			content := fmt.Sprintf("%s made you %s of the forum \"%s\".", user.Username, r.FormValue("role"), page.Forum.Name)
+			err = notifyUser(ctx, member.Identifier, "Your forum role changed", content, forumURL(page.Forum.Slug), page.Base)
+			if err != nil {
+				log.Println("error notifying forum role:", err)
+			}
+		}
+		return nil
+	})
+}
+
+// offerForumOwnershipHandler offers the forum to a member, nothing changes
+// until they accept on the forum page. A new offer replaces the old one.
+func offerForumOwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Owner {
+			return append(errs, errors.New("only the forum owner can transfer ownership"))
+		}
+
+		member, ok := findForumMember(page.Members, r.PathValue("username"))
+		if !ok {
+			return append(errs, errors.New("member not found"))
+		}
+		if member.Identifier == page.Forum.CreatedByIdentifier {
+			return append(errs, errors.New("this member already owns the forum"))
+		}
+
+		offer := `UPDATE forums SET pending_owner_identifier = $2 WHERE forum_id = $1`
+		_, err := database.Dbpool.Exec(ctx, offer, page.Forum.ID, member.Identifier)
+		if err != nil {
+			return append(errs, errors.New("error transferring ownership, try again"))
+		}
+
+		content := fmt.Sprintf("%s offered you ownership of the forum \"%s\", accept or decline it on the forum page.",
+			user.Username, page.Forum.Name)
+		err = notifyUser(ctx, member.Identifier, "You were offered a forum", content, forumURL(page.Forum.Slug), page.Base)
+		if err != nil {
+			log.Println("error notifying forum transfer:", err)
+		}
+		return nil
+	})
+}
+
+// cancelForumOwnershipHandler takes back an offer nobody answered yet
+func cancelForumOwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Owner {
+			return append(errs, errors.New("only the forum owner can transfer ownership"))
+		}
+
+		cancel := `UPDATE forums SET pending_owner_identifier = NULL WHERE forum_id = $1`
+		_, err := database.Dbpool.Exec(ctx, cancel, page.Forum.ID)
+		if err != nil {
+			return append(errs, errors.New("error cancelling the offer, try again"))
+		}
+		return nil
+	})
+}
+
+// answerForumOwnershipHandler accepts or declines an offer, accepting makes
+// the user owner and admin. The previous owner stays admin and is told
+// either way.
+func answerForumOwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	forumAction(w, r, func(ctx context.Context, user DbUser, forum Forum) (string, []error) {
+		var errs []error
+
+		if !forum.PendingOwnerIdentifier.Valid || forum.PendingOwnerIdentifier.UUID != user.Identifier {
+			return "", append(errs, errors.New("this forum was not offered to you"))
+		}
+
+		accept := r.FormValue("accept") == "true"
+		err := answerForumOwnership(ctx, forum.ID, user.Identifier, accept)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", append(errs, errors.New("the offer was taken back"))
+		} else if err != nil {
+			return "", append(errs, errors.New("error answering the offer, try again"))
+		}
+		forgetForumMember(ctx, forum.ID, user.Identifier)
+
+		subject, verb := "Forum ownership declined", "declined"
+		if accept {
+			subject, verb = "Forum ownership transferred", "accepted"
+		}
+		content := fmt.Sprintf("%s %s ownership of the forum \"%s\".", user.Username, verb, forum.Name)
+		err = notifyUser(ctx, forum.CreatedByIdentifier, subject, content, forumURL(forum.Slug), siteURL(r))
+		if err != nil {
+			log.Println("error notifying forum transfer:", err)
+		}
+		return forumURL(forum.Slug), nil
+	})
+}
+
+// OwnedBy tells if m owns the forum
+func (p ForumMembersPage) OwnedBy(m ForumMember) bool {
+	return p.Forum.CreatedByIdentifier == m.Identifier
+}
+
+// PendingOwner is the username ownership is offered to, empty without an
+// offer
+func (p ForumMembersPage) PendingOwner() string {
+	for _, m := range p.Members {
+		if p.Forum.PendingOwnerIdentifier.Valid && p.Forum.PendingOwnerIdentifier.UUID == m.Identifier {
+			return m.Username
+		}
+	}
+	return ""
+}
+
+func findForumMember(members []ForumMember, username string) (ForumMember, bool) {
+	for _, m := range members {
+		if m.Username == username {
+			return m, true
+		}
+	}
+	return ForumMember{}, false
+}
+
+// lockForumAdmins locks the forum row so two admins stepping down at the same
+// time can not leave it without any, it returns whether userIdentifier is
+// the only admin left
+func lockForumAdmins(ctx context.Context, tx pgx.Tx, forumID, userIdentifier uuid.UUID) (bool, error) {
+	_, err := tx.Exec(ctx, `SELECT 1 FROM forums WHERE forum_id = $1 FOR UPDATE`, forumID)
+	if err != nil {
+		return false, err
+	}
+
+	var last bool
+	check := `
+	SELECT EXISTS (SELECT 1 FROM forum_admins WHERE forum_id = $1 AND user_identifier = $2)
+	       AND NOT EXISTS (SELECT 1 FROM forum_admins WHERE forum_id = $1 AND user_identifier <> $2);
+	`
+	err = tx.QueryRow(ctx, check, forumID, userIdentifier).Scan(&last)
+	return last, err
+}
+
+// setForumRole replaces the role of a member, admins and mods are kept in
+// their own tables and a member is in at most one of them
+func setForumRole(ctx context.Context, forumID, userIdentifier uuid.UUID, role forumRole) error {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	last, err := lockForumAdmins(ctx, tx, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+	if last && role != forumAdmin {
+		return errLastForumAdmin
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM forum_admins WHERE forum_id = $1 AND user_identifier = $2`, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM forum_mods WHERE forum_id = $1 AND user_identifier = $2`, forumID, userIdentifier)
+	if err != nil {
+		return err
+	}
+
+	switch role {
+	case forumAdmin:
+		_, err = tx.Exec(ctx, `INSERT INTO forum_admins (user_identifier, forum_id) VALUES ($1, $2)`, userIdentifier, forumID)
+	case forumMod:
+		_, err = tx.Exec(ctx, `INSERT INTO forum_mods (user_identifier, forum_id) VALUES ($1, $2)`, userIdentifier, forumID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// answerForumOwnership clears the offer and on accept hands the forum to
+// userIdentifier, joining them as admin. The offer is checked again under
+// the row lock so one taken back meanwhile is not accepted.
+func answerForumOwnership(ctx context.Context, forumID, userIdentifier uuid.UUID, accept bool) error {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	answer := `
+	UPDATE forums
+	SET created_by_identifier = CASE WHEN $3::boolean THEN $2 ELSE created_by_identifier END,
+	    pending_owner_identifier = NULL
+	WHERE forum_id = $1 AND pending_owner_identifier = $2;
+	`
+	tag, err := tx.Exec(ctx, answer, forumID, userIdentifier, accept)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	if accept {
+		_, err = tx.Exec(ctx, `INSERT INTO forum_users (user_identifier, forum_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, userIdentifier, forumID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM forum_mods WHERE forum_id = $1 AND user_identifier = $2`, forumID, userIdentifier)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO forum_admins (user_identifier, forum_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, userIdentifier, forumID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestForumRoleFor(t *testing.T) {
+	public := Forum{Public: true}
+	private := Forum{}
+	user := DbUser{Identifier: uuid.New(), Role: 'U'}
+	siteAdmin := DbUser{Identifier: uuid.New(), Role: 'A'}
+
+	tests := []struct {
+		name               string
+		forum              Forum
+		user               DbUser
+		member, admin, mod bool
+		want               forumRole
+	}{
+		{"stranger in private forum", private, user, false, false, false, forumGuest},
+		{"stranger in public forum", public, user, false, false, false, forumMember},
+		{"member of private forum", private, user, true, false, false, forumMember},
+		{"mod", private, user, true, false, true, forumMod},
+		{"admin", private, user, true, true, false, forumAdmin},
+		{"admin and mod", private, user, true, true, true, forumAdmin},
+		{"site admin", private, siteAdmin, false, false, false, forumAdmin},
+	}
+	for _, tt := range tests {
+		if got := forumRoleFor(tt.forum, tt.user, tt.member, tt.admin, tt.mod); got != tt.want {
+			t.Errorf("%s: forumRoleFor = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForumAuthCan(t *testing.T) {
+	all := []forumPermission{permPost, permPin, permLock, permAnnounce, permDeleteOthers, permBan, permMembers, permEditSettings}
+	allowed := func(ps ...forumPermission) map[forumPermission]bool {
+		m := map[forumPermission]bool{}
+		for _, p := range ps {
+			m[p] = true
+		}
+		return m
+	}
+	mod := allowed(permPost, permPin, permLock, permAnnounce, permDeleteOthers, permBan, permMembers)
+
+	tests := []struct {
+		name      string
+		role      forumRole
+		canRead   bool
+		sanctions []ForumSanction
+		want      map[forumPermission]bool
+	}{
+		{"visitor", forumGuest, true, nil, allowed()},
+		{"guest without read", forumGuest, false, nil, allowed()},
+		{"member", forumMember, true, nil, allowed(permPost)},
+		{"muted member", forumMember, true, []ForumSanction{{Kind: 'M'}}, allowed()},
+		{"banned member", forumMember, true, []ForumSanction{{Kind: 'B'}}, allowed()},
+		{"mod", forumMod, true, nil, mod},
+		{"admin", forumAdmin, true, nil, allowed(all...)},
+		{"admin without read", forumAdmin, false, nil, allowed()},
+	}
+	for _, tt := range tests {
+		auth := ForumAuth{Role: tt.role, CanRead: tt.canRead}
+		auth.sanction(tt.sanctions)
+		for _, p := range all {
+			if got := auth.Can(p); got != tt.want[p] {
+				t.Errorf("%s: Can(%q) = %v, want %v", tt.name, p, got, tt.want[p])
+			}
+		}
+		if auth.Can("unknown") {
+			t.Errorf("%s: Can allowed an unknown permission", tt.name)
+		}
+	}
+}
+
+func TestForumAuthSanction(t *testing.T) {
+	auth := ForumAuth{Role: forumMember, CanRead: true}
+	auth.sanction([]ForumSanction{{Kind: 'M', Reason: "spam"}, {Kind: 'B', Reason: "abuse"}})
+	if auth.CanRead {
+		t.Error("banned user can still read")
+	}
+	if auth.Ban == nil || auth.Ban.Reason != "abuse" {
+		t.Errorf("Ban = %+v, want the abuse ban", auth.Ban)
+	}
+	if auth.Mute == nil || auth.Mute.Reason != "spam" {
+		t.Errorf("Mute = %+v, want the spam mute", auth.Mute)
+	}
+}
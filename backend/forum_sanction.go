@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// forum:slow:<forum id>:<user identifier> exists while the user has to wait
+// before posting again in a slow mode forum
+const forumSlowModeKey = "forum:slow:"
+
+// longest slow mode, an hour between messages
+const maxSlowModeSeconds = 3600
+
+var forumSanctionKinds = map[string]rune{
+	"ban":  'B',
+	"mute": 'M',
+}
+
+// ForumSanction is an active ban or mute, nil ExpiresAt lasts until lifted
+// and Moderator is empty once the moderator deleted their account
+type ForumSanction struct {
+	Identifier uuid.UUID
+	Username   string
+	Kind       rune
+	Reason     string
+	Moderator  string
+	ExpiresAt  *time.Time
+	CreatedAt  time.Time
+}
+
+func (s ForumSanction) KindName() string {
+	if s.Kind == 'B' {
+		return "ban"
+	}
+	return "mute"
+}
+
+// err is what the sanctioned user gets to read
+func (s ForumSanction) err() error {
+	until := "until a moderator lifts it"
+	if s.ExpiresAt != nil {
+		until = "until " + s.ExpiresAt.Format("2 Jan 2006 15:04")
+	}
+	if s.Kind == 'B' {
+		return fmt.Errorf("you are banned from this forum %s, reason: %s", until, s.Reason)
+	}
+	return fmt.Errorf("you are muted in this forum %s, reason: %s", until, s.Reason)
+}
+
+// postError tells why Can(permPost) said no
+func (a ForumAuth) postError() error {
+	switch {
+	case a.Ban != nil:
+		return a.Ban.err()
+	case a.Mute != nil:
+		return a.Mute.err()
+	case !a.CanRead:
+		return errPrivateForum
+	}
+	return errors.New("you can not post in this forum")
+}
+
+// sanctionForumUserHandler bans or mutes a user, minutes of 0 bans for good.
+// Forum staff and site admins can not be sanctioned, they are demoted first.
+func sanctionForumUserHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permBan) {
+			return append(errs, errors.New("only forum mods and admins can ban and mute"))
+		}
+
+		kind, ok := forumSanctionKinds[r.FormValue("kind")]
+		if !ok {
+			errs = append(errs, errors.New("choose ban or mute"))
+		}
+		minutes, err := optionalInt(r.FormValue("minutes"))
+		if err != nil || minutes < 0 || minutes > 525600 {
+			errs = append(errs, errors.New("duration must be between 0 minutes and a year"))
+		} else if minutes == 0 && kind == 'M' {
+			errs = append(errs, errors.New("mutes need a duration"))
+		}
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		if reason == "" {
+			errs = append(errs, errors.New("please provide a reason"))
+		} else if countCharacters(reason) > 512 {
+			errs = append(errs, errors.New("reason should be less than 512 characters"))
+		}
+		if errs != nil {
+			return errs
+		}
+
+		var target uuid.UUID
+		var staff bool
+		getUser := `
+		SELECT u.user_identifier, u.role = 'A'
+		       OR EXISTS (SELECT 1 FROM forum_admins WHERE forum_id = $2 AND user_identifier = u.user_identifier)
+		       OR EXISTS (SELECT 1 FROM forum_mods WHERE forum_id = $2 AND user_identifier = u.user_identifier)
+		FROM users u WHERE u.username = $1;
+		`
+		err = database.Dbpool.QueryRow(ctx, getUser, strings.TrimSpace(r.FormValue("username")), page.Forum.ID).Scan(&target, &staff)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return append(errs, errors.New("user does not exists"))
+		} else if err != nil {
+			return append(errs, errors.New("error finding user, try again"))
+		}
+		if staff {
+			return append(errs, errors.New("forum staff can not be banned or muted, change their role first"))
+		}
+
+		sanction, err := sanctionForumUser(ctx, page.Forum.ID, target, kind, reason, user.Identifier, minutes)
+		if err != nil {
+			return append(errs, errors.New("error saving "+r.FormValue("kind")+", try again"))
+		}
+
+		// a banned user stops receiving the forum and its topics right away
+		if kind == 'B' {
+			closeForumSubscribers(ctx, page.Forum.ID, "you are banned from this forum",
+				func(u DbUser) bool { return u.Identifier == target })
+		}
+
+		subject := "You were muted in a forum"
+		if kind == 'B' {
+			subject = "You were banned from a forum"
+		}
+		content := fmt.Sprintf("Forum \"%s\": %s", page.Forum.Name, sanction.err())
+		err = notifyUser(ctx, target, subject, content, forumURL(page.Forum.Slug), page.Base)
+		if err != nil {
+			log.Println("error notifying forum sanction:", err)
+		}
+		return nil
+	})
+}
+
+func liftForumSanctionHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permBan) {
+			return append(errs, errors.New("only forum mods and admins can lift bans and mutes"))
+		}
+
+		var sanction *ForumSanction
+		for i, s := range page.Sanctions {
+			if s.Username == r.PathValue("username") && s.KindName() == r.PathValue("kind") {
+				sanction = &page.Sanctions[i]
+				break
+			}
+		}
+		if sanction == nil {
+			return append(errs, errors.New("ban or mute not found"))
+		}
+
+		lift := `DELETE FROM forum_sanctions WHERE forum_id = $1 AND user_identifier = $2 AND kind = $3`
+		_, err := database.Dbpool.Exec(ctx, lift, page.Forum.ID, sanction.Identifier, string(sanction.Kind))
+		if err != nil {
+			return append(errs, errors.New("error lifting "+sanction.KindName()+", try again"))
+		}
+
+		content := fmt.Sprintf("%s lifted your %s in the forum \"%s\".", user.Username, sanction.KindName(), page.Forum.Name)
+		err = notifyUser(ctx, sanction.Identifier, "Your forum "+sanction.KindName()+" was lifted", content,
+			forumURL(page.Forum.Slug), page.Base)
+		if err != nil {
+			log.Println("error notifying lifted forum sanction:", err)
+		}
+		return nil
+	})
+}
+
+// setSlowModeHandler sets the seconds members wait between messages, 0 turns
+// slow mode off
+func setSlowModeHandler(w http.ResponseWriter, r *http.Request) {
+	membersAction(w, r, func(ctx context.Context, user DbUser, page ForumMembersPage) []error {
+		var errs []error
+
+		if !page.Can(permBan) {
+			return append(errs, errors.New("only forum mods and admins can change slow mode"))
+		}
+
+		seconds, err := optionalInt(r.FormValue("seconds"))
+		if err != nil || seconds < 0 || seconds > maxSlowModeSeconds {
+			return append(errs, fmt.Errorf("slow mode must be between 0 and %d seconds", maxSlowModeSeconds))
+		}
+
+		update := `UPDATE forums SET slow_mode_seconds = $2 WHERE forum_id = $1`
+		_, err = database.Dbpool.Exec(ctx, update, page.Forum.ID, seconds)
+		if err != nil {
+			return append(errs, errors.New("error changing slow mode, try again"))
+		}
+		return nil
+	})
+}
+
+// checkSlowMode claims the slow mode key of the user, a user still holding
+// it posted too recently. Claiming before posting keeps two quick posts from
+// both getting in, a post that then fails gives the key back with
+// releaseSlowMode. Staff is not slowed down. Redis being down lets messages
+// through rather than blocking the forum.
+func checkSlowMode(ctx context.Context, forum Forum, userIdentifier uuid.UUID, auth ForumAuth) error {
+	if forum.SlowModeSeconds == 0 || auth.Role >= forumMod {
+		return nil
+	}
+
+	key := forumSlowModeKey + forum.ID.String() + ":" + userIdentifier.String()
+	wait := time.Duration(forum.SlowModeSeconds) * time.Second
+
+	claimed, err := database.RedisAllClients.Client1.SetNX(ctx, key, "1", wait).Result()
+	if err != nil {
+		log.Println("error checking slow mode:", err)
+		return nil
+	}
+	if claimed {
+		return nil
+	}
+
+	left, err := database.RedisAllClients.Client1.TTL(ctx, key).Result()
+	if err != nil || left <= 0 {
+		left = wait
+	}
+	return fmt.Errorf("slow mode is on, wait %d more seconds before posting again", int(left.Round(time.Second).Seconds()))
+}
+
+// releaseSlowMode lets the user post again right away after their post
+// failed, ctx may be what ran out so it uses its own
+func releaseSlowMode(forum Forum, userIdentifier uuid.UUID) {
+	if forum.SlowModeSeconds == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := forumSlowModeKey + forum.ID.String() + ":" + userIdentifier.String()
+	err := database.RedisAllClients.Client1.Del(ctx, key).Err()
+	if err != nil {
+		log.Println("error releasing slow mode:", err)
+	}
+}
+
+func sanctionForumUser(ctx context.Context, forumID, userIdentifier uuid.UUID, kind rune, reason string, moderator uuid.UUID, minutes int) (ForumSanction, error) {
+	sanction := ForumSanction{Identifier: userIdentifier, Kind: kind, Reason: reason}
+
+	insert := `
+	INSERT INTO forum_sanctions (forum_id, user_identifier, kind, reason, moderator_identifier, expires_at)
+	VALUES ($1, $2, $3, $4, $5, CASE WHEN $6::int > 0 THEN CURRENT_TIMESTAMP + make_interval(mins => $6::int) END)
+	ON CONFLICT (forum_id, user_identifier, kind) DO UPDATE
+	SET reason = EXCLUDED.reason, moderator_identifier = EXCLUDED.moderator_identifier,
+	    expires_at = EXCLUDED.expires_at, created_at = CURRENT_TIMESTAMP
+	RETURNING expires_at, created_at;
+	`
+	err := database.Dbpool.QueryRow(ctx, insert, forumID, userIdentifier, string(kind), reason, moderator, minutes).Scan(
+		&sanction.ExpiresAt, &sanction.CreatedAt)
+	return sanction, err
+}
+
+const forumSanctionColumns = `u.user_identifier, u.username, s.kind, s.reason, COALESCE(mu.username, ''),
+	s.expires_at, s.created_at`
+
+func scanForumSanction(row pgx.Row) (ForumSanction, error) {
+	var s ForumSanction
+	var kind string
+	err := row.Scan(&s.Identifier, &s.Username, &kind, &s.Reason, &s.Moderator, &s.ExpiresAt, &s.CreatedAt)
+	s.Kind = firstRune(kind)
+	return s, err
+}
+
+// listForumSanctions returns the bans and mutes still in force, newest first
+func listForumSanctions(ctx context.Context, forumID uuid.UUID) ([]ForumSanction, error) {
+	list := `
+	SELECT ` + forumSanctionColumns + `
+	FROM forum_sanctions s
+	JOIN users u ON u.user_identifier = s.user_identifier
+	LEFT JOIN users mu ON mu.user_identifier = s.moderator_identifier
+	WHERE s.forum_id = $1 AND (s.expires_at IS NULL OR s.expires_at > CURRENT_TIMESTAMP)
+	ORDER BY s.created_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumSanction, error) {
+		return scanForumSanction(row)
+	})
+}
+
+// userForumSanctions returns the bans and mutes of one user still in force
+func userForumSanctions(ctx context.Context, forumID, userIdentifier uuid.UUID) ([]ForumSanction, error) {
+	list := `
+	SELECT ` + forumSanctionColumns + `
+	FROM forum_sanctions s
+	JOIN users u ON u.user_identifier = s.user_identifier
+	LEFT JOIN users mu ON mu.user_identifier = s.moderator_identifier
+	WHERE s.forum_id = $1 AND s.user_identifier = $2
+	  AND (s.expires_at IS NULL OR s.expires_at > CURRENT_TIMESTAMP);
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumSanction, error) {
+		return scanForumSanction(row)
+	})
+}
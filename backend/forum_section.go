@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// ForumSection groups forums in the directory, site admins define them.
+// StaffOnly sections take new forums from site admins only.
+type ForumSection struct {
+	ID          uuid.UUID
+	Name        string
+	Description string
+	Position    int
+	StaffOnly   bool
+	CreatedAt   time.Time
+}
+
+// ForumSectionsPage is where site admins manage the sections
+type ForumSectionsPage struct {
+	Sections []ForumSection
+	User     DbUser
+}
+
+func (s ForumSection) canCreateForum(user DbUser) bool {
+	return !s.StaffOnly || user.Role == 'A'
+}
+
+func forumSectionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := forumSectionsPage(ctx, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	renderHtml(w, r, page, nil, "forumSections.html")
+}
+
+// forumSectionsPage loads the sections for site admins
+func forumSectionsPage(ctx context.Context, user DbUser) (ForumSectionsPage, error) {
+	if user.Role != 'A' {
+		return ForumSectionsPage{}, pgx.ErrNoRows
+	}
+
+	sections, err := listForumSections(ctx)
+	if err != nil {
+		return ForumSectionsPage{}, err
+	}
+	return ForumSectionsPage{Sections: sections, User: user}, nil
+}
+
+// sectionAction runs a form of the sections page, errors are shown on it
+// and success goes back to it
+func sectionAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, page ForumSectionsPage) []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := forumSectionsPage(ctx, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	errs := action(ctx, page)
+	if len(errs) > 0 {
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "forumSections.html")
+		return
+	}
+
+	http.Redirect(w, r, "/forums/sections", http.StatusFound)
+}
+
+// sectionForm reads the fields shared by the create and edit forms
+func sectionForm(r *http.Request) (ForumSection, []error) {
+	var errs []error
+
+	section := ForumSection{
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		StaffOnly:   r.FormValue("staffOnly") == "true",
+	}
+
+	if section.Name == "" {
+		errs = append(errs, errors.New("please provide section name"))
+	} else if countCharacters(section.Name) > 64 {
+		errs = append(errs, errors.New("section name should be less than 64 characters"))
+	}
+	if countCharacters(section.Description) > 2000 {
+		errs = append(errs, errors.New("section description should be less than 2000 characters"))
+	}
+
+	if position := strings.TrimSpace(r.FormValue("position")); position != "" {
+		var err error
+		section.Position, err = strconv.Atoi(position)
+		if err != nil {
+			errs = append(errs, errors.New("position should be a whole number"))
+		}
+	}
+	return section, errs
+}
+
+func createForumSectionHandler(w http.ResponseWriter, r *http.Request) {
+	sectionAction(w, r, func(ctx context.Context, page ForumSectionsPage) []error {
+		section, errs := sectionForm(r)
+		if len(errs) > 0 {
+			return errs
+		}
+
+		insert := `
+		INSERT INTO forum_sections (section_name, description, position, staff_only)
+		VALUES ($1, $2, $3, $4);
+		`
+		_, err := database.Dbpool.Exec(ctx, insert, section.Name, section.Description, section.Position, section.StaffOnly)
+		if err != nil {
+			return append(errs, sectionSaveError(err))
+		}
+		return nil
+	})
+}
+
+func updateForumSectionHandler(w http.ResponseWriter, r *http.Request) {
+	sectionAction(w, r, func(ctx context.Context, page ForumSectionsPage) []error {
+		section, errs := sectionForm(r)
+		if len(errs) > 0 {
+			return errs
+		}
+
+		Id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			return append(errs, errors.New("section not found"))
+		}
+
+		update := `
+		UPDATE forum_sections SET section_name = $2, description = $3, position = $4, staff_only = $5
+		WHERE section_id = $1;
+		`
+		tag, err := database.Dbpool.Exec(ctx, update, Id, section.Name, section.Description, section.Position, section.StaffOnly)
+		if err != nil {
+			return append(errs, sectionSaveError(err))
+		}
+		if tag.RowsAffected() == 0 {
+			return append(errs, errors.New("section not found"))
+		}
+		return nil
+	})
+}
+
+// deleteForumSectionHandler removes a section, its forums stay and are
+// listed without a section
+func deleteForumSectionHandler(w http.ResponseWriter, r *http.Request) {
+	sectionAction(w, r, func(ctx context.Context, page ForumSectionsPage) []error {
+		var errs []error
+
+		Id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			return append(errs, errors.New("section not found"))
+		}
+
+		_, err = database.Dbpool.Exec(ctx, `DELETE FROM forum_sections WHERE section_id = $1`, Id)
+		if err != nil {
+			return append(errs, errors.New("error deleting section, try again"))
+		}
+		return nil
+	})
+}
+
+func sectionSaveError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return errors.New("section with this name already exists")
+	}
+	return errors.New("error saving section, try again")
+}
+
+// setForumSectionHandler moves a forum to another section or out of all of
+// them, only site admins sort forums
+func setForumSectionHandler(w http.ResponseWriter, r *http.Request) {
+	settingsAction(w, r, func(ctx context.Context, user DbUser, page ForumSettingsPage) []error {
+		var errs []error
+
+		if user.Role != 'A' {
+			return append(errs, errors.New("only site admins can move forums between sections"))
+		}
+
+		var sectionID uuid.NullUUID
+		if value := r.FormValue("section"); value != "" {
+			section, err := getForumSection(ctx, value)
+			if err != nil {
+				return append(errs, errors.New("section not found"))
+			}
+			sectionID = uuid.NullUUID{UUID: section.ID, Valid: true}
+		}
+
+		_, err := database.Dbpool.Exec(ctx, `UPDATE forums SET section_id = $2 WHERE forum_id = $1`, page.Forum.ID, sectionID)
+		if err != nil {
+			return append(errs, errors.New("error moving forum, try again"))
+		}
+		return nil
+	})
+}
+
+const forumSectionColumns = `section_id, section_name, description, position, staff_only, created_at`
+
+func scanForumSection(row pgx.Row) (ForumSection, error) {
+	var s ForumSection
+	err := row.Scan(&s.ID, &s.Name, &s.Description, &s.Position, &s.StaffOnly, &s.CreatedAt)
+	return s, err
+}
+
+func getForumSection(ctx context.Context, Id string) (ForumSection, error) {
+	sectionID, err := uuid.Parse(Id)
+	if err != nil {
+		return ForumSection{}, err
+	}
+
+	get := `SELECT ` + forumSectionColumns + ` FROM forum_sections WHERE section_id = $1`
+	return scanForumSection(database.Dbpool.QueryRow(ctx, get, sectionID))
+}
+
+// listForumSections returns every section in directory order
+func listForumSections(ctx context.Context) ([]ForumSection, error) {
+	list := `SELECT ` + forumSectionColumns + ` FROM forum_sections ORDER BY position, lower(section_name)`
+	rows, err := database.Dbpool.Query(ctx, list)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumSection, error) {
+		return scanForumSection(row)
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// longest side of a forum image in pixels, bigger uploads are scaled down
+const forumImageSize = 512
+
+var (
+	errForumNameTaken   = errors.New("forum name already used by another forum")
+	errForumNameControl = errors.New("forum name can't have line breaks, tabs or other control characters")
+	errConfirmPrivate   = errors.New("making the forum private hides it from everyone who is not a member " +
+		"and disconnects them from its live updates, tick the confirmation to go ahead")
+)
+
+// ForumSettingsPage is the settings of a forum, Sections are only loaded
+// for site admins who sort forums into them
+type ForumSettingsPage struct {
+	ForumAuth
+	Forum    Forum
+	User     DbUser
+	Sections []ForumSection
+}
+
+// InSection tells if the forum is in s
+func (p ForumSettingsPage) InSection(s ForumSection) bool {
+	return p.Forum.SectionID.Valid && p.Forum.SectionID.UUID == s.ID
+}
+
+// ForumUpdatedEvent tells open forum pages the settings changed
+type ForumUpdatedEvent struct {
+	Event       string `json:"event"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Rules       string `json:"rules"`
+	ImageURL    string `json:"image_url"`
+	Public      bool   `json:"public"`
+}
+
+func forumSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err := forumSettingsPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	renderHtml(w, r, page, nil, "forumSettings.html")
+}
+
+// forumSettingsPage loads the forum for those allowed permEditSettings
+func forumSettingsPage(ctx context.Context, r *http.Request, user DbUser) (ForumSettingsPage, error) {
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		return ForumSettingsPage{}, err
+	}
+
+	forum, err := getForum(ctx, Id)
+	if err != nil {
+		return ForumSettingsPage{}, err
+	}
+
+	page := ForumSettingsPage{Forum: forum, User: user}
+	page.ForumAuth, err = authorizeForum(ctx, forum, user)
+	if err != nil {
+		return ForumSettingsPage{}, err
+	}
+	if !page.Can(permEditSettings) {
+		return ForumSettingsPage{}, pgx.ErrNoRows
+	}
+	if user.Role == 'A' {
+		page.Sections, err = listForumSections(ctx)
+		if err != nil {
+			return ForumSettingsPage{}, err
+		}
+	}
+	return page, nil
+}
+
+// updateForumSettingsHandler saves the settings form, open pages of the
+// forum get the new settings and non-members are disconnected when it
+// goes private
+func updateForumSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var page ForumSettingsPage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	page, err = forumSettingsPage(ctx, r, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, page, errs, "forumSettings.html")
+		}
+	}()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+
+	updated := page.Forum
+	updated.Name = strings.TrimSpace(r.FormValue("name"))
+	updated.Description = strings.TrimSpace(r.FormValue("description"))
+	updated.Rules = strings.TrimSpace(r.FormValue("rules"))
+	updated.Public = r.FormValue("public") == "true"
+
+	if updated.Name == "" {
+		errs = append(errs, errors.New("please provide forum name"))
+	} else if countCharacters(updated.Name) > 128 {
+		errs = append(errs, errors.New("forum name should be less than 128 characters"))
+	} else if hasControlChars(updated.Name) {
+		errs = append(errs, errForumNameControl)
+	}
+	if countCharacters(updated.Description) > 2000 {
+		errs = append(errs, errors.New("description should be less than 2000 characters"))
+	}
+	if countCharacters(updated.Rules) > 10000 {
+		errs = append(errs, errors.New("rules should be less than 10000 characters"))
+	}
+	if page.Forum.Public && !updated.Public && r.FormValue("confirmPrivate") != "true" {
+		errs = append(errs, errConfirmPrivate)
+	}
+	if len(errs) > 0 {
+		return
+	}
+
+	if r.FormValue("removeImage") == "true" {
+		updated.ForumMediaID = uuid.NullUUID{}
+	}
+
+	file, header, err := r.FormFile("image")
+	if err == nil {
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, maxUploadSize+1))
+		if err != nil {
+			errs = append(errs, errors.New("error reading image, try again"))
+			return
+		}
+		if len(data) > maxUploadSize {
+			errs = append(errs, errors.New("image should be less than 10MB"))
+			return
+		}
+
+		data, err = resizeImage(data, forumImageSize)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+
+		media, err := storeMedia(ctx, data, header.Filename, user.Identifier)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		updated.ForumMediaID = uuid.NullUUID{UUID: media.ID, Valid: true}
+	} else if !errors.Is(err, http.ErrMissingFile) {
+		errs = append(errs, errors.New("please provide an image up to 10MB"))
+		return
+	}
+
+	err = updated.updateSettings(ctx)
+	if errors.Is(err, errForumNameTaken) {
+		errs = append(errs, err)
+		return
+	} else if err != nil {
+		errs = append(errs, errors.New("error saving settings, try again"))
+		return
+	}
+
+	publishForumUpdate(ctx, updated, page.Forum.Public && !updated.Public)
+	http.Redirect(w, r, "/forum/"+updated.ID.String()+"/settings", http.StatusFound)
+}
+
+func (forum Forum) updateSettings(ctx context.Context) error {
+	update := `
+	UPDATE forums
+	SET forum_name = $2, description = $3, rules = $4, forum_media_id = $5, public = $6
+	WHERE forum_id = $1 AND deleted_at IS NULL;
+	`
+	tag, err := database.Dbpool.Exec(ctx, update,
+		forum.ID, forum.Name, forum.Description, forum.Rules, forum.ForumMediaID, forum.Public)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return errForumNameTaken
+	} else if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// publishForumUpdate sends the new settings to open pages of the forum, when
+// it went private everyone who can no longer read it is disconnected from the
+// forum and its topics
+func publishForumUpdate(ctx context.Context, forum Forum, wentPrivate bool) {
+	if rmSrv == nil {
+		return
+	}
+	key := RoomKey{id: forum.ID, roomtype: "forum"}
+
+	if wentPrivate {
+		closeForumSubscribers(ctx, forum.ID, "this forum is private now", func(user DbUser) bool {
+			canRead, err := forum.canRead(ctx, user)
+			return err != nil || !canRead
+		})
+	}
+
+	eventByte, err := json.Marshal(ForumUpdatedEvent{
+		Event:       "forum_updated",
+		Name:        forum.Name,
+		Description: forum.Description,
+		Rules:       forum.Rules,
+		ImageURL:    forum.ImageURL(),
+		Public:      forum.Public,
+	})
+	if err != nil {
+		return
+	}
+	rmSrv.publishHandler(key, eventByte)
+}
+
+// hasControlChars reports line breaks, tabs and the like, forum names end up
+// in page titles and mail subjects where they don't belong
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// messages shown when a topic page opens, newer ones arrive over the websocket
+const topicPageSize = 100
+
+var errTopicLocked = errors.New("this topic is locked, only forum mods and admins can reply")
+
+// ForumTopic is a titled thread of a forum, Unread is set for logged in
+// users when there are replies since they last opened it
+type ForumTopic struct {
+	ID             uuid.UUID `json:"topic_id"`
+	ForumID        uuid.UUID `json:"forum_id"`
+	Title          string    `json:"title"`
+	AuthorUsername string    `json:"author_username"`
+	Locked         bool      `json:"locked"`
+	Pinned         bool      `json:"pinned"`
+	Posts          int       `json:"posts"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastReplyAt    time.Time `json:"last_reply_at"`
+	Unread         bool      `json:"unread"`
+}
+
+// TopicEvent is sent to the forum room when a topic is started and to the
+// topic room when it is locked or pinned
+type TopicEvent struct {
+	Event string     `json:"event"`
+	Topic ForumTopic `json:"topic"`
+}
+
+// TopicPage is a topic with its starter and latest messages, oldest first,
+// and the pinned messages and announcements of its forum. Those are only
+// loaded when CanRead.
+type TopicPage struct {
+	ForumAuth
+	Forum         Forum
+	Topic         ForumTopic
+	Messages      []Message
+	Pins          []ForumPin
+	Announcements []ForumAnnouncement
+	User          DbUser
+}
+
+// CanPost tells if the viewer may reply, locked topics are left to staff
+func (p TopicPage) CanPost() bool {
+	return p.Can(permPost) && (!p.Topic.Locked || p.Can(permLock))
+}
+
+// CanTrash tells if the viewer may move m to the trash
+func (p TopicPage) CanTrash(m Message) bool {
+	return p.Can(permDeleteOthers) || (p.User.Username != "" && m.AuthorIdentifier == p.User.Identifier)
+}
+
+func viewTopicHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	forumID, current, err := resolveSlug(ctx, slugForum, r.PathValue("slug"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	topicID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	topic, err := getTopic(ctx, topicID)
+	if err != nil || topic.ForumID != forumID {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	forum, err := getForum(ctx, forumID)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	// renamed forum, send the old link to the new one
+	if !current {
+		http.Redirect(w, r, topicURL(forum.Slug, topic.ID), http.StatusMovedPermanently)
+		return
+	}
+
+	// visitors read topics of public forums
+	user, _ := userInfoMiddleware(r)
+
+	page, err := topicPage(ctx, forum, topic, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	// the forum page tells why it can not be read
+	if !page.CanRead {
+		http.Redirect(w, r, forumURL(forum.Slug), http.StatusFound)
+		return
+	}
+
+	if user.Identifier != uuid.Nil {
+		err = markTopicRead(ctx, topic.ID, user.Identifier)
+		if err != nil {
+			log.Println("error marking topic read:", err)
+		}
+	}
+
+	renderHtml(w, r, page, nil, "topic.html")
+}
+
+// topicPage loads what user gets to see of topic, the starter stays on top
+// when the topic has more messages than fit on the page
+func topicPage(ctx context.Context, forum Forum, topic ForumTopic, user DbUser) (TopicPage, error) {
+	var err error
+	page := TopicPage{Forum: forum, Topic: topic, User: user}
+
+	page.ForumAuth, err = authorizeForum(ctx, forum, user)
+	if err != nil {
+		return TopicPage{}, err
+	}
+	if !page.CanRead {
+		return page, nil
+	}
+
+	page.Messages, err = listTopicMessages(ctx, topic.ID, topicPageSize)
+	if err != nil {
+		return TopicPage{}, err
+	}
+	slices.Reverse(page.Messages)
+
+	if len(page.Messages) == topicPageSize {
+		starter, err := getTopicStarter(ctx, topic.ID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return TopicPage{}, err
+		}
+		if err == nil && starter.MessageId != page.Messages[0].MessageId {
+			page.Messages = append([]Message{starter}, page.Messages...)
+		}
+	}
+
+	page.Pins, err = listForumPins(ctx, forum.ID)
+	if err != nil {
+		return TopicPage{}, err
+	}
+	page.Announcements, err = listForumAnnouncements(ctx, forum.ID)
+	if err != nil {
+		return TopicPage{}, err
+	}
+	return page, nil
+}
+
+// createTopicHandler starts a topic with its first message, posting rules
+// of the forum apply to the starter as to any reply
+func createTopicHandler(w http.ResponseWriter, r *http.Request) {
+	forumAction(w, r, func(ctx context.Context, user DbUser, forum Forum) (string, []error) {
+		var errs []error
+
+		title := strings.TrimSpace(r.FormValue("title"))
+		content := strings.TrimSpace(r.FormValue("content"))
+
+		if title == "" {
+			errs = append(errs, errors.New("please provide a topic title"))
+		} else if countCharacters(title) > 256 {
+			errs = append(errs, errors.New("topic title should be less than 256 characters"))
+		}
+		if content == "" {
+			errs = append(errs, errors.New("message is empty try again"))
+		}
+		if errs != nil {
+			return "", errs
+		}
+
+		auth, err := authorizeForum(ctx, forum, user)
+		if err != nil {
+			return "", append(errs, errors.New("something went wrong in server try again"))
+		}
+		if !auth.Can(permPost) {
+			return "", append(errs, auth.postError())
+		}
+		err = checkSlowMode(ctx, forum, user.Identifier, auth)
+		if err != nil {
+			return "", append(errs, err)
+		}
+
+		topic, err := createTopic(ctx, forum.ID, user, title, content)
+		if err != nil {
+			releaseSlowMode(forum, user.Identifier)
+			return "", append(errs, errors.New("error starting topic, try again"))
+		}
+
+		publishTopic(RoomKey{id: forum.ID, roomtype: "forum"}, "topic_created", topic)
+		return topicURL(forum.Slug, topic.ID), nil
+	})
+}
+
+// lockTopicHandler locks or unlocks a topic, locked topics keep their
+// messages but only staff can reply
+func lockTopicHandler(w http.ResponseWriter, r *http.Request) {
+	topicAction(w, r, func(ctx context.Context, user DbUser, page TopicPage) []error {
+		var errs []error
+
+		if !page.Can(permLock) {
+			return append(errs, errors.New("only forum mods and admins can lock topics"))
+		}
+
+		page.Topic.Locked = r.FormValue("locked") == "true"
+		update := `UPDATE forum_topics SET locked = $2 WHERE topic_id = $1`
+		_, err := database.Dbpool.Exec(ctx, update, page.Topic.ID, page.Topic.Locked)
+		if err != nil {
+			return append(errs, errors.New("error locking topic, try again"))
+		}
+
+		publishTopic(RoomKey{id: page.Topic.ID, roomtype: "topic"}, "topic_updated", page.Topic)
+		return nil
+	})
+}
+
+// pinTopicHandler pins or unpins a topic, pinned topics head the forum page
+func pinTopicHandler(w http.ResponseWriter, r *http.Request) {
+	topicAction(w, r, func(ctx context.Context, user DbUser, page TopicPage) []error {
+		var errs []error
+
+		if !page.Can(permPin) {
+			return append(errs, errors.New("only forum mods and admins can pin topics"))
+		}
+
+		page.Topic.Pinned = r.FormValue("pinned") == "true"
+		update := `UPDATE forum_topics SET pinned = $2 WHERE topic_id = $1`
+		_, err := database.Dbpool.Exec(ctx, update, page.Topic.ID, page.Topic.Pinned)
+		if err != nil {
+			return append(errs, errors.New("error pinning topic, try again"))
+		}
+
+		publishTopic(RoomKey{id: page.Topic.ID, roomtype: "topic"}, "topic_updated", page.Topic)
+		return nil
+	})
+}
+
+// topicAction loads the topic page of a topic form for a logged in user,
+// errors of action are shown on it and success goes back to the topic
+func topicAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, user DbUser, page TopicPage) []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	topic, err := getTopic(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	forum, err := getForum(ctx, topic.ForumID)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	page, err := topicPage(ctx, forum, topic, user)
+	if err != nil || !page.CanRead {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	errs := action(ctx, user, page)
+	if len(errs) > 0 {
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "topic.html")
+		return
+	}
+
+	http.Redirect(w, r, topicURL(forum.Slug, topic.ID), http.StatusFound)
+}
+
+func publishTopic(key RoomKey, event string, topic ForumTopic) {
+	if rmSrv == nil {
+		return
+	}
+	eventByte, err := json.Marshal(TopicEvent{Event: event, Topic: topic})
+	if err != nil {
+		return
+	}
+	rmSrv.publishHandler(key, eventByte)
+}
+
+// forumRooms are the websocket rooms of a forum, its own and one per topic
+func forumRooms(ctx context.Context, forumID uuid.UUID) ([]RoomKey, error) {
+	rows, err := database.Dbpool.Query(ctx, `SELECT topic_id FROM forum_topics WHERE forum_id = $1`, forumID)
+	if err != nil {
+		return nil, err
+	}
+	topicIDs, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []RoomKey{{id: forumID, roomtype: "forum"}}
+	for _, id := range topicIDs {
+		keys = append(keys, RoomKey{id: id, roomtype: "topic"})
+	}
+	return keys, nil
+}
+
+// publishForum sends data to the forum page and every open topic of it
+func publishForum(ctx context.Context, forumID uuid.UUID, data []byte) {
+	if rmSrv == nil {
+		return
+	}
+	keys, err := forumRooms(ctx, forumID)
+	if err != nil {
+		log.Println("error listing forum rooms:", err)
+		keys = []RoomKey{{id: forumID, roomtype: "forum"}}
+	}
+	for _, key := range keys {
+		rmSrv.publishHandler(key, data)
+	}
+}
+
+// closeForumSubscribers closes the forum room and the rooms of its topics
+// for the subscribers drop picks
+func closeForumSubscribers(ctx context.Context, forumID uuid.UUID, reason string, drop func(user DbUser) bool) {
+	if rmSrv == nil {
+		return
+	}
+	keys, err := forumRooms(ctx, forumID)
+	if err != nil {
+		log.Println("error listing forum rooms:", err)
+		keys = []RoomKey{{id: forumID, roomtype: "forum"}}
+	}
+	for _, key := range keys {
+		rmSrv.closeSubscribers(key, reason, drop)
+	}
+}
+
+// createTopic saves the topic and its starter message together, the author
+// has read their own topic
+func createTopic(ctx context.Context, forumID uuid.UUID, user DbUser, title, content string) (ForumTopic, error) {
+	topic := ForumTopic{ForumID: forumID, Title: title, AuthorUsername: user.Username, Posts: 1}
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return ForumTopic{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	insertTopic := `
+	INSERT INTO forum_topics (forum_id, title, author_identifier)
+	VALUES ($1, $2, $3)
+	RETURNING topic_id, created_at, last_reply_at;
+	`
+	err = tx.QueryRow(ctx, insertTopic, forumID, title, user.Identifier).Scan(
+		&topic.ID, &topic.CreatedAt, &topic.LastReplyAt)
+	if err != nil {
+		return ForumTopic{}, err
+	}
+
+	insertMsg := `INSERT INTO messages (author, author_identifier, content, in_table, in_table_id, topic_id, created_at)
+                  VALUES ($1, $2, $3, 'F', $4, $5, $6)`
+	_, err = tx.Exec(ctx, insertMsg, user.Username, user.Identifier, content, forumID, topic.ID, topic.CreatedAt)
+	if err != nil {
+		return ForumTopic{}, err
+	}
+
+	read := `INSERT INTO forum_topic_reads (topic_id, user_identifier, read_at) VALUES ($1, $2, $3)`
+	_, err = tx.Exec(ctx, read, topic.ID, user.Identifier, topic.LastReplyAt)
+	if err != nil {
+		return ForumTopic{}, err
+	}
+
+	return topic, tx.Commit(ctx)
+}
+
+// touchTopic moves the topic up the forum page after a reply, the one
+// replying has read it up to there
+func touchTopic(ctx context.Context, topicID, userIdentifier uuid.UUID, at time.Time) error {
+	touch := `
+	WITH touched AS (
+	    UPDATE forum_topics SET last_reply_at = GREATEST(last_reply_at, $3::timestamp) WHERE topic_id = $1
+	)
+	INSERT INTO forum_topic_reads (topic_id, user_identifier, read_at)
+	VALUES ($1, $2, $3::timestamp)
+	ON CONFLICT (topic_id, user_identifier) DO UPDATE
+	SET read_at = GREATEST(forum_topic_reads.read_at, EXCLUDED.read_at);
+	`
+	_, err := database.Dbpool.Exec(ctx, touch, topicID, userIdentifier, at)
+	return err
+}
+
+func markTopicRead(ctx context.Context, topicID, userIdentifier uuid.UUID) error {
+	read := `
+	INSERT INTO forum_topic_reads (topic_id, user_identifier) VALUES ($1, $2)
+	ON CONFLICT (topic_id, user_identifier) DO UPDATE SET read_at = CURRENT_TIMESTAMP;
+	`
+	_, err := database.Dbpool.Exec(ctx, read, topicID, userIdentifier)
+	return err
+}
+
+const topicColumns = `t.topic_id, t.forum_id, t.title, COALESCE(u.username, ''), t.locked, t.pinned,
+	(SELECT COUNT(*) FROM messages m WHERE m.topic_id = t.topic_id AND m.deleted_at IS NULL)::int,
+	t.created_at, t.last_reply_at`
+
+func scanTopic(row pgx.Row, extra ...any) (ForumTopic, error) {
+	var t ForumTopic
+	dest := append([]any{&t.ID, &t.ForumID, &t.Title, &t.AuthorUsername, &t.Locked, &t.Pinned,
+		&t.Posts, &t.CreatedAt, &t.LastReplyAt}, extra...)
+	err := row.Scan(dest...)
+	return t, err
+}
+
+func getTopic(ctx context.Context, topicID uuid.UUID) (ForumTopic, error) {
+	get := `
+	SELECT ` + topicColumns + `
+	FROM forum_topics t
+	LEFT JOIN users u ON u.user_identifier = t.author_identifier
+	WHERE t.topic_id = $1;
+	`
+	return scanTopic(database.Dbpool.QueryRow(ctx, get, topicID))
+}
+
+// listForumTopics returns pinned topics first, then the ones replied to
+// last. A zero viewer is a visitor and sees nothing unread, limit 0 lists
+// every topic.
+func listForumTopics(ctx context.Context, forumID, viewer uuid.UUID, limit int) ([]ForumTopic, error) {
+	list := `
+	SELECT ` + topicColumns + `,
+	       $2 <> '00000000-0000-0000-0000-000000000000'::uuid
+	       AND t.last_reply_at > COALESCE(r.read_at, '-infinity'::timestamp)
+	FROM forum_topics t
+	LEFT JOIN users u ON u.user_identifier = t.author_identifier
+	LEFT JOIN forum_topic_reads r ON r.topic_id = t.topic_id AND r.user_identifier = $2
+	WHERE t.forum_id = $1
+	ORDER BY t.pinned DESC, t.last_reply_at DESC
+	LIMIT NULLIF($3::int, 0);
+	`
+	rows, err := database.Dbpool.Query(ctx, list, forumID, viewer, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ForumTopic, error) {
+		var unread bool
+		t, err := scanTopic(row, &unread)
+		t.Unread = unread
+		return t, err
+	})
+}
+
+// listTopicMessages returns the newest messages of a topic
+func listTopicMessages(ctx context.Context, topicID uuid.UUID, limit int) ([]Message, error) {
+	list := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	WHERE topic_id = $1 AND deleted_at IS NULL
+	ORDER BY created_at DESC
+	LIMIT $2;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, topicID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Message, error) {
+		return scanMessage(row)
+	})
+}
+
+// listAllTopicMessages returns every message of a topic, oldest first
+func listAllTopicMessages(ctx context.Context, topicID uuid.UUID) ([]Message, error) {
+	list := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	WHERE topic_id = $1 AND deleted_at IS NULL
+	ORDER BY created_at;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Message, error) {
+		return scanMessage(row)
+	})
+}
+
+func getTopicStarter(ctx context.Context, topicID uuid.UUID) (Message, error) {
+	get := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	WHERE topic_id = $1 AND deleted_at IS NULL
+	ORDER BY created_at
+	LIMIT 1;
+	`
+	return scanMessage(database.Dbpool.QueryRow(ctx, get, topicID))
+}
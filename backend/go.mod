@@ -6,13 +6,13 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/jackc/pgx/v5 v5.6.0
 	github.com/joho/godotenv v1.5.1
+	github.com/lesismal/nbio v1.5.9
 	github.com/redis/go-redis/v9 v9.5.3
 	golang.org/x/crypto v0.17.0
 )
 
 require (
 	github.com/lesismal/llib v1.1.13 // indirect
-	github.com/lesismal/nbio v1.5.9 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
 
@@ -22,7 +22,6 @@ require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jackc/puddle/v2 v2.2.1 // indirect
-	github.com/lib/pq v1.10.9
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/text v0.14.0
 )
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// what the imports table remembers
+const (
+	importArticle = 'A'
+	importMessage = 'M'
+	importUser    = 'U'
+)
+
+// images that stay linked to the old site, the importer downloads nothing
+var externalImage = regexp.MustCompile(`(?i)(?:<img[^>]+src=["']|!\[[^\]]*\]\()https?://`)
+
+// importReport counts what an import did, or would do on a dry run
+type importReport struct {
+	created  map[string]int
+	skipped  map[string]int
+	warnings []string
+}
+
+func (r *importReport) warn(format string, args ...any) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+func (r *importReport) print(source string, dryRun bool) {
+	if dryRun {
+		fmt.Printf("dry run of %s, nothing was saved\n", source)
+	} else {
+		fmt.Printf("imported %s\n", source)
+	}
+
+	for _, kind := range []string{"articles", "comments", "categories", "placeholder users"} {
+		fmt.Printf("  %-18s %d created, %d skipped\n", kind+":", r.created[kind], r.skipped[kind])
+	}
+
+	if len(r.warnings) > 0 {
+		fmt.Println("warnings:")
+		for _, w := range r.warnings {
+			fmt.Println("  " + w)
+		}
+	}
+}
+
+// importAuthor is an author as the source knows them
+type importAuthor struct {
+	Login string
+	Email string
+	Name  string
+}
+
+// importedArticle is an article from any source, Key is unique per source
+// item like "wxr:<guid>" or "md:<path>"
+type importedArticle struct {
+	Key         string
+	Title       string
+	Slug        string
+	Content     string
+	Author      importAuthor
+	Category    string
+	Tags        []string
+	Status      rune
+	PublishAt   *time.Time
+	PublishedAt *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// importedMessage is enough of a message to thread replies below it
+type importedMessage struct {
+	ID       uuid.UUID
+	ParentID uuid.NullUUID
+	RootID   uuid.UUID
+	Depth    int
+	Author   uuid.UUID
+}
+
+// importer runs a whole import in one transaction, a dry run rolls it back
+type importer struct {
+	tx         pgx.Tx
+	report     *importReport
+	author     string
+	users      map[string]DbUser
+	categories map[string]uuid.UUID
+	messages   map[uuid.UUID]importedMessage
+}
+
+// importContent is the import command:
+//
+//	go run . import [-dry-run] [-author username] <export.xml | folder>
+//
+// a file is read as a WordPress WXR export, a folder as markdown files with
+// front matter. Anything already imported is skipped so it is safe to run again.
+func importContent(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without saving")
+	author := flags.String("author", "", "existing username for content without an author")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [-dry-run] [-author username] <export.xml | folder>")
+	}
+	source := flags.Arg(0)
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	im := &importer{
+		tx:         tx,
+		report:     &importReport{created: map[string]int{}, skipped: map[string]int{}},
+		author:     *author,
+		users:      map[string]DbUser{},
+		categories: map[string]uuid.UUID{},
+		messages:   map[uuid.UUID]importedMessage{},
+	}
+
+	if im.author != "" {
+		_, err = im.existingUser(ctx, `username = $1`, im.author)
+		if err != nil {
+			return fmt.Errorf("author %q: %w", im.author, err)
+		}
+	}
+
+	if info.IsDir() {
+		err = im.importMarkdown(ctx, source)
+	} else {
+		err = im.importWXR(ctx, source)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !*dryRun {
+		err = tx.Commit(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	im.report.print(source, *dryRun)
+	return nil
+}
+
+// imported returns what a source key was imported as before
+func (im *importer) imported(ctx context.Context, kind rune, key string) (uuid.UUID, bool, error) {
+	var id uuid.UUID
+	err := im.tx.QueryRow(ctx, `SELECT target_id FROM imports WHERE kind = $1 AND source_key = $2`,
+		string(kind), key).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, false, nil
+	} else if err != nil {
+		return uuid.Nil, false, err
+	}
+	return id, true, nil
+}
+
+func (im *importer) remember(ctx context.Context, kind rune, key string, id uuid.UUID) error {
+	_, err := im.tx.Exec(ctx, `INSERT INTO imports (kind, source_key, target_id) VALUES ($1, $2, $3)
+                               ON CONFLICT (kind, source_key) DO UPDATE SET target_id = EXCLUDED.target_id`,
+		string(kind), key, id)
+	return err
+}
+
+// article creates a, or returns the article it was imported as before.
+// Deleting an imported article is respected, it is not created again and
+// uuid.Nil is returned so its comments are skipped too.
+func (im *importer) article(ctx context.Context, a importedArticle) (uuid.UUID, bool, error) {
+	id, done, err := im.imported(ctx, importArticle, a.Key)
+	if err != nil {
+		return uuid.Nil, false, err
+	} else if done {
+		im.report.skipped["articles"]++
+		var exists bool
+		err = im.tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM articles WHERE article_id = $1)`, id).Scan(&exists)
+		if err != nil || !exists {
+			return uuid.Nil, false, err
+		}
+		return id, false, nil
+	}
+
+	user, err := im.user(ctx, a.Author, true)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	var categoryID uuid.NullUUID
+	if a.Category != "" {
+		categoryID.UUID, err = im.category(ctx, a.Category)
+		if err != nil {
+			return uuid.Nil, false, err
+		}
+		categoryID.Valid = true
+	}
+
+	if strings.TrimSpace(a.Title) == "" {
+		a.Title = "Untitled"
+	} else if countCharacters(a.Title) > 256 {
+		im.report.warn("%s: title cut to 256 characters", a.Key)
+		a.Title = summarize(a.Title, 255)
+	}
+
+	base := a.Slug
+	if base == "" {
+		base = a.Title
+	}
+	slug, err := uniqueSlug(ctx, im.tx, slugArticle, slugify(base, 256), uuid.Nil, 256)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now()
+	}
+	if a.UpdatedAt.IsZero() {
+		a.UpdatedAt = a.CreatedAt
+	}
+
+	insertArticle := `INSERT INTO articles (author_identifier, author, category_id, title, slug, content,
+                          status, publish_at, published_at, created_at, updated_at)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+                      RETURNING article_id`
+	err = im.tx.QueryRow(ctx, insertArticle,
+		user.Identifier, user.Username, categoryID, a.Title, slug, a.Content,
+		string(a.Status), a.PublishAt, a.PublishedAt, a.CreatedAt, a.UpdatedAt).Scan(&id)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	insertOwner := `INSERT INTO article_authors (article_id, user_identifier, role, position, accepted)
+                    VALUES ($1, $2, 'O', 0, TRUE)`
+	_, err = im.tx.Exec(ctx, insertOwner, id, user.Identifier)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	err = addArticleTags(ctx, im.tx, id, im.tagNames(a.Key, a.Tags))
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	if n := len(externalImage.FindAllStringIndex(a.Content, -1)); n > 0 {
+		im.report.warn("%s: %d images still point to the old site", a.Key, n)
+	}
+
+	im.report.created["articles"]++
+	return id, true, im.remember(ctx, importArticle, a.Key, id)
+}
+
+// tagNames cleans and dedupes tags the same way the tag form does
+func (im *importer) tagNames(key string, tags []string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, n := range tags {
+		n = cleanTagName(n)
+		if n == "" || seen[normalizeTag(n)] {
+			continue
+		}
+		if err := validateTagName(n); err != nil {
+			im.report.warn("%s: tag %q skipped, %v", key, n, err)
+			continue
+		}
+		seen[normalizeTag(n)] = true
+		names = append(names, n)
+	}
+
+	if len(names) > maxArticleTags {
+		im.report.warn("%s: only the first %d of %d tags kept", key, maxArticleTags, len(names))
+		names = names[:maxArticleTags]
+	}
+	return names
+}
+
+func (im *importer) category(ctx context.Context, name string) (uuid.UUID, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if countCharacters(name) > 64 {
+		name = string([]rune(name)[:64])
+	}
+	if id, ok := im.categories[name]; ok {
+		return id, nil
+	}
+
+	var id uuid.UUID
+	var inserted bool
+	upsert := `INSERT INTO categories (category_name) VALUES ($1)
+               ON CONFLICT (category_name) DO UPDATE SET category_name = EXCLUDED.category_name
+               RETURNING category_id, xmax = 0`
+	err := im.tx.QueryRow(ctx, upsert, name).Scan(&id, &inserted)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if inserted {
+		im.report.created["categories"]++
+	}
+	im.categories[name] = id
+	return id, nil
+}
+
+// message saves one comment below parent, replies deeper than
+// maxMessageDepth allows are attached to the deepest ancestor that fits
+func (im *importer) message(ctx context.Context, key string, articleID uuid.UUID, author DbUser,
+	content string, createdAt time.Time, parent uuid.NullUUID) (importedMessage, error) {
+	m := importedMessage{Author: author.Identifier}
+	var replyTo uuid.NullUUID
+
+	if parent.Valid {
+		p, err := im.loadMessage(ctx, parent.UUID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			im.report.warn("%s: reply to a deleted comment, imported as top level", key)
+			return im.message(ctx, key, articleID, author, content, createdAt, uuid.NullUUID{})
+		} else if err != nil {
+			return importedMessage{}, err
+		}
+		for p.Depth+1 >= maxMessageDepth && p.ParentID.Valid {
+			p, err = im.loadMessage(ctx, p.ParentID.UUID)
+			if err != nil {
+				return importedMessage{}, err
+			}
+		}
+		m.ParentID = uuid.NullUUID{UUID: p.ID, Valid: true}
+		m.RootID = p.RootID
+		m.Depth = p.Depth + 1
+		replyTo = uuid.NullUUID{UUID: p.Author, Valid: true}
+	}
+
+	rootID := uuid.NullUUID{UUID: m.RootID, Valid: m.ParentID.Valid}
+	insertMsg := `INSERT INTO messages (author, author_identifier, reply_to_identifier, parent_id, root_id, depth,
+                      content, created_at, in_table, in_table_id)
+                  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'A', $9)
+                  RETURNING message_id`
+	err := im.tx.QueryRow(ctx, insertMsg, author.Username, author.Identifier, replyTo, m.ParentID, rootID,
+		m.Depth, content, createdAt, articleID).Scan(&m.ID)
+	if err != nil {
+		return importedMessage{}, err
+	}
+	if !m.ParentID.Valid {
+		m.RootID = m.ID
+	}
+
+	im.messages[m.ID] = m
+	im.report.created["comments"]++
+	return m, im.remember(ctx, importMessage, key, m.ID)
+}
+
+func (im *importer) loadMessage(ctx context.Context, id uuid.UUID) (importedMessage, error) {
+	if m, ok := im.messages[id]; ok {
+		return m, nil
+	}
+
+	m := importedMessage{ID: id}
+	get := `SELECT parent_id, COALESCE(root_id, message_id), depth, author_identifier
+            FROM messages WHERE message_id = $1`
+	err := im.tx.QueryRow(ctx, get, id).Scan(&m.ParentID, &m.RootID, &m.Depth, &m.Author)
+	if err != nil {
+		return importedMessage{}, err
+	}
+	im.messages[id] = m
+	return m, nil
+}
+
+// user maps a source author to an existing user by email, or by username
+// when matchUsername is set, and creates a placeholder otherwise.
+// Placeholders get an unreachable email and no password so nobody can
+// log in as them.
+func (im *importer) user(ctx context.Context, a importAuthor, matchUsername bool) (DbUser, error) {
+	a.Email = strings.ToLower(strings.TrimSpace(a.Email))
+	if a.Login == "" && a.Email == "" && a.Name == "" {
+		if im.author != "" {
+			return im.existingUser(ctx, `username = $1`, im.author)
+		}
+		a.Login = "imported"
+	}
+
+	key := "email:" + a.Email
+	if a.Email == "" {
+		key = "name:" + strings.ToLower(a.Login+"|"+a.Name)
+	}
+	if u, ok := im.users[key]; ok {
+		return u, nil
+	}
+
+	u, err := im.matchUser(ctx, key, a, matchUsername)
+	if err != nil {
+		return DbUser{}, err
+	}
+	im.users[key] = u
+	return u, nil
+}
+
+func (im *importer) matchUser(ctx context.Context, key string, a importAuthor, matchUsername bool) (DbUser, error) {
+	id, done, err := im.imported(ctx, importUser, key)
+	if err != nil {
+		return DbUser{}, err
+	}
+	if done {
+		u, err := im.existingUser(ctx, `user_identifier = $1`, id)
+		if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+			im.report.skipped["placeholder users"]++
+			return u, err
+		}
+	}
+
+	if a.Email != "" {
+		u, err := im.existingUser(ctx, `lower(email) = $1`, a.Email)
+		if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+			return u, err
+		}
+	}
+
+	if matchUsername && a.Login != "" {
+		u, err := im.existingUser(ctx, `username = $1`, a.Login)
+		if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+			return u, err
+		}
+	}
+
+	name := a.Name
+	if name == "" {
+		name = a.Login
+	}
+	base := a.Login
+	if base == "" {
+		base = name
+	}
+
+	username, err := im.freeUsername(ctx, importUsername(base))
+	if err != nil {
+		return DbUser{}, err
+	}
+
+	fullname := strings.Join(strings.Fields(name), " ")
+	if fullname == "" {
+		fullname = username
+	} else if countCharacters(fullname) > 64 {
+		fullname = string([]rune(fullname)[:64])
+	}
+
+	u := DbUser{Username: username, Fullname: fullname, Email: username + "@import.invalid"}
+	insertUser := `INSERT INTO users (username, fullname, email, password_hash)
+                   VALUES ($1, $2, $3, '')
+                   RETURNING user_identifier`
+	err = im.tx.QueryRow(ctx, insertUser, u.Username, u.Fullname, u.Email).Scan(&u.Identifier)
+	if err != nil {
+		return DbUser{}, err
+	}
+
+	im.report.created["placeholder users"]++
+	im.report.warn("placeholder user %s created for %s", u.Username, strings.TrimPrefix(key, "name:"))
+	return u, im.remember(ctx, importUser, key, u.Identifier)
+}
+
+func (im *importer) existingUser(ctx context.Context, where string, arg any) (DbUser, error) {
+	var u DbUser
+	get := `SELECT user_identifier, username, fullname, email FROM users WHERE ` + where
+	err := im.tx.QueryRow(ctx, get, arg).Scan(&u.Identifier, &u.Username, &u.Fullname, &u.Email)
+	return u, err
+}
+
+// freeUsername appends -2, -3, ... to base until no user has it
+func (im *importer) freeUsername(ctx context.Context, base string) (string, error) {
+	username := base
+	for n := 2; ; n++ {
+		var taken bool
+		err := im.tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)`,
+			username).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return username, nil
+		}
+
+		suffix := fmt.Sprintf("-%d", n)
+		runes := []rune(base)
+		if len(runes) > 64-len(suffix) {
+			runes = runes[:64-len(suffix)]
+		}
+		username = string(runes) + suffix
+	}
+}
+
+// importUsername turns a login or display name into a valid username
+func importUsername(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(s)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-':
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '.':
+			b.WriteRune('_')
+		}
+	}
+
+	username := strings.Trim(b.String(), "_")
+	if runes := []rune(username); len(runes) > 48 {
+		username = string(runes[:48])
+	}
+	if username == "" {
+		username = "imported"
+	}
+	return username
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// front matter dates, the ones without a zone are server local time
+var frontMatterTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// importMarkdown imports every .md file below root, the path relative to
+// root identifies the file on later runs
+func (im *importer) importMarkdown(ctx context.Context, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".md" && ext != ".markdown" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		a, err := markdownArticle(rel, string(src))
+		if err != nil {
+			im.report.warn("%s: %v, skipped", rel, err)
+			return nil
+		}
+
+		_, _, err = im.article(ctx, a)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		return nil
+	})
+}
+
+func markdownArticle(rel, src string) (importedArticle, error) {
+	meta, body, err := splitFrontMatter(src)
+	if err != nil {
+		return importedArticle{}, err
+	}
+
+	a := importedArticle{
+		Key:     "md:" + rel,
+		Title:   meta.value("title"),
+		Slug:    meta.value("slug"),
+		Content: body,
+		Author:  importAuthor{Login: meta.value("author", "authors"), Email: meta.value("email")},
+		Tags:    append(meta["tags"], meta["keywords"]...),
+		Status:  articlePublished,
+	}
+	a.Author.Name = a.Author.Login
+
+	// the first heading or the file name stand in for a missing title
+	if a.Title == "" {
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, "# ") {
+				a.Title = strings.TrimSpace(line[2:])
+				break
+			}
+		}
+	}
+	if a.Title == "" {
+		a.Title = strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel))
+	}
+
+	if categories := append(meta["category"], meta["categories"]...); len(categories) > 0 {
+		a.Category = categories[0]
+	}
+
+	if v := meta.value("date"); v != "" {
+		a.CreatedAt, err = parseFrontMatterTime(v)
+		if err != nil {
+			return importedArticle{}, err
+		}
+	}
+	if v := meta.value("updated", "lastmod"); v != "" {
+		a.UpdatedAt, err = parseFrontMatterTime(v)
+		if err != nil {
+			return importedArticle{}, err
+		}
+	}
+
+	draft, _ := strconv.ParseBool(meta.value("draft"))
+	if draft || meta.value("published") == "false" || meta.value("status") == "draft" {
+		a.Status = articleDraft
+	} else if a.CreatedAt.After(time.Now()) {
+		// a future date is scheduled like a future WordPress post
+		a.Status = articleDraft
+		a.PublishAt = &a.CreatedAt
+	} else if !a.CreatedAt.IsZero() {
+		a.PublishedAt = &a.CreatedAt
+	}
+	return a, nil
+}
+
+func parseFrontMatterTime(value string) (time.Time, error) {
+	for _, layout := range frontMatterTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t.Local(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date %q not understood", value)
+}
+
+// frontMatter holds every key as a list, scalars have one value
+type frontMatter map[string][]string
+
+// value returns the first value of the first key that is set
+func (m frontMatter) value(keys ...string) string {
+	for _, k := range keys {
+		if len(m[k]) > 0 {
+			return m[k][0]
+		}
+	}
+	return ""
+}
+
+// splitFrontMatter cuts the "---" fenced front matter off src. Files
+// without front matter are all body.
+func splitFrontMatter(src string) (frontMatter, string, error) {
+	src = strings.TrimPrefix(strings.ReplaceAll(src, "\r\n", "\n"), "\ufeff")
+	if !strings.HasPrefix(src, "---\n") {
+		return frontMatter{}, src, nil
+	}
+
+	lines := strings.Split(src, "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] == "---" || lines[i] == "..." {
+			meta, err := parseFrontMatter(lines[1:i])
+			body := strings.TrimLeft(strings.Join(lines[i+1:], "\n"), "\n")
+			return meta, body, err
+		}
+	}
+	return nil, "", fmt.Errorf("front matter is not closed with ---")
+}
+
+// parseFrontMatter reads the part of yaml front matter uses in practice,
+// "key: value", "key: [a, b]", "- item" lists below a key and | or >
+// blocks. Nested maps are skipped.
+func parseFrontMatter(lines []string) (frontMatter, error) {
+	meta := frontMatter{}
+	key := ""
+	block := ""
+	var blockLines []string
+
+	endBlock := func() {
+		if block == "" {
+			return
+		}
+		sep := "\n"
+		if block == ">" {
+			sep = " "
+		}
+		meta[key] = []string{strings.TrimSpace(strings.Join(blockLines, sep))}
+		block, blockLines = "", nil
+	}
+
+	for n, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		indented := line != "" && (line[0] == ' ' || line[0] == '\t')
+
+		if block != "" && (indented || trimmed == "") {
+			blockLines = append(blockLines, trimmed)
+			continue
+		}
+		endBlock()
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if indented || strings.HasPrefix(trimmed, "- ") {
+			if key != "" && strings.HasPrefix(trimmed, "- ") {
+				meta[key] = append(meta[key], yamlScalar(trimmed[2:]))
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d should be key: value", n+2)
+		}
+		key = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+
+		switch {
+		case value == "":
+			meta[key] = nil
+		case value == "|" || value == ">" || value == "|-" || value == ">-":
+			block = value[:1]
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			meta[key] = nil
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = yamlScalar(item); item != "" {
+					meta[key] = append(meta[key], item)
+				}
+			}
+		default:
+			meta[key] = []string{yamlScalar(value)}
+		}
+	}
+	endBlock()
+
+	return meta, nil
+}
+
+// yamlScalar unquotes a value, unquoted values lose a trailing # comment
+func yamlScalar(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			if s, err := strconv.Unquote(value); err == nil {
+				return s
+			}
+			return value[1 : len(value)-1]
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
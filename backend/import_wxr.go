@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// wxrExport is the part of a WordPress export the importer reads, tags
+// without a namespace match wp: elements of every WXR version
+type wxrExport struct {
+	Authors []wxrAuthor `xml:"channel>author"`
+	Items   []wxrItem   `xml:"channel>item"`
+}
+
+type wxrAuthor struct {
+	Login       string `xml:"author_login"`
+	Email       string `xml:"author_email"`
+	DisplayName string `xml:"author_display_name"`
+}
+
+type wxrItem struct {
+	Title       string        `xml:"title"`
+	Guid        string        `xml:"guid"`
+	Creator     string        `xml:"creator"`
+	Content     string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID      string        `xml:"post_id"`
+	PostName    string        `xml:"post_name"`
+	PostType    string        `xml:"post_type"`
+	Status      string        `xml:"status"`
+	Date        string        `xml:"post_date"`
+	DateGmt     string        `xml:"post_date_gmt"`
+	ModifiedGmt string        `xml:"post_modified_gmt"`
+	Categories  []wxrCategory `xml:"category"`
+	Comments    []wxrComment  `xml:"comment"`
+}
+
+type wxrCategory struct {
+	Domain string `xml:"domain,attr"`
+	Name   string `xml:",chardata"`
+}
+
+type wxrComment struct {
+	ID          string `xml:"comment_id"`
+	Author      string `xml:"comment_author"`
+	AuthorEmail string `xml:"comment_author_email"`
+	DateGmt     string `xml:"comment_date_gmt"`
+	Content     string `xml:"comment_content"`
+	Approved    string `xml:"comment_approved"`
+	Type        string `xml:"comment_type"`
+	Parent      string `xml:"comment_parent"`
+}
+
+const wxrTimeLayout = "2006-01-02 15:04:05"
+
+// wxrTime reads a WXR date, drafts carry "0000-00-00 00:00:00"
+func wxrTime(value string, loc *time.Location) time.Time {
+	t, err := time.ParseInLocation(wxrTimeLayout, strings.TrimSpace(value), loc)
+	if err != nil || t.Year() < 1970 {
+		return time.Time{}
+	}
+	return t.Local()
+}
+
+// importWXR imports posts and pages with their categories, tags and
+// approved comments. Attachments, menus and revisions are left out.
+func (im *importer) importWXR(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var export wxrExport
+	dec := xml.NewDecoder(f)
+	dec.Entity = xml.HTMLEntity
+	err = dec.Decode(&export)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	authors := make(map[string]importAuthor, len(export.Authors))
+	for _, a := range export.Authors {
+		authors[a.Login] = importAuthor{Login: a.Login, Email: a.Email, Name: a.DisplayName}
+	}
+
+	for _, item := range export.Items {
+		if item.PostType != "post" && item.PostType != "page" {
+			continue
+		}
+
+		a, ok := wxrArticle(item, authors)
+		if !ok {
+			im.report.warn("post %s: status %q skipped", item.PostID, item.Status)
+			continue
+		}
+
+		articleID, _, err := im.article(ctx, a)
+		if err != nil {
+			return fmt.Errorf("post %s: %w", item.PostID, err)
+		}
+		if articleID == uuid.Nil {
+			continue
+		}
+
+		err = im.wxrComments(ctx, a.Key, articleID, item.Comments)
+		if err != nil {
+			return fmt.Errorf("comments of post %s: %w", item.PostID, err)
+		}
+	}
+	return nil
+}
+
+func wxrArticle(item wxrItem, authors map[string]importAuthor) (importedArticle, bool) {
+	a := importedArticle{
+		Key:     "wxr:" + item.Guid,
+		Title:   item.Title,
+		Slug:    item.PostName,
+		Content: item.Content,
+		Author:  authors[item.Creator],
+	}
+	if strings.TrimSpace(item.Guid) == "" {
+		a.Key = "wxr:post:" + item.PostID
+	}
+	if a.Author.Login == "" {
+		a.Author.Login = item.Creator
+	}
+
+	for _, c := range item.Categories {
+		switch c.Domain {
+		case "category":
+			// articles have one category, the first one wins
+			if a.Category == "" && c.Name != "Uncategorized" {
+				a.Category = c.Name
+			}
+		case "post_tag":
+			a.Tags = append(a.Tags, c.Name)
+		}
+	}
+
+	date := wxrTime(item.DateGmt, time.UTC)
+	if date.IsZero() {
+		date = wxrTime(item.Date, time.Local)
+	}
+	a.CreatedAt = date
+	a.UpdatedAt = wxrTime(item.ModifiedGmt, time.UTC)
+
+	switch item.Status {
+	case "publish":
+		a.Status = articlePublished
+		if !date.IsZero() {
+			a.PublishedAt = &date
+		}
+	case "future":
+		// the scheduler publishes it on the original date
+		a.Status = articleDraft
+		if !date.IsZero() {
+			a.PublishAt = &date
+		}
+	case "draft", "pending", "private":
+		a.Status = articleDraft
+	default:
+		return importedArticle{}, false
+	}
+	return a, true
+}
+
+// wxrComments imports approved comments oldest first so every parent is
+// saved before its replies
+func (im *importer) wxrComments(ctx context.Context, articleKey string, articleID uuid.UUID, comments []wxrComment) error {
+	sort.SliceStable(comments, func(i, j int) bool {
+		a, _ := strconv.Atoi(comments[i].ID)
+		b, _ := strconv.Atoi(comments[j].ID)
+		return a < b
+	})
+
+	saved := map[string]uuid.UUID{}
+	for _, c := range comments {
+		if c.Approved != "1" || (c.Type != "" && c.Type != "comment") {
+			continue
+		}
+
+		key := articleKey + "#comment-" + c.ID
+		id, done, err := im.imported(ctx, importMessage, key)
+		if err != nil {
+			return err
+		}
+		if done {
+			im.report.skipped["comments"]++
+			saved[c.ID] = id
+			continue
+		}
+
+		content := strings.TrimSpace(c.Content)
+		if content == "" {
+			continue
+		} else if countCharacters(content) > maxCommentLength {
+			im.report.warn("%s: longer than %d characters, skipped", key, maxCommentLength)
+			continue
+		}
+
+		var parent uuid.NullUUID
+		if c.Parent != "" && c.Parent != "0" {
+			parent.UUID, parent.Valid = saved[c.Parent]
+			if !parent.Valid {
+				im.report.warn("%s: reply to a missing comment, imported as top level", key)
+			}
+		}
+
+		author, err := im.user(ctx, importAuthor{Email: c.AuthorEmail, Name: c.Author}, false)
+		if err != nil {
+			return err
+		}
+
+		createdAt := wxrTime(c.DateGmt, time.UTC)
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+
+		m, err := im.message(ctx, key, articleID, author, content, createdAt, parent)
+		if err != nil {
+			return err
+		}
+		saved[c.ID] = m.ID
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"mime"
 	"net/smtp"
+	"os"
+	"strings"
+	"unicode"
 )
 
 type MailTo struct {
@@ -26,3 +31,35 @@ func (m MailTo) sendMail() error {
 
 	return nil
 }
+
+// mailUser sends a plain text mail with the smtp settings from .env. The
+// subject often carries names users chose, line breaks are dropped and the
+// rest is encoded so it can't add headers.
+func mailUser(email, subject, body string) error {
+	subject = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, subject)
+
+	message := []byte(fmt.Sprintf("To: %v\r\n", email) +
+		fmt.Sprintf("From: %v\r\n", os.Getenv("SMTP_EMAIL")) +
+		fmt.Sprintf("Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject)) +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		body + "\r\n")
+
+	sendMailTo := MailTo{
+		from:        os.Getenv("SMTP_EMAIL"),
+		username:    os.Getenv("SMTP_USERNAME"),
+		password:    os.Getenv("SMTP_PASSWORD"),
+		sendTo:      []string{email},
+		smtpHost:    os.Getenv("SMTP_HOST"),
+		smtpPort:    os.Getenv("SMTP_PORT"),
+		mailMessage: message,
+	}
+
+	return sendMailTo.sendMail()
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
 	"github.com/joho/godotenv"
 	"github.com/sameer-gits/CMS/database"
+	"github.com/sameer-gits/CMS/storage"
 )
 
 func init() {
@@ -31,5 +33,36 @@ func main() {
 		log.Fatalf("Redis initialization failed: %v", err)
 	}
 
+	err = storage.MediaInit()
+	if err != nil {
+		log.Fatalf("Media storage initialization failed: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		command(os.Args[1], os.Args[2:])
+		return
+	}
+
 	routes()
 }
+
+// command runs one off jobs like "go run . migrate-media" instead of the server
+func command(name string, args []string) {
+	ctx := context.Background()
+
+	var err error
+	switch name {
+	case "migrate-media":
+		err = migrateMedia(ctx)
+	case "import":
+		err = importContent(ctx, args)
+	case "export":
+		err = exportSite(ctx, args)
+	default:
+		log.Fatalf("unknown command %q", name)
+	}
+
+	if err != nil {
+		log.Fatalf("%s failed: %v", name, err)
+	}
+}
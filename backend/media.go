@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+	"github.com/sameer-gits/CMS/storage"
+)
+
+const maxUploadSize = 10 << 20
+
+// images with more pixels than this are not decoded for resizing
+const maxResizePixels = 40_000_000
+
+var allowedMediaTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+type Media struct {
+	ID                   uuid.UUID `json:"media_id"`
+	Checksum             string    `json:"checksum"`
+	StorageKey           string    `json:"-"`
+	ContentType          string    `json:"content_type"`
+	Size                 int64     `json:"size"`
+	Filename             string    `json:"filename"`
+	UploadedByIdentifier uuid.UUID `json:"uploaded_by_identifier"`
+	CreatedAt            time.Time `json:"created_at"`
+	URL                  string    `json:"url"`
+}
+
+// embeds inserted by the picker, ![alt](/media/id) for images and [name](/media/id) for files
+var mediaEmbed = regexp.MustCompile(`(!?)\[([^\]]*)\]\(/media/([0-9a-fA-F-]{36})\)`)
+
+// embedMedia escapes content and turns picker embeds into html, the tags it
+// writes itself are the only html that comes out
+func embedMedia(content string) string {
+	content = html.EscapeString(content)
+	return mediaEmbed.ReplaceAllStringFunc(content, func(embed string) string {
+		m := mediaEmbed.FindStringSubmatch(embed)
+		id, err := uuid.Parse(m[3])
+		if err != nil {
+			return embed
+		}
+		// escaped with the rest of the content
+		alt := m[2]
+		if m[1] == "!" {
+			return fmt.Sprintf(`<img src="%s" alt="%s" loading="lazy" />`, mediaURL(id), alt)
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, mediaURL(id), alt)
+	})
+}
+
+func mediaURL(id uuid.UUID) string {
+	return "/media/" + id.String()
+}
+
+func uploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		renderJson(w, unauthorized, map[string]string{"error": "please login to upload"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		renderJson(w, badCode, map[string]string{"error": "please provide a file up to 10MB"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadSize+1))
+	if err != nil {
+		renderJson(w, badCode, map[string]string{"error": "error reading file, try again"})
+		return
+	}
+
+	media, err := storeMedia(ctx, data, header.Filename, user.Identifier)
+	if err != nil {
+		renderJson(w, badCode, map[string]string{"error": err.Error()})
+		return
+	}
+
+	renderJson(w, statusOK, media)
+}
+
+// listMediaHandler feeds the picker with the user's own uploads
+func listMediaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		renderJson(w, unauthorized, map[string]string{"error": "please login to see your media"})
+		return
+	}
+
+	list := `SELECT m.media_id, m.checksum, m.storage_key, m.content_type, m.size, um.filename,
+	                m.uploaded_by_identifier, um.created_at
+	         FROM user_media um JOIN media m ON m.media_id = um.media_id
+	         WHERE um.user_identifier = $1
+	         ORDER BY um.created_at DESC
+	         LIMIT 100`
+	rows, err := database.Dbpool.Query(ctx, list, user.Identifier)
+	if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error getting media"})
+		return
+	}
+
+	media, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Media, error) {
+		return scanMedia(row)
+	})
+	if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error getting media"})
+		return
+	}
+
+	if media == nil {
+		media = []Media{}
+	}
+	renderJson(w, statusOK, media)
+}
+
+func serveMediaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	media, err := getMedia(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	// media never changes for an id, the checksum is a perfect etag
+	etag := `"` + media.Checksum + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := storage.Media.Get(ctx, media.StorageKey)
+	if err != nil {
+		log.Println("error reading media", media.ID, err)
+		http.Error(w, "error reading media", serverCode)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", media.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprint(media.Size))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": media.Filename}))
+	io.Copy(w, body)
+}
+
+// storeMedia saves data once per checksum, uploading the same file again
+// returns the existing media row. Either way the file is added to the
+// uploader's library under filename.
+func storeMedia(ctx context.Context, data []byte, filename string, uploader uuid.UUID) (Media, error) {
+	if len(data) == 0 {
+		return Media{}, errors.New("file is empty")
+	}
+	if len(data) > maxUploadSize {
+		return Media{}, errors.New("file should be less than 10MB")
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedMediaTypes[contentType]
+	if !ok {
+		return Media{}, errors.New("only png, jpeg, gif, webp images and pdf files are allowed")
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	filename = strings.TrimSpace(filepath.Base(filename))
+	if filename == "" || filename == "." || countCharacters(filename) > 256 {
+		filename = checksum[:12] + ext
+	}
+
+	existing, err := getMediaByChecksum(ctx, checksum)
+	if err == nil {
+		return addUserMedia(ctx, uploader, existing, filename)
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return Media{}, err
+	}
+
+	key := checksum[:2] + "/" + checksum[2:4] + "/" + checksum + ext
+	err = storage.Media.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+	if err != nil {
+		log.Println("error storing media:", err)
+		return Media{}, errors.New("error storing file, try again")
+	}
+
+	// a concurrent upload of the same file wins the race, return its row
+	insertMedia := `INSERT INTO media (checksum, storage_key, content_type, size, filename, uploaded_by_identifier)
+                    VALUES ($1, $2, $3, $4, $5, $6)
+                    ON CONFLICT (checksum) DO UPDATE SET checksum = EXCLUDED.checksum
+                    RETURNING ` + mediaColumns
+	media, err := scanMedia(database.Dbpool.QueryRow(ctx, insertMedia,
+		checksum, key, contentType, len(data), filename, uploader))
+	if err != nil {
+		return Media{}, err
+	}
+	return addUserMedia(ctx, uploader, media, filename)
+}
+
+// addUserMedia puts media in the library of user, uploading a file that is
+// already there keeps its first name
+func addUserMedia(ctx context.Context, user uuid.UUID, media Media, filename string) (Media, error) {
+	insert := `INSERT INTO user_media (user_identifier, media_id, filename)
+	           VALUES ($1, $2, $3)
+	           ON CONFLICT (user_identifier, media_id) DO UPDATE SET filename = user_media.filename
+	           RETURNING filename, created_at`
+	err := database.Dbpool.QueryRow(ctx, insert, user, media.ID, filename).Scan(&media.Filename, &media.CreatedAt)
+	if err != nil {
+		return Media{}, err
+	}
+	return media, nil
+}
+
+// resizeImage scales a png, jpeg or gif down with nearest neighbour sampling
+// so neither side is longer than size, smaller images come back untouched.
+// Jpegs stay jpegs, everything else is encoded as png.
+func resizeImage(data []byte, size int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("only png, jpeg and gif images are allowed")
+	}
+	if config.Width <= size && config.Height <= size {
+		return data, nil
+	}
+	if config.Width*config.Height > maxResizePixels {
+		return nil, errors.New("image is too large")
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("error reading image, try another one")
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := size, size
+	if w > h {
+		dh = max(h*size/w, 1)
+	} else {
+		dw = max(w*size/h, 1)
+	}
+
+	// every target pixel takes the source pixel its top left corner lands on
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy := bounds.Min.Y + y*h/dh
+		for x := 0; x < dw; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*w/dw, sy))
+		}
+	}
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&out, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+const mediaColumns = `media_id, checksum, storage_key, content_type, size, filename, uploaded_by_identifier, created_at`
+
+func scanMedia(row pgx.Row) (Media, error) {
+	var m Media
+	err := row.Scan(&m.ID, &m.Checksum, &m.StorageKey, &m.ContentType, &m.Size, &m.Filename,
+		&m.UploadedByIdentifier, &m.CreatedAt)
+	if err != nil {
+		return Media{}, err
+	}
+	m.URL = mediaURL(m.ID)
+	return m, nil
+}
+
+func getMedia(ctx context.Context, Id uuid.UUID) (Media, error) {
+	get := `SELECT ` + mediaColumns + ` FROM media WHERE media_id = $1`
+	return scanMedia(database.Dbpool.QueryRow(ctx, get, Id))
+}
+
+func getMediaByChecksum(ctx context.Context, checksum string) (Media, error) {
+	get := `SELECT ` + mediaColumns + ` FROM media WHERE checksum = $1`
+	return scanMedia(database.Dbpool.QueryRow(ctx, get, checksum))
+}
+
+// migrateMedia moves the old inline BYTEA images of users and forums into
+// the media library, run it once with "go run . migrate-media"
+func migrateMedia(ctx context.Context) error {
+	moved, err := migrateMediaColumn(ctx, "users", "user_identifier", "user_identifier", "profile_image", "profile_media_id")
+	if err != nil {
+		return fmt.Errorf("migrating profile images: %w", err)
+	}
+	log.Printf("moved %d profile images", moved)
+
+	moved, err = migrateMediaColumn(ctx, "forums", "forum_id", "created_by_identifier", "forum_image", "forum_media_id")
+	if err != nil {
+		return fmt.Errorf("migrating forum images: %w", err)
+	}
+	log.Printf("moved %d forum images", moved)
+
+	return nil
+}
+
+func migrateMediaColumn(ctx context.Context, table, idColumn, ownerColumn, oldColumn, newColumn string) (int, error) {
+	moved := 0
+	for {
+		var id, owner uuid.UUID
+		var data []byte
+
+		// one row at a time keeps memory flat for big tables
+		next := fmt.Sprintf(`SELECT %s, %s, %s FROM %s WHERE %s IS NOT NULL LIMIT 1`,
+			idColumn, ownerColumn, oldColumn, table, oldColumn)
+		err := database.Dbpool.QueryRow(ctx, next).Scan(&id, &owner, &data)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return moved, nil
+		} else if err != nil {
+			return moved, err
+		}
+
+		var mediaID uuid.NullUUID
+		media, err := storeMedia(ctx, data, "", owner)
+		if err != nil {
+			// unsupported or broken images are dropped instead of blocking the migration
+			log.Printf("skipping %s %s: %v", table, id, err)
+		} else {
+			mediaID = uuid.NullUUID{UUID: media.ID, Valid: true}
+		}
+
+		update := fmt.Sprintf(`UPDATE %s SET %s = $1, %s = NULL WHERE %s = $2`, table, newColumn, oldColumn, idColumn)
+		_, err = database.Dbpool.Exec(ctx, update, mediaID, id)
+		if err != nil {
+			return moved, err
+		}
+		if mediaID.Valid {
+			moved++
+		}
+	}
+}
+
+func (forum Forum) ImageURL() string {
+	if !forum.ForumMediaID.Valid {
+		return ""
+	}
+	return mediaURL(forum.ForumMediaID.UUID)
+}
+
+func (user DbUser) ProfileImageURL() string {
+	if !user.ProfileMedia.Valid {
+		return ""
+	}
+	return mediaURL(user.ProfileMedia.UUID)
+}
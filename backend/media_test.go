@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestEmbedMedia(t *testing.T) {
+	const id = "0b4e7a0e-5bb8-4f3a-9d2c-1f6f1c2d3e4f"
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"just text", "just text"},
+		{"![cat](/media/" + id + ")", `<img src="/media/` + id + `" alt="cat" loading="lazy" />`},
+		{"see [report.pdf](/media/" + id + ")", `see <a href="/media/` + id + `">report.pdf</a>`},
+		{"<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{`![" onerror="alert(1)](/media/` + id + ")", `<img src="/media/` + id + `" alt="&#34; onerror=&#34;alert(1)" loading="lazy" />`},
+		{"[<b>x</b>](/media/" + id + ")", `<a href="/media/` + id + `">&lt;b&gt;x&lt;/b&gt;</a>`},
+		{"[link](/media/not-a-media-id)", "[link](/media/not-a-media-id)"},
+		{"[link](https://example.com)", "[link](https://example.com)"},
+	}
+	for _, tt := range tests {
+		if got := embedMedia(tt.content); got != tt.want {
+			t.Errorf("embedMedia(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
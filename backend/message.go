@@ -4,80 +4,117 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/sameer-gits/CMS/database"
 )
 
+// a top level message is depth 0, replies nest up to maxMessageDepth-1 levels
+const maxMessageDepth = 5
+
+var (
+	errParentNotFound = errors.New("message replying to does not exists")
+	errTooDeep        = fmt.Errorf("replies can only be nested %d levels deep", maxMessageDepth-1)
+)
+
 type Message struct {
-	AuthorUsername    string    `json:"author_username"`
-	AuthorIdentifier  uuid.UUID `json:"author_identifier"`
-	MessageId         uuid.UUID `json:"message_id"`
-	ReplyToIdentifier uuid.UUID `json:"reply_to_identifier"`
-	Content           string    `json:"content"`
-	CreatedAt         time.Time `json:"created_at"`
-	InTable           rune      `json:"in_table"`
-	InTableId         uuid.UUID `json:"in_table_id"`
+	AuthorUsername    string        `json:"author_username"`
+	AuthorIdentifier  uuid.UUID     `json:"author_identifier"`
+	MessageId         uuid.UUID     `json:"message_id"`
+	ReplyToIdentifier uuid.UUID     `json:"reply_to_identifier"`
+	ParentId          uuid.NullUUID `json:"parent_id"`
+	Depth             int           `json:"depth"`
+	Content           string        `json:"content"`
+	CreatedAt         time.Time     `json:"created_at"`
+	InTable           rune          `json:"in_table"`
+	InTableId         uuid.UUID     `json:"in_table_id"`
+	TopicId           uuid.NullUUID `json:"topic_id"`
+	ReplyCount        int           `json:"reply_count"`
+	Replies           []Message     `json:"replies,omitempty"`
+	// a trashed comment kept in the tree as a placeholder for its replies
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// MessageEvent is sent to websocket rooms when a message is posted
+type MessageEvent struct {
+	Event   string  `json:"event"`
+	Message Message `json:"message"`
+}
+
+const messageColumns = `author, author_identifier, message_id,
+	COALESCE(reply_to_identifier, '00000000-0000-0000-0000-000000000000'),
+	parent_id, depth, content, created_at, in_table, in_table_id, topic_id`
+
+func scanMessage(row pgx.Row, extra ...any) (Message, error) {
+	var m Message
+	var table string
+	dest := append([]any{&m.AuthorUsername, &m.AuthorIdentifier, &m.MessageId, &m.ReplyToIdentifier,
+		&m.ParentId, &m.Depth, &m.Content, &m.CreatedAt, &table, &m.InTableId, &m.TopicId}, extra...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return Message{}, err
+	}
+	m.InTable = firstRune(table)
+	return m, nil
+}
+
+func (m Message) CanReply() bool {
+	return m.Depth < maxMessageDepth-1
 }
 
 func insertMessageHandler(w http.ResponseWriter, r *http.Request) {
 	var errs []error
 	var msg Message
 	var inTableRune rune
-	var replyToIdentifierUUID uuid.UUID
+	var parentId uuid.NullUUID
 
-	messageContent := r.FormValue("content")
+	messageContent := strings.TrimSpace(r.FormValue("content"))
 	inTable := r.FormValue("inTable")
-	replyToIdentifierForm := r.FormValue("replyToIdentifier")
+	parentIdForm := r.FormValue("parentId")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	defer func() {
-		if len(errs) > 0 {
-			w.WriteHeader(badCode)
-			renderHtml(w, msg, errs, "user.html")
-		} else if len(errs) == 0 {
-			renderHtml(w, msg, errs, "user.html")
-		}
-	}()
-
 	user, err := userInfoMiddleware(r)
 	if err != nil {
 		http.Redirect(w, r, "/logout", badCode)
 		return
 	}
 
-	if replyToIdentifierForm == "" {
-		replyToIdentifierUUID = uuid.Nil
-	} else {
-		replyToIdentifierUUID, err = uuid.Parse(replyToIdentifierForm)
-		if err != nil {
-			errs = append(errs, errors.New("something went wrong try again"))
-			return
+	// a sent message goes back to the topic or article it was posted on,
+	// errors are shown on the profile
+	back := "/user"
+	defer func() {
+		if len(errs) > 0 {
+			renderUserPage(ctx, w, r, user, errs)
+		} else {
+			http.Redirect(w, r, back, http.StatusFound)
 		}
+	}()
 
-		exists, err := getUserIdentifier(ctx, replyToIdentifierUUID)
+	if parentIdForm != "" {
+		parentId.UUID, err = uuid.Parse(parentIdForm)
 		if err != nil {
-			errs = append(errs, errors.New("something went wrong in server try again"))
-			return
-		}
-
-		if !exists {
-			errs = append(errs, errors.New("something went wrong user replying to does not exists"))
+			errs = append(errs, errors.New("something went wrong try again"))
 			return
 		}
+		parentId.Valid = true
 	}
 
-	if msg.Content == "" {
+	if messageContent == "" {
 		errs = append(errs, errors.New("message is empty try again"))
 		return
 	}
 
+	// forum messages are posted to one of its topics
 	switch inTable {
-	case "forum":
+	case "topic":
 		inTableRune = 'F'
 	case "article":
 		inTableRune = 'A'
@@ -93,6 +130,20 @@ func insertMessageHandler(w http.ResponseWriter, r *http.Request) {
 		errs = append(errs, errors.New("something went wrong try again"))
 		return
 	}
+	room := RoomKey{id: InTableId, roomtype: inTable}
+
+	var topic ForumTopic
+	if inTable == "topic" {
+		topic, err = getTopic(ctx, InTableId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			errs = append(errs, errors.New("something went wrong topic does not exists"))
+			return
+		} else if err != nil {
+			errs = append(errs, errors.New("something went wrong in server try again"))
+			return
+		}
+		InTableId, inTable = topic.ForumID, "forum"
+	}
 
 	exists, err := getInTableId(ctx, InTableId, inTable)
 	if err != nil {
@@ -105,52 +156,168 @@ func insertMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg = Message{
-		AuthorUsername:    user.Username,
-		AuthorIdentifier:  user.Identifier,
-		ReplyToIdentifier: replyToIdentifierUUID,
-		Content:           messageContent,
-		InTable:           inTableRune,
-		InTableId:         InTableId,
+	// article messages are comments, held to the same rules as the comments api
+	if inTableRune == 'A' {
+		article, err := getArticle(ctx, InTableId)
+		if err != nil || !user.canViewArticle(article) {
+			errs = append(errs, errors.New("something went wrong table does not exists"))
+			return
+		}
+		if countCharacters(messageContent) > maxCommentLength {
+			errs = append(errs, fmt.Errorf("comment should be less than %d characters", maxCommentLength))
+			return
+		}
+		back = articleURL(article.Slug)
+	}
+
+	// set for forum messages, a failed post gives back the slow mode key
+	var forum Forum
+	if inTableRune == 'F' {
+		forum, err = getForum(ctx, InTableId)
+		if err != nil {
+			errs = append(errs, errors.New("something went wrong in server try again"))
+			return
+		}
+		auth, err := authorizeForum(ctx, forum, user)
+		if err != nil {
+			errs = append(errs, errors.New("something went wrong in server try again"))
+			return
+		}
+		if !auth.Can(permPost) {
+			errs = append(errs, auth.postError())
+			return
+		}
+		if topic.Locked && !auth.Can(permLock) {
+			errs = append(errs, errTopicLocked)
+			return
+		}
+		err = checkSlowMode(ctx, forum, user.Identifier, auth)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		back = topicURL(forum.Slug, topic.ID)
 	}
 
-	msg.insertMessage(ctx)
+	msg = Message{
+		AuthorUsername:   user.Username,
+		AuthorIdentifier: user.Identifier,
+		ParentId:         parentId,
+		Content:          messageContent,
+		InTable:          inTableRune,
+		InTableId:        InTableId,
+		TopicId:          uuid.NullUUID{UUID: topic.ID, Valid: inTableRune == 'F'},
+	}
 
-	msgByte, err := json.Marshal(msg)
+	msg, err = msg.insertMessage(ctx)
 	if err != nil {
-		errs = append(errs, errors.New("something went wrong try refreshing"))
+		releaseSlowMode(forum, user.Identifier)
+	}
+	if errors.Is(err, errParentNotFound) || errors.Is(err, errTooDeep) {
+		errs = append(errs, err)
+		return
+	} else if err != nil {
+		errs = append(errs, errors.New("error sending message, try again"))
 		return
 	}
 
-	roomKey := RoomKey{id: InTableId, roomtype: inTable}
+	if msg.TopicId.Valid {
+		err = touchTopic(ctx, msg.TopicId.UUID, user.Identifier, msg.CreatedAt)
+		if err != nil {
+			log.Println("error updating topic last reply:", err)
+		}
+	}
 
-	// add websocket here or if needed add redis for cache
-	rmSrv.publishHandler(roomKey, msgByte)
+	publishMessage(room, "message_created", msg)
 }
 
+// publishMessage streams a message event, message_created or
+// message_deleted, to everyone in the room
+func publishMessage(key RoomKey, event string, msg Message) {
+	msgByte, err := json.Marshal(MessageEvent{Event: event, Message: msg})
+	if err != nil {
+		return
+	}
+	rmSrv.publishHandler(key, msgByte)
+}
+
+// insertMessage saves msg, a reply must be in the same forum topic, article
+// or poll as its parent and takes the parent's author as reply_to_identifier
 func (msg Message) insertMessage(ctx context.Context) (Message, error) {
-	var result Message
-	var insertMsg string
-
-	if msg.ReplyToIdentifier == uuid.Nil {
-		insertMsg = `INSERT INTO messages (author, author_id, content, in_table, in_table_id)
-                     VALUES ($1, $2, $3, $4, $5)
-                     RETURNING message_id, author, author_id, content, created_at, in_table, in_table_id`
-		err := database.Dbpool.QueryRow(ctx, insertMsg, msg.AuthorUsername, msg.AuthorIdentifier, msg.Content, msg.InTable, msg.InTableId).Scan(
-			&result.MessageId, &result.AuthorUsername, &result.AuthorIdentifier, &result.Content, &result.CreatedAt, &result.InTable, &result.InTableId)
-		if err != nil {
+	var rootId uuid.NullUUID
+	var replyTo uuid.NullUUID
+	depth := 0
+
+	if msg.ParentId.Valid {
+		var parentTable string
+		var parentTableId uuid.UUID
+		var parentTopicId uuid.NullUUID
+		var parentDepth int
+
+		getParent := `SELECT COALESCE(root_id, message_id), depth, author_identifier, in_table, in_table_id, topic_id
+		              FROM messages WHERE message_id = $1 AND deleted_at IS NULL`
+		err := database.Dbpool.QueryRow(ctx, getParent, msg.ParentId.UUID).Scan(
+			&rootId.UUID, &parentDepth, &replyTo.UUID, &parentTable, &parentTableId, &parentTopicId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Message{}, errParentNotFound
+		} else if err != nil {
 			return Message{}, err
 		}
-	} else {
-		insertMsg = `INSERT INTO messages (author, author_id, reply_to, content, in_table, in_table_id)
-                     VALUES ($1, $2, $3, $4, $5, $6)
-                     RETURNING message_id, author, author_id, reply_to_identifier, content, created_at, in_table, in_table_id`
-		err := database.Dbpool.QueryRow(ctx, insertMsg, msg.AuthorUsername, msg.AuthorIdentifier, msg.ReplyToIdentifier, msg.Content, msg.InTable, msg.InTableId).Scan(
-			&result.MessageId, &result.AuthorUsername, &result.AuthorIdentifier, &result.ReplyToIdentifier, &result.Content, &result.CreatedAt, &result.InTable, &result.InTableId)
-		if err != nil {
-			return Message{}, err
+
+		if firstRune(parentTable) != msg.InTable || parentTableId != msg.InTableId || parentTopicId != msg.TopicId {
+			return Message{}, errParentNotFound
+		}
+
+		depth = parentDepth + 1
+		if depth >= maxMessageDepth {
+			return Message{}, errTooDeep
 		}
+		rootId.Valid = true
+		replyTo.Valid = true
+	}
+
+	insertMsg := `INSERT INTO messages (author, author_identifier, reply_to_identifier, parent_id, root_id, depth,
+                      content, in_table, in_table_id, topic_id)
+                  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+                  RETURNING ` + messageColumns
+	return scanMessage(database.Dbpool.QueryRow(ctx, insertMsg,
+		msg.AuthorUsername, msg.AuthorIdentifier, replyTo, msg.ParentId, rootId, depth,
+		msg.Content, string(msg.InTable), msg.InTableId, msg.TopicId))
+}
+
+// listMessages returns the newest messages of a forum, article or poll
+func listMessages(ctx context.Context, inTable rune, inTableID uuid.UUID, limit int) ([]Message, error) {
+	list := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	WHERE in_table = $1 AND in_table_id = $2 AND deleted_at IS NULL
+	ORDER BY created_at DESC
+	LIMIT $3;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, string(inTable), inTableID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Message, error) {
+		return scanMessage(row)
+	})
+}
+
+// listAllMessages returns every message of a forum, article or poll, oldest first
+func listAllMessages(ctx context.Context, inTable rune, inTableID uuid.UUID) ([]Message, error) {
+	list := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	WHERE in_table = $1 AND in_table_id = $2 AND deleted_at IS NULL
+	ORDER BY created_at;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, string(inTable), inTableID)
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Message, error) {
+		return scanMessage(row)
+	})
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+type Notification struct {
+	ID        uuid.UUID  `json:"notification_id"`
+	Content   string     `json:"content"`
+	Link      string     `json:"link"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// NotificationEvent is pushed to the user room of the recipient
+type NotificationEvent struct {
+	Event        string       `json:"event"`
+	Notification Notification `json:"notification"`
+}
+
+type NotificationsPage struct {
+	Notifications []Notification
+	Unread        int
+}
+
+// notifyUser stores an in-app notification, pushes it to the user's open
+// pages and mails it, base is the site url links in the mail start with.
+// A failed mail is only logged, the notification stays.
+func notifyUser(ctx context.Context, userIdentifier uuid.UUID, subject, content, link, base string) error {
+	var n Notification
+	var email string
+
+	insert := `
+	INSERT INTO notifications (user_identifier, content, link)
+	VALUES ($1, $2, $3)
+	RETURNING notification_id, content, link, read_at, created_at,
+	          (SELECT email FROM users WHERE user_identifier = $1)
+	`
+	err := database.Dbpool.QueryRow(ctx, insert, userIdentifier, summarize(content, 500), link).Scan(
+		&n.ID, &n.Content, &n.Link, &n.ReadAt, &n.CreatedAt, &email)
+	if err != nil {
+		return err
+	}
+
+	if rmSrv != nil {
+		eventByte, err := json.Marshal(NotificationEvent{Event: "notification", Notification: n})
+		if err == nil {
+			rmSrv.publishHandler(RoomKey{id: userIdentifier, roomtype: "user"}, eventByte)
+		}
+	}
+
+	body := content + "\r\n"
+	if link != "" {
+		body += base + link + "\r\n"
+	}
+	// smtp is slow, the request does not wait for it
+	go func() {
+		err := mailUser(email, subject, body)
+		if err != nil {
+			log.Println("error mailing notification:", err)
+		}
+	}()
+	return nil
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var page NotificationsPage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, page, errs, "notifications.html")
+	}()
+
+	page.Notifications, err = listNotifications(ctx, user.Identifier)
+	if err != nil {
+		errs = append(errs, errors.New("error getting notifications, try again"))
+		return
+	}
+	for _, n := range page.Notifications {
+		if n.ReadAt == nil {
+			page.Unread++
+		}
+	}
+}
+
+// readNotificationsHandler marks every notification of the user as read
+func readNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	read := `UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_identifier = $1 AND read_at IS NULL`
+	_, err = database.Dbpool.Exec(ctx, read, user.Identifier)
+	if err != nil {
+		page := NotificationsPage{}
+		page.Notifications, _ = listNotifications(ctx, user.Identifier)
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, []error{errors.New("error marking notifications read, try again")}, "notifications.html")
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
+
+// listNotifications returns the latest notifications, unread first
+func listNotifications(ctx context.Context, userIdentifier uuid.UUID) ([]Notification, error) {
+	list := `
+	SELECT notification_id, content, link, read_at, created_at
+	FROM notifications
+	WHERE user_identifier = $1
+	ORDER BY read_at IS NOT NULL, created_at DESC
+	LIMIT 100;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Notification, error) {
+		var n Notification
+		err := row.Scan(&n.ID, &n.Content, &n.Link, &n.ReadAt, &n.CreatedAt)
+		return n, err
+	})
+}
+
+func countUnreadNotifications(ctx context.Context, userIdentifier uuid.UUID) (int, error) {
+	var unread int
+	count := `SELECT COUNT(*) FROM notifications WHERE user_identifier = $1 AND read_at IS NULL`
+	err := database.Dbpool.QueryRow(ctx, count, userIdentifier).Scan(&unread)
+	return unread, err
+}
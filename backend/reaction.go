@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// REACTIONS in .env overrides the set, comma separated
+const defaultReactions = "👍,❤️,🎉,😄,🤔"
+
+// counters live in redis hashes, postgres rows stay the source of truth and
+// the scheduler reconciles every article in the dirty set
+const (
+	reactionsKey      = "reactions:"
+	reactionsDirtyKey = "reactions:dirty"
+	bookmarksField    = "bookmarks"
+	reactionsTTL      = 24 * time.Hour
+)
+
+// only bump counters that are loaded, a missing hash is rebuilt from postgres on read
+var bumpCounter = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+    return redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int64  `json:"count"`
+	Mine  bool   `json:"mine"`
+}
+
+type Reactions struct {
+	Counts     []ReactionCount `json:"reactions"`
+	Bookmarks  int64           `json:"bookmarks"`
+	Bookmarked bool            `json:"bookmarked"`
+}
+
+type Bookmark struct {
+	ArticleID uuid.UUID
+	Title     string
+	Slug      string
+	Author    string
+	CreatedAt time.Time
+}
+
+type UserPage struct {
+	User      DbUser
+	Bookmarks []Bookmark
+	Unread    int
+	// Sections the user may create forums in
+	Sections []ForumSection
+}
+
+func reactionSet() []string {
+	value := os.Getenv("REACTIONS")
+	if value == "" {
+		value = defaultReactions
+	}
+
+	var set []string
+	for _, emoji := range strings.Split(value, ",") {
+		emoji = strings.TrimSpace(emoji)
+		if emoji != "" {
+			set = append(set, emoji)
+		}
+	}
+	return set
+}
+
+func validReaction(emoji string) bool {
+	for _, e := range reactionSet() {
+		if e == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+func reactHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Emoji string `json:"emoji"`
+	}
+
+	reactionAction(w, r, func(ctx context.Context, user DbUser, article Article) error {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body)
+		if err != nil || !validReaction(body.Emoji) {
+			return errors.New("please provide one of the reactions " + strings.Join(reactionSet(), " "))
+		}
+
+		added, err := toggleRow(ctx,
+			`DELETE FROM article_reactions WHERE article_id = $1 AND user_identifier = $2 AND emoji = $3`,
+			`INSERT INTO article_reactions (article_id, user_identifier, emoji) VALUES ($1, $2, $3)
+			 ON CONFLICT (article_id, user_identifier, emoji) DO NOTHING`,
+			article.ID, user.Identifier, body.Emoji)
+		if err != nil {
+			log.Println("error toggling reaction:", err)
+			return errors.New("error saving reaction, try again")
+		}
+
+		bumpReaction(ctx, article.ID, body.Emoji, added)
+		return nil
+	})
+}
+
+func bookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	reactionAction(w, r, func(ctx context.Context, user DbUser, article Article) error {
+		added, err := toggleRow(ctx,
+			`DELETE FROM bookmarks WHERE article_id = $1 AND user_identifier = $2`,
+			`INSERT INTO bookmarks (article_id, user_identifier) VALUES ($1, $2)
+			 ON CONFLICT (user_identifier, article_id) DO NOTHING`,
+			article.ID, user.Identifier)
+		if err != nil {
+			log.Println("error toggling bookmark:", err)
+			return errors.New("error saving bookmark, try again")
+		}
+
+		bumpReaction(ctx, article.ID, bookmarksField, added)
+		return nil
+	})
+}
+
+// reactionAction loads the article for a reaction api call and answers with
+// the fresh counts, action returns an error to show the reader
+func reactionAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, user DbUser, article Article) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		renderJson(w, unauthorized, map[string]string{"error": "please login to react"})
+		return
+	}
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		renderJson(w, notFound, map[string]string{"error": "article not found"})
+		return
+	}
+
+	article, err := getArticle(ctx, Id)
+	if err != nil || !user.canViewArticle(article) {
+		renderJson(w, notFound, map[string]string{"error": "article not found"})
+		return
+	}
+
+	err = action(ctx, user, article)
+	if err != nil {
+		renderJson(w, badCode, map[string]string{"error": err.Error()})
+		return
+	}
+
+	reactions, err := getReactions(ctx, article.ID, user.Identifier)
+	if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error getting reactions"})
+		return
+	}
+	renderJson(w, statusOK, reactions)
+}
+
+// removeBookmarkHandler is the remove button of the bookmarks list on /user
+func removeBookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/user", http.StatusFound)
+		return
+	}
+
+	remove := `DELETE FROM bookmarks WHERE article_id = $1 AND user_identifier = $2`
+	tag, err := database.Dbpool.Exec(ctx, remove, Id, user.Identifier)
+	if err != nil {
+		renderUserPage(ctx, w, r, user, []error{errors.New("error removing bookmark, try again")})
+		return
+	}
+	if tag.RowsAffected() > 0 {
+		bumpReaction(ctx, Id, bookmarksField, false)
+	}
+
+	http.Redirect(w, r, "/user", http.StatusFound)
+}
+
+// toggleRow deletes the row and inserts it when there was none,
+// added tells which of the two happened
+func toggleRow(ctx context.Context, remove, insert string, args ...any) (added bool, err error) {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, remove, args...)
+	if err != nil {
+		return false, err
+	}
+
+	if tag.RowsAffected() == 0 {
+		tag, err = tx.Exec(ctx, insert, args...)
+		if err != nil {
+			return false, err
+		}
+		added = tag.RowsAffected() > 0
+	}
+
+	return added, tx.Commit(ctx)
+}
+
+// bumpReaction moves the redis counter and marks the article for reconciling,
+// redis errors are only logged because postgres already has the change
+func bumpReaction(ctx context.Context, articleID uuid.UUID, field string, added bool) {
+	delta := -1
+	if added {
+		delta = 1
+	}
+
+	key := reactionsKey + articleID.String()
+	err := bumpCounter.Run(ctx, database.RedisAllClients.Client1, []string{key}, field, delta).Err()
+	if err != nil {
+		log.Println("error bumping reaction counter:", err)
+	}
+
+	err = database.RedisAllClients.Client1.SAdd(ctx, reactionsDirtyKey, articleID.String()).Err()
+	if err != nil {
+		log.Println("error marking reactions dirty:", err)
+	}
+}
+
+// getReactions reads counts from redis, loading them from postgres on a miss,
+// the viewer's own reactions always come from postgres
+func getReactions(ctx context.Context, articleID, viewer uuid.UUID) (Reactions, error) {
+	var reactions Reactions
+
+	counts, err := reactionCounts(ctx, articleID)
+	if err != nil {
+		return Reactions{}, err
+	}
+
+	mine := make(map[string]bool)
+	if viewer != uuid.Nil {
+		getMine := `
+		SELECT emoji FROM article_reactions WHERE article_id = $1 AND user_identifier = $2
+		UNION ALL
+		SELECT $3 FROM bookmarks WHERE article_id = $1 AND user_identifier = $2;
+		`
+		rows, err := database.Dbpool.Query(ctx, getMine, articleID, viewer, bookmarksField)
+		if err != nil {
+			return Reactions{}, err
+		}
+		emojis, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return Reactions{}, err
+		}
+		for _, e := range emojis {
+			mine[e] = true
+		}
+	}
+
+	for _, emoji := range reactionSet() {
+		reactions.Counts = append(reactions.Counts, ReactionCount{Emoji: emoji, Count: counts[emoji], Mine: mine[emoji]})
+	}
+	reactions.Bookmarks = counts[bookmarksField]
+	reactions.Bookmarked = mine[bookmarksField]
+
+	return reactions, nil
+}
+
+func reactionCounts(ctx context.Context, articleID uuid.UUID) (map[string]int64, error) {
+	key := reactionsKey + articleID.String()
+
+	cached, err := database.RedisAllClients.Client1.HGetAll(ctx, key).Result()
+	if err == nil && len(cached) > 0 {
+		counts := make(map[string]int64, len(cached))
+		for field, value := range cached {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			counts[field] = n
+		}
+		return counts, nil
+	}
+
+	counts, err := storedReactionCounts(ctx, articleID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cacheReactionCounts(ctx, articleID, counts)
+	if err != nil {
+		log.Println("error caching reaction counts:", err)
+	}
+	return counts, nil
+}
+
+// storedReactionCounts reads the counts reconcileReactions kept in postgres,
+// they lag at most one run as bumps mark the article dirty. Articles never
+// reconciled have no rows, not even bookmarks, and are counted instead.
+func storedReactionCounts(ctx context.Context, articleID uuid.UUID) (map[string]int64, error) {
+	rows, err := database.Dbpool.Query(ctx, `SELECT reaction, count FROM article_reaction_counts WHERE article_id = $1`, articleID)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	var field string
+	var n int64
+	_, err = pgx.ForEachRow(rows, []any{&field, &n}, func() error {
+		counts[field] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(counts) == 0 {
+		return countReactions(ctx, articleID)
+	}
+	return counts, nil
+}
+
+// countReactions counts the real rows, bookmarks under bookmarksField
+func countReactions(ctx context.Context, articleID uuid.UUID) (map[string]int64, error) {
+	count := `
+	SELECT emoji, COUNT(*) FROM article_reactions WHERE article_id = $1 GROUP BY emoji
+	UNION ALL
+	SELECT $2, COUNT(*) FROM bookmarks WHERE article_id = $1;
+	`
+	rows, err := database.Dbpool.Query(ctx, count, articleID, bookmarksField)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	var field string
+	var n int64
+	_, err = pgx.ForEachRow(rows, []any{&field, &n}, func() error {
+		counts[field] = n
+		return nil
+	})
+	return counts, err
+}
+
+// cacheReactionCounts replaces the redis hash, the bookmarks field is always
+// set so a loaded hash is never empty
+func cacheReactionCounts(ctx context.Context, articleID uuid.UUID, counts map[string]int64) error {
+	key := reactionsKey + articleID.String()
+
+	values := map[string]interface{}{bookmarksField: counts[bookmarksField]}
+	for field, n := range counts {
+		values[field] = n
+	}
+
+	tx := database.RedisAllClients.Client1.TxPipeline()
+	tx.Del(ctx, key)
+	tx.HSet(ctx, key, values)
+	tx.Expire(ctx, key, reactionsTTL)
+	_, err := tx.Exec(ctx)
+	return err
+}
+
+// reconcileReactions recounts every article touched since the last run,
+// stores the counts in postgres and fixes any drift of the redis counters
+func reconcileReactions(ctx context.Context) error {
+	for {
+		ids, err := database.RedisAllClients.Client1.SPopN(ctx, reactionsDirtyKey, 100).Result()
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		for i, id := range ids {
+			articleID, err := uuid.Parse(id)
+			if err != nil {
+				continue
+			}
+
+			err = reconcileArticleReactions(ctx, articleID)
+			if err != nil {
+				// the rest of the batch waits for the next run, ctx may be
+				// what ran out
+				requeueDirty(reactionsDirtyKey, ids[i:])
+				return fmt.Errorf("article %s: %w", id, err)
+			}
+		}
+	}
+}
+
+// requeueDirty puts ids back into the dirty set with a context of its own
+func requeueDirty(key string, ids []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	err := database.RedisAllClients.Client1.SAdd(ctx, key, members...).Err()
+	if err != nil {
+		log.Println("error requeueing dirty ids:", err)
+	}
+}
+
+func reconcileArticleReactions(ctx context.Context, articleID uuid.UUID) error {
+	counts, err := countReactions(ctx, articleID)
+	if err != nil {
+		return err
+	}
+
+	fields := make([]string, 0, len(counts))
+	values := make([]int64, 0, len(counts))
+	for field, n := range counts {
+		fields = append(fields, field)
+		values = append(values, n)
+	}
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	clear := `DELETE FROM article_reaction_counts WHERE article_id = $1 AND NOT (reaction = ANY($2))`
+	_, err = tx.Exec(ctx, clear, articleID, fields)
+	if err != nil {
+		return err
+	}
+
+	upsert := `
+	INSERT INTO article_reaction_counts (article_id, reaction, count)
+	SELECT $1, c.reaction, c.count FROM unnest($2::text[], $3::bigint[]) AS c(reaction, count)
+	ON CONFLICT (article_id, reaction) DO UPDATE SET count = EXCLUDED.count, updated_at = CURRENT_TIMESTAMP;
+	`
+	_, err = tx.Exec(ctx, upsert, articleID, fields, values)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	return cacheReactionCounts(ctx, articleID, counts)
+}
+
+// listBookmarks returns the user's saved articles that are still published
+func listBookmarks(ctx context.Context, identifier uuid.UUID) ([]Bookmark, error) {
+	list := `
+	SELECT a.article_id, a.title, a.slug, a.author, b.created_at
+	FROM bookmarks b
+	JOIN articles a ON a.article_id = b.article_id
+	WHERE b.user_identifier = $1 AND a.status = 'P' AND a.deleted_at IS NULL
+	ORDER BY b.created_at DESC;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Bookmark, error) {
+		var b Bookmark
+		err := row.Scan(&b.ArticleID, &b.Title, &b.Slug, &b.Author, &b.CreatedAt)
+		return b, err
+	})
+}
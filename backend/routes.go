@@ -46,16 +46,112 @@ func routes() {
 	mux.HandleFunc("/404", notFoundHandler)
 	mux.HandleFunc("/verify", redirectLoginHandler)
 	mux.HandleFunc("/resendotp", redirectLoginHandler)
-	mux.HandleFunc("/forum/{id}", viewForumHandler)
+	mux.HandleFunc("/forums", forumsHandler)
+	mux.HandleFunc("/forums/invitations", forumInvitationsHandler)
+	mux.HandleFunc("/forums/sections", forumSectionsHandler)
+	mux.HandleFunc("/forum/{id}", forumIdRedirectHandler)
+	mux.HandleFunc("/f/{slug}", viewForumHandler)
+	mux.HandleFunc("/f/{slug}/t/{id}", viewTopicHandler)
+	mux.HandleFunc("/forum/{id}/members", forumMembersHandler)
+	mux.HandleFunc("/forum/{id}/settings", forumSettingsHandler)
+	mux.HandleFunc("/forum/{id}/export", exportForumMessagesHandler)
+	mux.HandleFunc("/invite/{code}", inviteLinkHandler)
+	mux.HandleFunc("/articles", listArticlesHandler)
+	mux.HandleFunc("/article/{id}", articleIdRedirectHandler)
+	mux.HandleFunc("/a/{slug}", viewArticleHandler)
+	mux.HandleFunc("/article/new", newArticleHandler)
+	mux.HandleFunc("/article/{id}/edit", editArticleHandler)
+	mux.HandleFunc("/article/{id}/authors", articleAuthorsHandler)
+	mux.HandleFunc("/article/invitations", articleInvitationsHandler)
+	mux.HandleFunc("/s/{slug}", viewSeriesHandler)
+	mux.HandleFunc("/series/new", newSeriesHandler)
+	mux.HandleFunc("/series/{id}/edit", editSeriesHandler)
+	mux.HandleFunc("/tags", tagCloudHandler)
+	mux.HandleFunc("/tag/{slug}", viewTagHandler)
+	mux.HandleFunc("/api/tags", tagAutocompleteHandler)
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/api/search", searchApiHandler)
+	mux.HandleFunc("/sitemap.xml", sitemapHandler)
+	mux.HandleFunc("/sitemap/{page}", sitemapPageHandler)
+	mux.HandleFunc("/robots.txt", robotsHandler)
+	mux.HandleFunc("/feed/{format}", articlesFeedHandler)
+	mux.HandleFunc("/feed/{format}/category/{category}", categoryFeedHandler)
+	mux.HandleFunc("/feed/{format}/author/{username}", authorFeedHandler)
+	mux.HandleFunc("/feed/{format}/forum/{slug}", forumFeedHandler)
+	mux.HandleFunc("/media/{id}", serveMediaHandler)
+	mux.HandleFunc("/api/media", listMediaHandler)
+	mux.HandleFunc("/analytics", analyticsHandler)
+	mux.HandleFunc("/api/article/{id}/comments", commentsApiHandler)
+	mux.HandleFunc("/trash", trashHandler)
+	mux.HandleFunc("/notifications", notificationsHandler)
 
 	mux.HandleFunc("POST /login", createUserHandler)
 	mux.HandleFunc("POST /verify", verifyUserHandler)
 	mux.HandleFunc("POST /resendotp", resendOtpHandler)
 	mux.HandleFunc("POST /sendmessage", insertMessageHandler)
 	mux.HandleFunc("POST /createforum", createForumHandler)
+	mux.HandleFunc("POST /forum/{id}/slug", editForumSlugHandler)
+	mux.HandleFunc("POST /forum/{id}/section", setForumSectionHandler)
+	mux.HandleFunc("POST /forums/sections", createForumSectionHandler)
+	mux.HandleFunc("POST /forums/sections/{id}", updateForumSectionHandler)
+	mux.HandleFunc("POST /forums/sections/{id}/delete", deleteForumSectionHandler)
+	mux.HandleFunc("POST /forum/{id}/settings", updateForumSettingsHandler)
+	mux.HandleFunc("POST /forum/{id}/join", joinForumHandler)
+	mux.HandleFunc("POST /forum/{id}/leave", leaveForumHandler)
+	mux.HandleFunc("POST /forum/{id}/request", requestJoinForumHandler)
+	mux.HandleFunc("POST /forum/{id}/requests/{username}", decideJoinRequestHandler)
+	mux.HandleFunc("POST /forum/{id}/members/{username}/role", setForumRoleHandler)
+	mux.HandleFunc("POST /forum/{id}/members/{username}/transfer", offerForumOwnershipHandler)
+	mux.HandleFunc("POST /forum/{id}/ownership/cancel", cancelForumOwnershipHandler)
+	mux.HandleFunc("POST /forum/{id}/ownership", answerForumOwnershipHandler)
+	mux.HandleFunc("POST /forum/{id}/delete", scheduleForumDeletionHandler)
+	mux.HandleFunc("POST /forum/{id}/delete/cancel", cancelForumDeletionHandler)
+	mux.HandleFunc("POST /forum/{id}/sanctions", sanctionForumUserHandler)
+	mux.HandleFunc("POST /forum/{id}/sanctions/{username}/{kind}/lift", liftForumSanctionHandler)
+	mux.HandleFunc("POST /forum/{id}/slowmode", setSlowModeHandler)
+	mux.HandleFunc("POST /forum/{id}/topics", createTopicHandler)
+	mux.HandleFunc("POST /forum/{id}/announcements", announceForumHandler)
+	mux.HandleFunc("POST /forum/{id}/announcements/{announcement}/remove", removeAnnouncementHandler)
+	mux.HandleFunc("POST /topic/{id}/lock", lockTopicHandler)
+	mux.HandleFunc("POST /topic/{id}/pin", pinTopicHandler)
+	mux.HandleFunc("POST /topic/{id}/messages/{message}/pin", pinMessageHandler)
+	mux.HandleFunc("POST /topic/{id}/messages/{message}/unpin", unpinMessageHandler)
+	mux.HandleFunc("POST /forum/{id}/invite", inviteForumUserHandler)
+	mux.HandleFunc("POST /forum/{id}/invites/{invite}/revoke", revokeForumInviteHandler)
+	mux.HandleFunc("POST /forum/{id}/links", createInviteLinkHandler)
+	mux.HandleFunc("POST /forum/{id}/links/{code}/revoke", revokeInviteLinkHandler)
+	mux.HandleFunc("POST /forums/invitations/{id}", respondForumInviteHandler)
+	mux.HandleFunc("POST /invite/{code}", redeemInviteLinkHandler)
+	mux.HandleFunc("POST /createarticle", createArticleHandler)
+	mux.HandleFunc("POST /article/{id}/edit", updateArticleHandler)
+	mux.HandleFunc("POST /article/{id}/tags", setArticleTagsHandler)
+	mux.HandleFunc("POST /article/{id}/slug", editArticleSlugHandler)
+	mux.HandleFunc("POST /article/{id}/authors", inviteArticleAuthorHandler)
+	mux.HandleFunc("POST /article/{id}/authors/order", reorderArticleAuthorsHandler)
+	mux.HandleFunc("POST /article/{id}/authors/{username}/role", setArticleAuthorRoleHandler)
+	mux.HandleFunc("POST /article/{id}/authors/{username}/remove", removeArticleAuthorHandler)
+	mux.HandleFunc("POST /article/{id}/invitation", respondArticleInviteHandler)
+	mux.HandleFunc("POST /createseries", createSeriesHandler)
+	mux.HandleFunc("POST /series/{id}/edit", updateSeriesHandler)
+	mux.HandleFunc("POST /series/{id}/articles", addSeriesArticleHandler)
+	mux.HandleFunc("POST /series/{id}/articles/{article}/remove", removeSeriesArticleHandler)
+	mux.HandleFunc("POST /api/series/{id}/order", reorderSeriesApiHandler)
+	mux.HandleFunc("POST /api/article/{id}/react", reactHandler)
+	mux.HandleFunc("POST /api/article/{id}/bookmark", bookmarkHandler)
+	mux.HandleFunc("POST /api/article/{id}/comments", createCommentApiHandler)
+	mux.HandleFunc("POST /user/bookmarks/{id}/remove", removeBookmarkHandler)
+	mux.HandleFunc("POST /tag/{slug}/rename", renameTagHandler)
+	mux.HandleFunc("POST /tag/{slug}/merge", mergeTagHandler)
+	mux.HandleFunc("POST /api/media", uploadMediaHandler)
+	mux.HandleFunc("POST /trash/{kind}/{id}", trashContentHandler)
+	mux.HandleFunc("POST /trash/{kind}/{id}/restore", restoreContentHandler)
+	mux.HandleFunc("POST /notifications/read", readNotificationsHandler)
 
 	// websocket subscribe
-	mux.HandleFunc("websocket/{type}/{id}", rm.subscribeHandler)
+	mux.HandleFunc("/websocket/{type}/{id}", rm.subscribeHandler)
+
+	// publish and unpublish scheduled articles
+	go runScheduler(context.Background())
 
 	localFlies := http.FileServer(http.Dir("../frontend/public"))
 	mux.Handle("/public/", http.StripPrefix("/public/", localFlies))
@@ -68,16 +164,50 @@ func routes() {
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	var formUser FormUser
-	renderHtml(w, formUser, nil, "login.html")
+	renderHtml(w, r, formUser, nil, "login.html")
 }
 
 func userHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
 	user, err := userInfoMiddleware(r)
 	if err != nil {
 		http.Redirect(w, r, "/logout", badCode)
 		return
 	}
-	renderHtml(w, user, nil, "user.html")
+
+	renderUserPage(ctx, w, r, user, nil)
+}
+
+// renderUserPage shows the profile of user, forms posted from it come back
+// here with their errs
+func renderUserPage(ctx context.Context, w http.ResponseWriter, r *http.Request, user DbUser, errs []error) {
+	var err error
+
+	page := UserPage{User: user}
+	page.Bookmarks, err = listBookmarks(ctx, user.Identifier)
+	if err != nil {
+		errs = append(errs, errors.New("error getting bookmarks, try again"))
+	}
+	page.Unread, err = countUnreadNotifications(ctx, user.Identifier)
+	if err != nil {
+		errs = append(errs, errors.New("error getting notifications, try again"))
+	}
+	sections, err := listForumSections(ctx)
+	if err != nil {
+		errs = append(errs, errors.New("error getting forum sections, try again"))
+	}
+	for _, s := range sections {
+		if s.canCreateForum(user) {
+			page.Sections = append(page.Sections, s)
+		}
+	}
+
+	if len(errs) > 0 {
+		w.WriteHeader(badCode)
+	}
+	renderHtml(w, r, page, errs, "user.html")
 }
 
 func redirectLoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -85,7 +215,7 @@ func redirectLoginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
-	renderHtml(w, nil, nil, "notFound.html")
+	renderHtml(w, r, nil, nil, "notFound.html")
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -93,7 +223,7 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		notFoundHandler(w, r)
 		return
 	}
-	renderHtml(w, nil, nil, "index.html")
+	renderHtml(w, r, nil, nil, "index.html")
 }
 
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -105,9 +235,9 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if len(errs) > 0 {
 			w.WriteHeader(badCode)
-			renderHtml(w, userForm, errs, "login.html")
+			renderHtml(w, r, userForm, errs, "login.html")
 		} else if len(errs) == 0 {
-			renderHtml(w, userForm, errs, "verify.html")
+			renderHtml(w, r, userForm, errs, "verify.html")
 		}
 	}()
 
@@ -194,7 +324,7 @@ func verifyUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if len(errs) > 0 {
-			renderHtml(w, formUser, errs, "verify.html")
+			renderHtml(w, r, formUser, errs, "verify.html")
 		} else if len(errs) == 0 {
 			http.Redirect(w, r, "/", http.StatusFound)
 		}
@@ -270,10 +400,10 @@ func resendOtpHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if len(errs) > 0 {
-			renderHtml(w, formUser, errs, "verify.html")
+			renderHtml(w, r, formUser, errs, "verify.html")
 		} else if len(errs) == 0 {
 			formUser.Message = "New OTP sent, Please check your email."
-			renderHtml(w, formUser, errs, "verify.html")
+			renderHtml(w, r, formUser, errs, "verify.html")
 		}
 	}()
 
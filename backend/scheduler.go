@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+const schedulerInterval = 30 * time.Second
+
+type ArticleEvent struct {
+	Event     string    `json:"event"`
+	ArticleID uuid.UUID `json:"article_id"`
+	Title     string    `json:"title"`
+	Author    string    `json:"author"`
+	URL       string    `json:"url"`
+}
+
+// runScheduler publishes and unpublishes articles whose time has come.
+// Every server instance runs one, SKIP LOCKED makes sure a row is only
+// flipped (and announced) by a single instance.
+func runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		runScheduledJobs(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runScheduledJobs(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	published, err := publishDueArticles(ctx)
+	if err != nil {
+		log.Println("scheduler error publishing articles:", err)
+	}
+	for _, a := range published {
+		notifyArticlePublished(a)
+	}
+
+	_, err = unpublishDueArticles(ctx)
+	if err != nil {
+		log.Println("scheduler error unpublishing articles:", err)
+	}
+
+	err = reconcileReactions(ctx)
+	if err != nil {
+		log.Println("scheduler error reconciling reactions:", err)
+	}
+
+	err = flushArticleViews(ctx)
+	if err != nil {
+		log.Println("scheduler error flushing article views:", err)
+	}
+
+	err = deleteDueForums(ctx)
+	if err != nil {
+		log.Println("scheduler error deleting forums:", err)
+	}
+
+	err = purgeTrash(ctx)
+	if err != nil {
+		log.Println("scheduler error purging trash:", err)
+	}
+}
+
+func publishDueArticles(ctx context.Context) ([]Article, error) {
+	publish := `
+	UPDATE articles SET status = 'P', published_at = publish_at, updated_at = CURRENT_TIMESTAMP
+	WHERE article_id IN (
+	    SELECT article_id FROM articles
+	    WHERE status = 'D' AND publish_at <= CURRENT_TIMESTAMP AND deleted_at IS NULL
+	    ORDER BY publish_at
+	    LIMIT 100
+	    FOR UPDATE SKIP LOCKED)
+	RETURNING ` + articleColumns
+	rows, err := database.Dbpool.Query(ctx, publish)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Article, error) {
+		return scanArticle(row)
+	})
+}
+
+func unpublishDueArticles(ctx context.Context) ([]Article, error) {
+	unpublish := `
+	UPDATE articles SET status = 'U', updated_at = CURRENT_TIMESTAMP
+	WHERE article_id IN (
+	    SELECT article_id FROM articles
+	    WHERE status = 'P' AND unpublish_at <= CURRENT_TIMESTAMP AND deleted_at IS NULL
+	    ORDER BY unpublish_at
+	    LIMIT 100
+	    FOR UPDATE SKIP LOCKED)
+	RETURNING ` + articleColumns
+	rows, err := database.Dbpool.Query(ctx, unpublish)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Article, error) {
+		return scanArticle(row)
+	})
+}
+
+// notifyArticlePublished tells readers waiting on the article page and
+// everyone following the article stream that a new article is live
+func notifyArticlePublished(article Article) {
+	if rmSrv == nil {
+		return
+	}
+
+	event := ArticleEvent{
+		Event:     "article_published",
+		ArticleID: article.ID,
+		Title:     article.Title,
+		Author:    article.Author,
+		URL:       articleURL(article.Slug),
+	}
+	eventByte, err := json.Marshal(event)
+	if err != nil {
+		log.Println("error encoding article event:", err)
+		return
+	}
+
+	rmSrv.publishHandler(RoomKey{id: article.ID, roomtype: "article"}, eventByte)
+	rmSrv.publishHandler(RoomKey{id: uuid.Nil, roomtype: "articles"}, eventByte)
+	if article.CategoryID.Valid {
+		rmSrv.publishHandler(RoomKey{id: article.CategoryID.UUID, roomtype: "category"}, eventByte)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+const searchPageSize = 20
+
+type SearchQuery struct {
+	Query    string
+	Type     string
+	Author   string
+	Category string
+	From     string
+	To       string
+	Page     int
+}
+
+type SearchResult struct {
+	Type      string    `json:"type"`
+	ID        uuid.UUID `json:"id"`
+	Title     string    `json:"title"`
+	URL       string    `json:"url"`
+	Author    string    `json:"author"`
+	Snippet   string    `json:"snippet"`
+	Rank      float32   `json:"rank"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SearchPage struct {
+	Query   SearchQuery
+	Results []SearchResult
+	HasMore bool
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var page SearchPage
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, page, errs, "search.html")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	page.Query = searchQueryFromRequest(r)
+	if page.Query.Query == "" {
+		return
+	}
+
+	page, errs = runSearch(ctx, r, page.Query)
+}
+
+func searchApiHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := searchQueryFromRequest(r)
+	if query.Query == "" {
+		renderJson(w, badCode, map[string]string{"error": "please provide search query q"})
+		return
+	}
+
+	page, errs := runSearch(ctx, r, query)
+	if errs != nil {
+		renderJson(w, badCode, map[string]string{"error": errs[0].Error()})
+		return
+	}
+
+	renderJson(w, statusOK, page)
+}
+
+func searchQueryFromRequest(r *http.Request) SearchQuery {
+	q := r.URL.Query()
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return SearchQuery{
+		Query:    strings.TrimSpace(q.Get("q")),
+		Type:     q.Get("type"),
+		Author:   strings.TrimSpace(q.Get("author")),
+		Category: strings.TrimSpace(q.Get("category")),
+		From:     q.Get("from"),
+		To:       q.Get("to"),
+		Page:     page,
+	}
+}
+
+// runSearch validates the filters and searches as the logged in user, if any,
+// so private forums only show up for their members
+func runSearch(ctx context.Context, r *http.Request, query SearchQuery) (SearchPage, []error) {
+	var errs []error
+	page := SearchPage{Query: query}
+
+	switch query.Type {
+	case "", "article", "forum", "message":
+	default:
+		errs = append(errs, errors.New("type should be article, forum or message"))
+	}
+
+	from, err := parseSearchDate(query.From)
+	if err != nil {
+		errs = append(errs, errors.New("from date should look like 2006-01-02"))
+	}
+
+	to, err := parseSearchDate(query.To)
+	if err != nil {
+		errs = append(errs, errors.New("to date should look like 2006-01-02"))
+	} else if to != nil {
+		// include the whole "to" day
+		end := to.AddDate(0, 0, 1)
+		to = &end
+	}
+
+	if errs != nil {
+		return page, errs
+	}
+
+	viewer := uuid.Nil
+	user, err := userInfoMiddleware(r)
+	if err == nil {
+		viewer = user.Identifier
+	}
+
+	results, err := search(ctx, query, from, to, viewer)
+	if err != nil {
+		errs = append(errs, errors.New("error searching, try again"))
+		return page, errs
+	}
+
+	// one extra row is fetched to know if there is a next page
+	if len(results) > searchPageSize {
+		page.HasMore = true
+		results = results[:searchPageSize]
+	}
+	page.Results = results
+
+	return page, nil
+}
+
+func parseSearchDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func search(ctx context.Context, query SearchQuery, from, to *time.Time, viewer uuid.UUID) ([]SearchResult, error) {
+	// \x01 and \x02 mark the matches, the snippet is escaped before they
+	// become <mark>. They are taken out of the text first so only ts_headline
+	// writes them.
+	searchAll := `
+	WITH q AS (SELECT websearch_to_tsquery('english', $1) AS query),
+	     headline AS (SELECT 'StartSel=' || chr(1) || ', StopSel=' || chr(2) || ', MaxWords=35, MinWords=15, MaxFragments=2' AS opts)
+	SELECT result_type, id, title, parent_type, parent_slug, author, snippet, rank, created_at
+	FROM (
+	    SELECT 'article' AS result_type, a.article_id AS id, a.title, 'A' AS parent_type, a.slug AS parent_slug,
+	           a.author, ts_headline('english', translate(a.content, chr(1) || chr(2), ''), q.query, headline.opts) AS snippet,
+	           ts_rank(a.search_vector, q.query) AS rank, a.published_at AS created_at
+	    FROM articles a, q, headline
+	    WHERE $2 IN ('', 'article')
+	      AND a.status = 'P' AND a.deleted_at IS NULL
+	      AND a.search_vector @@ q.query
+	      AND ($3 = '' OR EXISTS (
+	          SELECT 1 FROM article_authors aa JOIN users au ON au.user_identifier = aa.user_identifier
+	          WHERE aa.article_id = a.article_id AND aa.accepted AND aa.role <> 'V' AND au.username = $3))
+	      AND ($4 = '' OR a.category_id = (SELECT category_id FROM categories WHERE category_name = $4))
+	      AND ($5::timestamp IS NULL OR a.published_at >= $5)
+	      AND ($6::timestamp IS NULL OR a.published_at < $6)
+
+	    UNION ALL
+
+	    SELECT 'forum', f.forum_id, f.forum_name, 'F', f.forum_slug,
+	           u.username, ts_headline('english', translate(f.forum_name, chr(1) || chr(2), ''), q.query, headline.opts),
+	           ts_rank(f.search_vector, q.query), f.created_at
+	    FROM forums f JOIN users u ON u.user_identifier = f.created_by_identifier, q, headline
+	    WHERE $2 IN ('', 'forum')
+	      AND $4 = ''
+	      AND f.deleted_at IS NULL
+	      AND f.search_vector @@ q.query
+	      AND (f.public OR EXISTS (
+	          SELECT 1 FROM forum_users fu WHERE fu.forum_id = f.forum_id AND fu.user_identifier = $7))
+	      AND ($3 = '' OR u.username = $3)
+	      AND ($5::timestamp IS NULL OR f.created_at >= $5)
+	      AND ($6::timestamp IS NULL OR f.created_at < $6)
+
+	    UNION ALL
+
+	    SELECT 'message', m.message_id, COALESCE(f.forum_name, a.title), m.in_table,
+	           COALESCE(f.forum_slug || COALESCE('/t/' || m.topic_id, ''), a.slug),
+	           m.author, ts_headline('english', translate(m.content, chr(1) || chr(2), ''), q.query, headline.opts),
+	           ts_rank(m.search_vector, q.query), m.created_at
+	    FROM messages m
+	    LEFT JOIN forums f ON m.in_table = 'F' AND f.forum_id = m.in_table_id
+	    LEFT JOIN articles a ON m.in_table = 'A' AND a.article_id = m.in_table_id, q, headline
+	    WHERE $2 IN ('', 'message')
+	      AND m.deleted_at IS NULL
+	      AND m.search_vector @@ q.query
+	      AND ((m.in_table = 'F' AND f.deleted_at IS NULL AND (f.public OR EXISTS (
+	              SELECT 1 FROM forum_users fu WHERE fu.forum_id = f.forum_id AND fu.user_identifier = $7)))
+	        OR (m.in_table = 'A' AND a.status = 'P' AND a.deleted_at IS NULL))
+	      AND ($3 = '' OR m.author = $3)
+	      AND ($4 = '' OR a.category_id = (SELECT category_id FROM categories WHERE category_name = $4))
+	      AND ($5::timestamp IS NULL OR m.created_at >= $5)
+	      AND ($6::timestamp IS NULL OR m.created_at < $6)
+	) results
+	ORDER BY rank DESC, created_at DESC
+	LIMIT $8 OFFSET $9;
+	`
+	offset := (query.Page - 1) * searchPageSize
+	rows, err := database.Dbpool.Query(ctx, searchAll,
+		query.Query, query.Type, query.Author, query.Category, from, to, viewer, searchPageSize+1, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (SearchResult, error) {
+		var res SearchResult
+		var parentType, parentSlug string
+		err := row.Scan(&res.Type, &res.ID, &res.Title, &parentType, &parentSlug,
+			&res.Author, &res.Snippet, &res.Rank, &res.CreatedAt)
+		if err != nil {
+			return SearchResult{}, err
+		}
+
+		res.Snippet = highlightSnippet(res.Snippet)
+		if parentType == "F" {
+			res.URL = forumURL(parentSlug)
+		} else {
+			res.URL = articleURL(parentSlug)
+		}
+		return res, nil
+	})
+}
+
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, "\x01", "<mark>")
+	return strings.ReplaceAll(snippet, "\x02", "</mark>")
+}
+
+func (p SearchPage) NextPage() int {
+	return p.Query.Page + 1
+}
+
+func (p SearchPage) PrevPage() int {
+	return p.Query.Page - 1
+}
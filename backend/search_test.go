@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		snippet string
+		want    string
+	}{
+		{"plain text", "plain text"},
+		{"a \x01match\x02 here", "a <mark>match</mark> here"},
+		{"\x01one\x02 and \x01two\x02", "<mark>one</mark> and <mark>two</mark>"},
+		{"<b>bold</b> \x01x\x02", "&lt;b&gt;bold&lt;/b&gt; <mark>x</mark>"},
+		{"<mark>fake</mark>", "&lt;mark&gt;fake&lt;/mark&gt;"},
+		{"\x01<script>\x02", "<mark>&lt;script&gt;</mark>"},
+	}
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.snippet); got != tt.want {
+			t.Errorf("highlightSnippet(%q) = %q, want %q", tt.snippet, got, tt.want)
+		}
+	}
+}
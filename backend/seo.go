@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+const metaDescriptionLength = 160
+
+// PageMeta fills the OpenGraph, Twitter card and canonical tags of meta.html
+type PageMeta struct {
+	Title       string
+	Description string
+	Canonical   string
+	Image       string
+	Type        string
+	Robots      string
+}
+
+// pageMetaer is implemented by template data that knows its own metadata,
+// renderHtml picks it up so handlers do not have to pass it around
+type pageMetaer interface {
+	pageMeta() PageMeta
+}
+
+var contentImage = regexp.MustCompile(`!\[[^\]]*\]\(([^)\s]+)|<img[^>]+src="([^"]+)"`)
+
+// firstImage returns the first markdown or html image in content
+func firstImage(content string) string {
+	m := contentImage.FindStringSubmatch(content)
+	if m == nil {
+		return ""
+	}
+	if m[1] != "" {
+		return m[1]
+	}
+	return m[2]
+}
+
+func (m PageMeta) TwitterCard() string {
+	if m.Image != "" {
+		return "summary_large_image"
+	}
+	return "summary"
+}
+
+// withBase turns site relative links into absolute ones, base is siteURL
+// like for feeds and the sitemap
+func (m PageMeta) withBase(base string) PageMeta {
+	if strings.HasPrefix(m.Canonical, "/") {
+		m.Canonical = base + m.Canonical
+	}
+	if strings.HasPrefix(m.Image, "/") {
+		m.Image = base + m.Image
+	}
+	return m
+}
+
+func (a Article) pageMeta() PageMeta {
+	meta := PageMeta{
+		Title:       a.Title,
+		Description: summarize(a.Content, metaDescriptionLength),
+		Canonical:   articleURL(a.Slug),
+		Image:       firstImage(a.Content),
+		Type:        "article",
+	}
+	if !a.IsPublished() {
+		meta.Robots = "noindex"
+	}
+	return meta
+}
+
+// private forums are only for members, they are never indexed
+func (p ForumPage) pageMeta() PageMeta {
+	meta := PageMeta{
+		Title:       p.Forum.Name,
+		Description: "Messages in the " + p.Forum.Name + " forum",
+		Canonical:   forumURL(p.Forum.Slug),
+		Image:       p.Forum.ImageURL(),
+		Type:        "website",
+	}
+	if p.Forum.Description != "" {
+		meta.Description = summarize(p.Forum.Description, 160)
+	}
+	if !p.Forum.Public {
+		meta.Robots = "noindex"
+	}
+	return meta
+}
+
+// a topic is described by its starter message
+func (p TopicPage) pageMeta() PageMeta {
+	meta := PageMeta{
+		Title:       p.Topic.Title + " - " + p.Forum.Name,
+		Description: "A topic in the " + p.Forum.Name + " forum",
+		Canonical:   topicURL(p.Forum.Slug, p.Topic.ID),
+		Image:       p.Forum.ImageURL(),
+		Type:        "article",
+	}
+	if len(p.Messages) > 0 {
+		meta.Description = summarize(p.Messages[0].Content, metaDescriptionLength)
+	}
+	if !p.Forum.Public {
+		meta.Robots = "noindex"
+	}
+	return meta
+}
+
+func (p TagPage) pageMeta() PageMeta {
+	return PageMeta{
+		Title:       "#" + p.Tag.Name,
+		Description: "Articles tagged " + p.Tag.Name,
+		Canonical:   "/tag/" + p.Tag.Slug,
+		Type:        "website",
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sameer-gits/CMS/database"
+)
+
+type Series struct {
+	ID                  uuid.UUID
+	Title               string
+	Slug                string
+	Description         string
+	CreatedByIdentifier uuid.UUID
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+type SeriesEntry struct {
+	ArticleID uuid.UUID `json:"article_id"`
+	Title     string    `json:"title"`
+	Slug      string    `json:"slug"`
+	Status    rune      `json:"-"`
+	Position  int       `json:"position"`
+	Read      bool      `json:"read"`
+	// the viewer is an owner or editor of the article
+	Editable bool `json:"-"`
+}
+
+type SeriesPage struct {
+	Series  Series
+	Entries []SeriesEntry
+	CanEdit bool
+}
+
+// SeriesNav is the place of an article in its series, for previous/next links
+type SeriesNav struct {
+	Series   Series
+	Position int
+	Total    int
+	Prev     *SeriesEntry
+	Next     *SeriesEntry
+}
+
+const seriesColumns = `series_id, title, series_slug, description, created_by_identifier, created_at, updated_at`
+
+func scanSeries(row pgx.Row) (Series, error) {
+	var s Series
+	err := row.Scan(&s.ID, &s.Title, &s.Slug, &s.Description, &s.CreatedByIdentifier, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
+func (e SeriesEntry) IsPublished() bool {
+	return e.Status == articlePublished
+}
+
+// Published counts the entries readers can see, drafts only show up for editors
+func (p SeriesPage) Published() int {
+	n := 0
+	for _, e := range p.Entries {
+		if e.IsPublished() {
+			n++
+		}
+	}
+	return n
+}
+
+func (p SeriesPage) ReadCount() int {
+	n := 0
+	for _, e := range p.Entries {
+		if e.IsPublished() && e.Read {
+			n++
+		}
+	}
+	return n
+}
+
+// Progress is the read share of published entries in percent
+func (p SeriesPage) Progress() int {
+	total := p.Published()
+	if total == 0 {
+		return 0
+	}
+	return p.ReadCount() * 100 / total
+}
+
+func (p SeriesPage) pageMeta() PageMeta {
+	description := p.Series.Description
+	if description == "" {
+		description = "Series " + p.Series.Title
+	}
+	return PageMeta{
+		Title:       p.Series.Title,
+		Description: summarize(description, metaDescriptionLength),
+		Canonical:   seriesURL(p.Series.Slug),
+		Type:        "website",
+	}
+}
+
+func (u DbUser) canEditSeries(series Series) bool {
+	return u.Role == 'A' || u.Identifier == series.CreatedByIdentifier
+}
+
+func viewSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, _, err := resolveSlug(ctx, slugSeries, r.PathValue("slug"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	page, err := seriesPage(ctx, r, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	renderHtml(w, r, page, nil, "series.html")
+}
+
+// seriesPage loads the series as seen by the logged in user, if any
+func seriesPage(ctx context.Context, r *http.Request, Id uuid.UUID) (SeriesPage, error) {
+	series, err := getSeries(ctx, Id)
+	if err != nil {
+		return SeriesPage{}, err
+	}
+
+	page := SeriesPage{Series: series}
+	viewer := uuid.Nil
+	user, err := userInfoMiddleware(r)
+	if err == nil {
+		viewer = user.Identifier
+		page.CanEdit = user.canEditSeries(series)
+	}
+
+	page.Entries, err = listSeriesEntries(ctx, series.ID, page.CanEdit, viewer)
+	if err != nil {
+		return SeriesPage{}, err
+	}
+
+	return page, nil
+}
+
+func newSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+	renderHtml(w, r, Series{}, nil, "seriesEdit.html")
+}
+
+func createSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var series Series
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, series, errs, "seriesEdit.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, seriesURL(series.Slug), http.StatusFound)
+		}
+	}()
+
+	series, errs = seriesFromForm(r)
+	if errs != nil {
+		return
+	}
+	series.CreatedByIdentifier = user.Identifier
+
+	created, err := series.create(ctx)
+	if err != nil {
+		errs = append(errs, errors.New("error creating series, try again"))
+		return
+	}
+	series = created
+}
+
+func editSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var series Series
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, series, errs, "seriesEdit.html")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		errs = append(errs, errors.New("series not found"))
+		return
+	}
+
+	series, err = getSeries(ctx, Id)
+	if err != nil {
+		errs = append(errs, errors.New("series not found"))
+		return
+	}
+
+	if !user.canEditSeries(series) {
+		series = Series{}
+		errs = append(errs, errors.New("you are not allowed to edit this series"))
+		return
+	}
+}
+
+func updateSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var series Series
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, series, errs, "seriesEdit.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, seriesURL(series.Slug), http.StatusFound)
+		}
+	}()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		errs = append(errs, errors.New("series not found"))
+		return
+	}
+
+	existing, err := getSeries(ctx, Id)
+	if err != nil {
+		errs = append(errs, errors.New("series not found"))
+		return
+	}
+
+	if !user.canEditSeries(existing) {
+		errs = append(errs, errors.New("you are not allowed to edit this series"))
+		return
+	}
+
+	series, errs = seriesFromForm(r)
+	series.ID = existing.ID
+	series.Slug = existing.Slug
+	if errs != nil {
+		return
+	}
+
+	updated, err := series.update(ctx)
+	if err != nil {
+		errs = append(errs, errors.New("error saving series, try again"))
+		return
+	}
+	series = updated
+}
+
+// seriesAction loads the series of a series form and checks the user may edit it,
+// action returns the errors shown on the series page
+func seriesAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, user DbUser, series Series) []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	series, err := getSeries(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	var errs []error
+	if !user.canEditSeries(series) {
+		errs = append(errs, errors.New("you are not allowed to edit this series"))
+	} else {
+		errs = action(ctx, user, series)
+	}
+
+	if len(errs) > 0 {
+		page, err := seriesPage(ctx, r, series.ID)
+		if err != nil {
+			page = SeriesPage{Series: series}
+		}
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "series.html")
+		return
+	}
+
+	http.Redirect(w, r, seriesURL(series.Slug), http.StatusFound)
+}
+
+// addSeriesArticleHandler appends an article by its slug or link, only
+// articles the user may edit can join a series
+func addSeriesArticleHandler(w http.ResponseWriter, r *http.Request) {
+	seriesAction(w, r, func(ctx context.Context, user DbUser, series Series) []error {
+		var errs []error
+
+		slug := strings.TrimSpace(r.FormValue("article"))
+		if i := strings.LastIndex(slug, "/a/"); i >= 0 {
+			slug = slug[i+len("/a/"):]
+		}
+		slug = strings.Trim(slug, "/")
+		if slug == "" {
+			return append(errs, errors.New("please provide article link or slug"))
+		}
+
+		articleID, _, err := resolveSlug(ctx, slugArticle, slug)
+		if err != nil {
+			return append(errs, errors.New("article not found"))
+		}
+
+		article, err := getArticle(ctx, articleID)
+		if err != nil {
+			return append(errs, errors.New("article not found"))
+		}
+
+		if !user.canEditArticle(article) {
+			return append(errs, errors.New("you can only add articles you are allowed to edit"))
+		}
+
+		err = addSeriesArticle(ctx, series.ID, article.ID)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return append(errs, errors.New("article is already part of a series"))
+		} else if err != nil {
+			return append(errs, errors.New("error adding article, try again"))
+		}
+		return nil
+	})
+}
+
+func removeSeriesArticleHandler(w http.ResponseWriter, r *http.Request) {
+	seriesAction(w, r, func(ctx context.Context, user DbUser, series Series) []error {
+		var errs []error
+
+		articleID, err := uuid.Parse(r.PathValue("article"))
+		if err != nil {
+			return append(errs, errors.New("article not found"))
+		}
+
+		remove := `DELETE FROM series_articles WHERE series_id = $1 AND article_id = $2`
+		_, err = database.Dbpool.Exec(ctx, remove, series.ID, articleID)
+		if err != nil {
+			return append(errs, errors.New("error removing article, try again"))
+		}
+		return nil
+	})
+}
+
+// reorderSeriesApiHandler takes {"articles": [id, ...]} in the new order,
+// it is called by drag and drop on the series page
+func reorderSeriesApiHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Articles []uuid.UUID `json:"articles"`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		renderJson(w, unauthorized, map[string]string{"error": "please login to reorder series"})
+		return
+	}
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		renderJson(w, notFound, map[string]string{"error": "series not found"})
+		return
+	}
+
+	series, err := getSeries(ctx, Id)
+	if err != nil {
+		renderJson(w, notFound, map[string]string{"error": "series not found"})
+		return
+	}
+
+	if !user.canEditSeries(series) {
+		renderJson(w, forbidden, map[string]string{"error": "you are not allowed to edit this series"})
+		return
+	}
+
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body)
+	if err != nil || len(body.Articles) == 0 {
+		renderJson(w, badCode, map[string]string{"error": "please provide articles in the new order"})
+		return
+	}
+
+	err = reorderSeries(ctx, series.ID, body.Articles)
+	if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error reordering series, try again"})
+		return
+	}
+
+	entries, err := listSeriesEntries(ctx, series.ID, true, user.Identifier)
+	if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error getting series, try again"})
+		return
+	}
+	renderJson(w, statusOK, entries)
+}
+
+func seriesFromForm(r *http.Request) (Series, []error) {
+	var errs []error
+
+	series := Series{
+		Title:       strings.TrimSpace(r.FormValue("title")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+	}
+
+	if series.Title == "" {
+		errs = append(errs, errors.New("please provide title"))
+	} else if countCharacters(series.Title) > 256 {
+		errs = append(errs, errors.New("title should be less than 256 characters"))
+	}
+
+	if countCharacters(series.Description) > 2000 {
+		errs = append(errs, errors.New("description should be less than 2000 characters"))
+	}
+
+	return series, errs
+}
+
+func (series Series) create(ctx context.Context) (Series, error) {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return Series{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	slug, err := uniqueSlug(ctx, tx, slugSeries, slugify(series.Title, 256), uuid.Nil, 256)
+	if err != nil {
+		return Series{}, err
+	}
+
+	insertSeries := `INSERT INTO series (title, series_slug, description, created_by_identifier)
+                     VALUES ($1, $2, $3, $4)
+                     RETURNING ` + seriesColumns
+	result, err := scanSeries(tx.QueryRow(ctx, insertSeries, series.Title, slug, series.Description, series.CreatedByIdentifier))
+	if err != nil {
+		return Series{}, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return Series{}, err
+	}
+
+	return result, nil
+}
+
+func (series Series) update(ctx context.Context) (Series, error) {
+	updateSeries := `UPDATE series SET title = $2, description = $3, updated_at = CURRENT_TIMESTAMP
+                     WHERE series_id = $1
+                     RETURNING ` + seriesColumns
+	return scanSeries(database.Dbpool.QueryRow(ctx, updateSeries, series.ID, series.Title, series.Description))
+}
+
+func getSeries(ctx context.Context, Id uuid.UUID) (Series, error) {
+	get := `SELECT ` + seriesColumns + ` FROM series WHERE series_id = $1`
+	return scanSeries(database.Dbpool.QueryRow(ctx, get, Id))
+}
+
+// listSeriesEntries returns articles in series order, drafts only when all is set,
+// Read is set for articles viewer has opened
+func listSeriesEntries(ctx context.Context, seriesID uuid.UUID, all bool, viewer uuid.UUID) ([]SeriesEntry, error) {
+	list := `
+	SELECT a.article_id, a.title, a.slug, a.status, sa.position,
+	       EXISTS (SELECT 1 FROM series_reads sr WHERE sr.article_id = a.article_id AND sr.user_identifier = $3),
+	       EXISTS (SELECT 1 FROM article_authors aa WHERE aa.article_id = a.article_id AND aa.user_identifier = $3
+	               AND aa.accepted AND aa.role IN ('O', 'E'))
+	FROM series_articles sa
+	JOIN articles a ON a.article_id = sa.article_id
+	WHERE sa.series_id = $1 AND a.deleted_at IS NULL AND ($2::boolean OR a.status = 'P')
+	ORDER BY sa.position, a.created_at;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, seriesID, all, viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (SeriesEntry, error) {
+		var e SeriesEntry
+		var status string
+		err := row.Scan(&e.ArticleID, &e.Title, &e.Slug, &status, &e.Position, &e.Read, &e.Editable)
+		e.Status = firstRune(status)
+		return e, err
+	})
+}
+
+func addSeriesArticle(ctx context.Context, seriesID, articleID uuid.UUID) error {
+	add := `INSERT INTO series_articles (series_id, article_id, position)
+            VALUES ($1, $2, (SELECT COALESCE(MAX(position) + 1, 0) FROM series_articles WHERE series_id = $1))`
+	_, err := database.Dbpool.Exec(ctx, add, seriesID, articleID)
+	if err != nil {
+		return err
+	}
+
+	touch := `UPDATE series SET updated_at = CURRENT_TIMESTAMP WHERE series_id = $1`
+	_, err = database.Dbpool.Exec(ctx, touch, seriesID)
+	return err
+}
+
+// reorderSeries sets positions from order, the first article is part one
+func reorderSeries(ctx context.Context, seriesID uuid.UUID, order []uuid.UUID) error {
+	reorder := `
+	UPDATE series_articles sa
+	SET position = o.ord - 1
+	FROM unnest($2::uuid[]) WITH ORDINALITY AS o(id, ord)
+	WHERE sa.series_id = $1 AND sa.article_id = o.id;
+	`
+	_, err := database.Dbpool.Exec(ctx, reorder, seriesID, order)
+	if err != nil {
+		return err
+	}
+
+	touch := `UPDATE series SET updated_at = CURRENT_TIMESTAMP WHERE series_id = $1`
+	_, err = database.Dbpool.Exec(ctx, touch, seriesID)
+	return err
+}
+
+// getSeriesNav finds the series of an article and its neighbours as viewer
+// sees them, nil when the article is not part of any series
+func getSeriesNav(ctx context.Context, article Article, viewer DbUser) (*SeriesNav, error) {
+	var seriesID uuid.UUID
+	getSeriesID := `SELECT series_id FROM series_articles WHERE article_id = $1`
+	err := database.Dbpool.QueryRow(ctx, getSeriesID, article.ID).Scan(&seriesID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	series, err := getSeries(ctx, seriesID)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := listSeriesEntries(ctx, seriesID, true, viewer.Identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	// a draft shows among the published parts when it is the one being
+	// previewed or the viewer may edit it, reading one draft of the series
+	// does not reveal the others
+	var entries []SeriesEntry
+	for _, e := range all {
+		if e.Status == 'P' || e.ArticleID == article.ID || e.Editable || viewer.Role == 'A' {
+			entries = append(entries, e)
+		}
+	}
+
+	nav := &SeriesNav{Series: series, Total: len(entries)}
+	for i, e := range entries {
+		if e.ArticleID != article.ID {
+			continue
+		}
+		nav.Position = i + 1
+		if i > 0 {
+			nav.Prev = &entries[i-1]
+		}
+		if i < len(entries)-1 {
+			nav.Next = &entries[i+1]
+		}
+	}
+	return nav, nil
+}
+
+// markSeriesRead remembers that a user opened an article, for series progress
+func markSeriesRead(ctx context.Context, identifier, articleID uuid.UUID) error {
+	mark := `INSERT INTO series_reads (user_identifier, article_id) VALUES ($1, $2)
+             ON CONFLICT (user_identifier, article_id) DO NOTHING`
+	_, err := database.Dbpool.Exec(ctx, mark, identifier, articleID)
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// sitemaps are limited to 50k urls, past that /sitemap.xml becomes an index
+const sitemapMaxURLs = 50000
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// every public page, private forums and unpublished articles are never listed
+const sitemapPages = `
+	SELECT path, lastmod FROM (
+	    SELECT '/a/' || slug AS path, updated_at AS lastmod, 1 AS kind FROM articles WHERE status = 'P' AND deleted_at IS NULL
+	    UNION ALL
+	    SELECT '/f/' || forum_slug, created_at, 2 FROM forums WHERE public AND deleted_at IS NULL
+	    UNION ALL
+	    SELECT '/f/' || f.forum_slug || '/t/' || t.topic_id, t.last_reply_at, 5 FROM forum_topics t
+	    JOIN forums f ON f.forum_id = t.forum_id
+	    WHERE f.public AND f.deleted_at IS NULL
+	    UNION ALL
+	    SELECT '/tag/' || tag_slug, created_at, 3 FROM tags t
+	    WHERE EXISTS (
+	        SELECT 1 FROM article_tags at JOIN articles a ON a.article_id = at.article_id
+	        WHERE at.tag_id = t.tag_id AND a.status = 'P' AND a.deleted_at IS NULL)
+	    UNION ALL
+	    SELECT '/s/' || series_slug, updated_at, 4 FROM series s
+	    WHERE EXISTS (
+	        SELECT 1 FROM series_articles sa JOIN articles a ON a.article_id = sa.article_id
+	        WHERE sa.series_id = s.series_id AND a.status = 'P' AND a.deleted_at IS NULL)
+	) pages`
+
+var sitemapStaticPaths = []string{"/", "/articles", "/tags", "/forums"}
+
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var total int
+	err := database.Dbpool.QueryRow(ctx, `SELECT COUNT(*) FROM (`+sitemapPages+`) counted`).Scan(&total)
+	if err != nil {
+		http.Error(w, "error building sitemap", serverCode)
+		return
+	}
+	total += len(sitemapStaticPaths)
+
+	if total <= sitemapMaxURLs {
+		writeSitemapPage(ctx, w, r, 1)
+		return
+	}
+
+	base := siteURL(r)
+	var index sitemapIndex
+	for page := 1; (page-1)*sitemapMaxURLs < total; page++ {
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{Loc: fmt.Sprintf("%s/sitemap/%d.xml", base, page)})
+	}
+	writeXml(w, index)
+}
+
+func sitemapPageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	page, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("page"), ".xml"))
+	if err != nil || page < 1 {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+	writeSitemapPage(ctx, w, r, page)
+}
+
+// writeSitemapPage writes urls of one page, the static pages lead the first one
+func writeSitemapPage(ctx context.Context, w http.ResponseWriter, r *http.Request, page int) {
+	base := siteURL(r)
+	var set sitemapURLSet
+
+	offset := (page - 1) * sitemapMaxURLs
+	limit := sitemapMaxURLs
+	if page == 1 {
+		for _, p := range sitemapStaticPaths {
+			set.URLs = append(set.URLs, sitemapURL{Loc: base + p})
+		}
+		limit -= len(sitemapStaticPaths)
+	} else {
+		offset -= len(sitemapStaticPaths)
+	}
+
+	rows, err := database.Dbpool.Query(ctx, sitemapPages+` ORDER BY kind, path LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		http.Error(w, "error building sitemap", serverCode)
+		return
+	}
+
+	urls, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (sitemapURL, error) {
+		var path string
+		var lastmod time.Time
+		err := row.Scan(&path, &lastmod)
+		return sitemapURL{Loc: base + path, LastMod: lastmod.UTC().Format("2006-01-02")}, err
+	})
+	if err != nil {
+		http.Error(w, "error building sitemap", serverCode)
+		return
+	}
+
+	if page > 1 && len(urls) == 0 {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	set.URLs = append(set.URLs, urls...)
+	writeXml(w, set)
+}
+
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	robots := "User-agent: *\n" +
+		"Disallow: /api/\n" +
+		"Disallow: /login\n" +
+		"Disallow: /logout\n" +
+		"Disallow: /verify\n" +
+		"Disallow: /user\n" +
+		"Disallow: /article/\n" +
+		"Disallow: /websocket/\n" +
+		"\n" +
+		"Sitemap: " + siteURL(r) + "/sitemap.xml\n"
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(robots))
+}
+
+func writeXml(w http.ResponseWriter, doc interface{}) {
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		http.Error(w, "error encoding xml", serverCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
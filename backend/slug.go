@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	slugArticle = 'A'
+	slugForum   = 'F'
+	slugSeries  = 'S'
+)
+
+var errSlugTaken = errors.New("slug already taken")
+
+// dbQuerier is satisfied by both the pool and a transaction
+type dbQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// letters that do not decompose into ascii + accent
+var translit = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'ł': "l", 'þ': "th", 'ı': "i",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh", 'з': "z",
+	'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+	'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g",
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th", 'ι': "i",
+	'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s",
+	'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+}
+
+// slugify lowercases s, transliterates what it can to ascii and joins words
+// with "-". Letters with no ascii form (e.g. CJK) are kept as they are.
+func slugify(s string, maxLen int) string {
+	// transliterate before stripping accents, 'й' would become 'и' otherwise.
+	// Letters missing from the map are looked up without their accent so
+	// 'ή' goes the way of 'η'.
+	var t strings.Builder
+	for _, r := range norm.NFC.String(strings.ToLower(s)) {
+		if tr, ok := translit[r]; ok {
+			t.WriteString(tr)
+		} else if tr, ok := translit[[]rune(norm.NFD.String(string(r)))[0]]; ok {
+			t.WriteString(tr)
+		} else {
+			t.WriteRune(r)
+		}
+	}
+
+	stripMarks := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	s, _, err := transform.String(stripMarks, t.String())
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	dash := false
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			dash = false
+		default:
+			if b.Len() > 0 && !dash {
+				b.WriteRune('-')
+				dash = true
+			}
+		}
+	}
+
+	slug := strings.Trim(b.String(), "-")
+	for countCharacters(slug) > maxLen {
+		// drop whole words first so slugs do not end mid word
+		i := strings.LastIndex(slug, "-")
+		if i <= 0 {
+			slug = string([]rune(slug)[:maxLen])
+			break
+		}
+		slug = slug[:i]
+	}
+	return slug
+}
+
+func slugTable(inTable rune) (table, idColumn, slugColumn string) {
+	switch inTable {
+	case slugForum:
+		return "forums", "forum_id", "forum_slug"
+	case slugSeries:
+		return "series", "series_id", "series_slug"
+	}
+	return "articles", "article_id", "slug"
+}
+
+// slugInUse reports whether slug is current or historic for anything other than id
+func slugInUse(ctx context.Context, q dbQuerier, inTable rune, slug string, id uuid.UUID) (bool, error) {
+	var exists bool
+	table, idColumn, slugColumn := slugTable(inTable)
+
+	check := fmt.Sprintf(`
+	SELECT EXISTS (SELECT 1 FROM %s WHERE %s = $1 AND %s <> $2)
+	    OR EXISTS (SELECT 1 FROM slug_redirects WHERE in_table = $3 AND old_slug = $1 AND in_table_id <> $2);
+	`, table, slugColumn, idColumn)
+	err := q.QueryRow(ctx, check, slug, id, string(inTable)).Scan(&exists)
+	return exists, err
+}
+
+// uniqueSlug appends -2, -3, ... to base until nothing else owns it
+func uniqueSlug(ctx context.Context, q dbQuerier, inTable rune, base string, id uuid.UUID, maxLen int) (string, error) {
+	if base == "" {
+		base = "untitled"
+	}
+
+	slug := base
+	for n := 2; ; n++ {
+		taken, err := slugInUse(ctx, q, inTable, slug, id)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+		if n > 100 {
+			return "", errSlugTaken
+		}
+
+		suffix := fmt.Sprintf("-%d", n)
+		slug = slugify(base, maxLen-len(suffix)) + suffix
+	}
+}
+
+// changeSlug moves id to a new slug and keeps the old one for redirects
+func changeSlug(ctx context.Context, inTable rune, id uuid.UUID, newSlug string) error {
+	var oldSlug string
+	table, idColumn, slugColumn := slugTable(inTable)
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	getOld := fmt.Sprintf(`SELECT %s FROM %s WHERE %s = $1 FOR UPDATE`, slugColumn, table, idColumn)
+	err = tx.QueryRow(ctx, getOld, id).Scan(&oldSlug)
+	if err != nil {
+		return err
+	}
+
+	if oldSlug == newSlug {
+		return nil
+	}
+
+	taken, err := slugInUse(ctx, tx, inTable, newSlug, id)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errSlugTaken
+	}
+
+	// going back to an older slug takes it out of the history
+	_, err = tx.Exec(ctx, `DELETE FROM slug_redirects WHERE in_table = $1 AND old_slug = $2`, string(inTable), newSlug)
+	if err != nil {
+		return err
+	}
+
+	insertRedirect := `INSERT INTO slug_redirects (in_table, old_slug, in_table_id) VALUES ($1, $2, $3)`
+	_, err = tx.Exec(ctx, insertRedirect, string(inTable), oldSlug, id)
+	if err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE %s = $2`, table, slugColumn, idColumn)
+	_, err = tx.Exec(ctx, update, newSlug, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// resolveSlug finds the id behind slug, current is false for a historic slug
+func resolveSlug(ctx context.Context, inTable rune, slug string) (id uuid.UUID, current bool, err error) {
+	table, idColumn, slugColumn := slugTable(inTable)
+
+	getCurrent := fmt.Sprintf(`SELECT %s FROM %s WHERE %s = $1`, idColumn, table, slugColumn)
+	err = database.Dbpool.QueryRow(ctx, getCurrent, slug).Scan(&id)
+	if err == nil {
+		return id, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, false, err
+	}
+
+	getOld := `SELECT in_table_id FROM slug_redirects WHERE in_table = $1 AND old_slug = $2`
+	err = database.Dbpool.QueryRow(ctx, getOld, string(inTable), slug).Scan(&id)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	return id, false, nil
+}
+
+func articleURL(slug string) string {
+	return "/a/" + slug
+}
+
+func forumURL(slug string) string {
+	return "/f/" + slug
+}
+
+func topicURL(forumSlug string, topicID uuid.UUID) string {
+	return "/f/" + forumSlug + "/t/" + topicID.String()
+}
+
+func seriesURL(slug string) string {
+	return "/s/" + slug
+}
+
+// articleIdRedirectHandler keeps the old /article/{id} links working
+func articleIdRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	article, err := getArticle(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	http.Redirect(w, r, articleURL(article.Slug), http.StatusMovedPermanently)
+}
+
+// forumIdRedirectHandler keeps the old /forum/{id} links working
+func forumIdRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	forum, err := getForum(ctx, Id)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	http.Redirect(w, r, forumURL(forum.Slug), http.StatusMovedPermanently)
+}
+
+func editArticleSlugHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var article Article
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, article, errs, "article.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, articleURL(article.Slug), http.StatusFound)
+		}
+	}()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	article, err = getArticle(ctx, Id)
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	if !user.canEditArticle(article) {
+		errs = append(errs, errors.New("you are not allowed to edit this article"))
+		return
+	}
+
+	slug := slugify(r.FormValue("slug"), 256)
+	if slug == "" {
+		errs = append(errs, errors.New("slug should contain letters or numbers"))
+		return
+	}
+
+	err = changeSlug(ctx, slugArticle, article.ID, slug)
+	if errors.Is(err, errSlugTaken) {
+		errs = append(errs, errors.New("slug already used by another article"))
+		return
+	} else if err != nil {
+		errs = append(errs, errors.New("error changing slug, try again"))
+		return
+	}
+	article.Slug = slug
+}
+
+// editForumSlugHandler changes the forum slug from the settings page, the
+// old one keeps redirecting
+func editForumSlugHandler(w http.ResponseWriter, r *http.Request) {
+	settingsAction(w, r, func(ctx context.Context, user DbUser, page ForumSettingsPage) []error {
+		var errs []error
+
+		slug := slugify(r.FormValue("slug"), 128)
+		if slug == "" {
+			return append(errs, errors.New("slug should contain letters or numbers"))
+		}
+
+		err := changeSlug(ctx, slugForum, page.Forum.ID, slug)
+		if errors.Is(err, errSlugTaken) {
+			return append(errs, errors.New("slug already used by another forum"))
+		} else if err != nil {
+			return append(errs, errors.New("error changing slug, try again"))
+		}
+		return nil
+	})
+}
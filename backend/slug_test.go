@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		in     string
+		maxLen int
+		want   string
+	}{
+		{"Hello, World!", 128, "hello-world"},
+		{"  many   spaces  ", 128, "many-spaces"},
+		{"Йогурт и ёж", 128, "yogurt-i-ezh"},
+		{"Їжак", 128, "yizhak"},
+		{"Straße Café", 128, "strasse-cafe"},
+		{"Crème brûlée", 128, "creme-brulee"},
+		{"Łódź", 128, "lodz"},
+		{"Αθήνα", 128, "athina"},
+		{"日本 語", 128, "日本-語"},
+		{"!!!", 128, ""},
+		{"one two three", 8, "one-two"},
+		{"abcdefghij", 4, "abcd"},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.in, tt.maxLen); got != tt.want {
+			t.Errorf("slugify(%q, %d) = %q, want %q", tt.in, tt.maxLen, got, tt.want)
+		}
+	}
+}
@@ -1,7 +1,33 @@
+DROP TABLE IF EXISTS article_referrers;
+
+DROP TABLE IF EXISTS article_views;
+
+DROP TABLE IF EXISTS article_reaction_counts;
+
+DROP TABLE IF EXISTS bookmarks;
+
+DROP TABLE IF EXISTS article_reactions;
+
+DROP TABLE IF EXISTS series_reads;
+
+DROP TABLE IF EXISTS series_articles;
+
+DROP TABLE IF EXISTS series;
+
+DROP TABLE IF EXISTS article_authors;
+
+DROP TABLE IF EXISTS article_tags;
+
+DROP TABLE IF EXISTS tags;
+
 DROP TABLE IF EXISTS articles;
 
 DROP TABLE IF EXISTS categories;
 
+DROP TABLE IF EXISTS imports;
+
+DROP TABLE IF EXISTS forum_pins;
+
 DROP TABLE IF EXISTS messages;
 
 DROP TABLE IF EXISTS poll_votes;
@@ -16,11 +42,41 @@ DROP TABLE IF EXISTS forum_admins;
 
 DROP TABLE IF EXISTS forum_mods;
 
+DROP TABLE IF EXISTS forum_announcements;
+
+DROP TABLE IF EXISTS forum_topic_reads;
+
+DROP TABLE IF EXISTS forum_topics;
+
+DROP TABLE IF EXISTS forum_sanctions;
+
+DROP TABLE IF EXISTS forum_join_requests;
+
+DROP TABLE IF EXISTS forum_invite_links;
+
+DROP TABLE IF EXISTS forum_invites;
+
+DROP TABLE IF EXISTS notifications;
+
 DROP TABLE IF EXISTS forums;
 
+DROP TABLE IF EXISTS forum_sections;
+
+DROP TABLE IF EXISTS slug_redirects;
+
+DROP TABLE IF EXISTS user_media;
+
 DROP TABLE IF EXISTS users;
 
+DROP FUNCTION IF EXISTS sync_article_author;
+
+DROP TABLE IF EXISTS media;
+
 -- index
+DROP INDEX IF EXISTS idx_uploaded_by_identifier_media;
+
+DROP INDEX IF EXISTS idx_user_identifier_user_media;
+
 DROP INDEX IF EXISTS idx_username_users;
 
 DROP INDEX IF EXISTS idx_user_identifier_users;
@@ -31,6 +87,24 @@ DROP INDEX IF EXISTS idx_title_articles;
 
 DROP INDEX IF EXISTS idx_author_identifier_articles;
 
+DROP INDEX IF EXISTS idx_published_at_articles;
+
+DROP INDEX IF EXISTS idx_publish_at_articles;
+
+DROP INDEX IF EXISTS idx_unpublish_at_articles;
+
+DROP INDEX IF EXISTS idx_search_vector_articles;
+
+DROP INDEX IF EXISTS idx_tag_slug_pattern_tags;
+
+DROP INDEX IF EXISTS idx_tag_id_article_tags;
+
+DROP INDEX IF EXISTS idx_user_identifier_article_authors;
+
+DROP INDEX IF EXISTS idx_series_id_position_series_articles;
+
+DROP INDEX IF EXISTS idx_article_id_bookmarks;
+
 DROP INDEX IF EXISTS idx_author_identifier_messages;
 
 DROP INDEX IF EXISTS idx_reply_to_identifier_messages;
@@ -41,6 +115,12 @@ DROP INDEX IF EXISTS idx_in_table_id_messages;
 
 DROP INDEX IF EXISTS idx_forum_name_forums;
 
+DROP INDEX IF EXISTS idx_search_vector_messages;
+
+DROP INDEX IF EXISTS idx_search_vector_forums;
+
+DROP INDEX IF EXISTS idx_in_table_id_slug_redirects;
+
 DROP INDEX IF EXISTS idx_forum_id_users_forums;
 
 DROP INDEX IF EXISTS idx_forum_id_admins_forums;
@@ -51,4 +131,10 @@ DROP INDEX IF EXISTS idx_poll_id_polls;
 
 DROP INDEX IF EXISTS idx_poll_id_options;
 
-DROP INDEX IF EXISTS idx_poll_id_votes;
\ No newline at end of file
+DROP INDEX IF EXISTS idx_poll_id_votes;
+
+DROP INDEX IF EXISTS idx_parent_id_messages;
+
+DROP INDEX IF EXISTS idx_root_id_messages;
+
+DROP INDEX IF EXISTS idx_roots_messages;
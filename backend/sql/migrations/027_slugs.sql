@@ -0,0 +1,50 @@
+-- slugs for databases created before them. Article titles are no longer
+-- unique, existing articles and forums get a slug from their title or name.
+-- This keeps letters and digits only without transliterating, renaming
+-- doesn't change a slug so fix odd ones from the slug form of the article
+-- or forum. Clashing slugs get the start of the row id appended.
+ALTER TABLE articles DROP CONSTRAINT IF EXISTS articles_title_key;
+
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS slug VARCHAR(256);
+
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS forum_slug VARCHAR(128);
+
+WITH base AS (
+    SELECT article_id,
+           COALESCE(NULLIF(trim(BOTH '-' FROM regexp_replace(lower(title), '[^[:alnum:]]+', '-', 'g')), ''), 'article') AS slug
+    FROM articles WHERE slug IS NULL
+), numbered AS (
+    SELECT article_id, slug, ROW_NUMBER() OVER (PARTITION BY slug ORDER BY article_id) AS n FROM base
+)
+UPDATE articles a
+SET slug = CASE WHEN n.n = 1 THEN left(n.slug, 256) ELSE left(n.slug, 247) || '-' || left(a.article_id::text, 8) END
+FROM numbered n WHERE n.article_id = a.article_id;
+
+WITH base AS (
+    SELECT forum_id,
+           COALESCE(NULLIF(trim(BOTH '-' FROM regexp_replace(lower(forum_name), '[^[:alnum:]]+', '-', 'g')), ''), 'forum') AS slug
+    FROM forums WHERE forum_slug IS NULL
+), numbered AS (
+    SELECT forum_id, slug, ROW_NUMBER() OVER (PARTITION BY slug ORDER BY forum_id) AS n FROM base
+)
+UPDATE forums f
+SET forum_slug = CASE WHEN n.n = 1 THEN left(n.slug, 128) ELSE left(n.slug, 119) || '-' || left(f.forum_id::text, 8) END
+FROM numbered n WHERE n.forum_id = f.forum_id;
+
+ALTER TABLE articles ALTER COLUMN slug SET NOT NULL;
+
+ALTER TABLE forums ALTER COLUMN forum_slug SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS articles_slug_key ON articles (slug);
+
+CREATE UNIQUE INDEX IF NOT EXISTS forums_forum_slug_key ON forums (forum_slug);
+
+CREATE TABLE IF NOT EXISTS slug_redirects (
+    in_table CHAR CHECK (in_table IN ('F', 'A')) NOT NULL,
+    old_slug VARCHAR(256) NOT NULL,
+    in_table_id UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (in_table, old_slug)
+);
+
+CREATE INDEX IF NOT EXISTS idx_in_table_id_slug_redirects ON slug_redirects (in_table_id);
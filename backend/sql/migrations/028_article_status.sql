@@ -0,0 +1,25 @@
+-- publishing states for databases created before them. Articles written
+-- before drafts existed were public, they start out published.
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS status CHAR CHECK (status IN ('D', 'P', 'U')) NOT NULL DEFAULT 'P';
+
+ALTER TABLE articles ALTER COLUMN status SET DEFAULT 'D';
+
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS publish_at TIMESTAMP;
+
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS unpublish_at TIMESTAMP;
+
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS published_at TIMESTAMP;
+
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+
+UPDATE articles SET updated_at = created_at WHERE updated_at IS NULL;
+
+ALTER TABLE articles ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP;
+
+UPDATE articles SET published_at = created_at WHERE status = 'P' AND published_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_published_at_articles ON articles (published_at) WHERE status = 'P';
+
+CREATE INDEX IF NOT EXISTS idx_publish_at_articles ON articles (publish_at) WHERE status = 'D';
+
+CREATE INDEX IF NOT EXISTS idx_unpublish_at_articles ON articles (unpublish_at) WHERE status = 'P';
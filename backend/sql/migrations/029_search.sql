@@ -0,0 +1,15 @@
+-- full text search for databases created before it, generated columns fill
+-- in for existing rows when added
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', content), 'B')
+) STORED;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', forum_name)) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_search_vector_articles ON articles USING GIN (search_vector);
+
+CREATE INDEX IF NOT EXISTS idx_search_vector_messages ON messages USING GIN (search_vector);
+
+CREATE INDEX IF NOT EXISTS idx_search_vector_forums ON forums USING GIN (search_vector);
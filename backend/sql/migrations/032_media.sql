@@ -0,0 +1,20 @@
+-- media library for databases created before it existed,
+-- run "go run . migrate-media" afterwards to move the old images
+CREATE TABLE IF NOT EXISTS media (
+    media_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    checksum CHAR(64) NOT NULL UNIQUE,
+    storage_key VARCHAR(256) NOT NULL,
+    content_type VARCHAR(128) NOT NULL,
+    size BIGINT NOT NULL,
+    filename VARCHAR(256) NOT NULL,
+    uploaded_by_identifier UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_uploaded_by_identifier_media ON media (uploaded_by_identifier, created_at DESC);
+
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS profile_media_id UUID REFERENCES media (media_id) ON DELETE SET NULL;
+
+ALTER TABLE forums
+ADD COLUMN IF NOT EXISTS forum_media_id UUID REFERENCES media (media_id) ON DELETE SET NULL;
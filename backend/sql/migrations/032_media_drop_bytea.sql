@@ -0,0 +1,4 @@
+-- only after "go run . migrate-media" moved every image
+ALTER TABLE users DROP COLUMN IF EXISTS profile_image;
+
+ALTER TABLE forums DROP COLUMN IF EXISTS forum_image;
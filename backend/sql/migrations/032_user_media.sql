@@ -0,0 +1,16 @@
+-- per user media libraries for databases created before them, every file
+-- starts out in the library of whoever stored it first
+CREATE TABLE IF NOT EXISTS user_media (
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    media_id UUID REFERENCES media (media_id) ON DELETE CASCADE,
+    filename VARCHAR(256) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_identifier, media_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identifier_user_media ON user_media (user_identifier, created_at DESC);
+
+INSERT INTO user_media (user_identifier, media_id, filename, created_at)
+SELECT m.uploaded_by_identifier, m.media_id, m.filename, m.created_at
+FROM media m JOIN users u ON u.user_identifier = m.uploaded_by_identifier
+ON CONFLICT DO NOTHING;
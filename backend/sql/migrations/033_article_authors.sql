@@ -0,0 +1,30 @@
+-- co-authors for databases created before them, every existing
+-- article gets its author as accepted owner
+CREATE TABLE IF NOT EXISTS article_authors (
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    role CHAR CHECK (role IN ('O', 'E', 'V')) NOT NULL DEFAULT 'E',
+    position SMALLINT NOT NULL DEFAULT 0,
+    accepted BOOLEAN NOT NULL DEFAULT FALSE,
+    invited_by_identifier UUID,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (article_id, user_identifier)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identifier_article_authors ON article_authors (user_identifier);
+
+INSERT INTO article_authors (article_id, user_identifier, role, position, accepted)
+SELECT article_id, author_identifier, 'O', 0, TRUE FROM articles
+ON CONFLICT DO NOTHING;
+
+CREATE OR REPLACE FUNCTION sync_article_author () RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE articles SET author = NEW.username WHERE author_identifier = NEW.user_identifier;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER trg_username_articles
+AFTER UPDATE OF username ON users
+FOR EACH ROW WHEN (OLD.username IS DISTINCT FROM NEW.username)
+EXECUTE FUNCTION sync_article_author ();
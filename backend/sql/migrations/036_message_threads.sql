@@ -0,0 +1,13 @@
+-- threaded replies for databases created before them, existing
+-- messages all become top level
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_id UUID REFERENCES messages (message_id) ON DELETE CASCADE;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS root_id UUID;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS depth SMALLINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_parent_id_messages ON messages (parent_id);
+
+CREATE INDEX IF NOT EXISTS idx_root_id_messages ON messages (root_id);
+
+CREATE INDEX IF NOT EXISTS idx_roots_messages ON messages (in_table_id, created_at) WHERE parent_id IS NULL;
@@ -0,0 +1,16 @@
+-- trash for databases created before it, nothing starts out trashed
+ALTER TABLE articles ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+ALTER TABLE polls ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_articles ON articles (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_messages ON messages (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_forums ON forums (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_polls ON polls (deleted_at) WHERE deleted_at IS NOT NULL;
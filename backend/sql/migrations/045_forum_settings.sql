@@ -0,0 +1,4 @@
+-- description and rules for forums created before they could be edited
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS description VARCHAR(2000) NOT NULL DEFAULT '';
+
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS rules VARCHAR(10000) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- slow mode for forums created before it, off by default
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS slow_mode_seconds INTEGER NOT NULL DEFAULT 0 CHECK (slow_mode_seconds >= 0);
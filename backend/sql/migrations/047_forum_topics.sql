@@ -0,0 +1,36 @@
+-- topics for databases created before them, the messages a forum already
+-- has all go into one "General" topic of that forum
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS topic_id UUID;
+
+CREATE TABLE IF NOT EXISTS forum_topics (
+    topic_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    title VARCHAR(256) NOT NULL,
+    author_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    locked BOOLEAN NOT NULL DEFAULT FALSE,
+    pinned BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_reply_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS forum_topic_reads (
+    topic_id UUID REFERENCES forum_topics (topic_id) ON DELETE CASCADE,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    read_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (topic_id, user_identifier)
+);
+
+CREATE INDEX IF NOT EXISTS idx_forum_id_forum_topics ON forum_topics (forum_id, pinned DESC, last_reply_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_topic_id_messages ON messages (topic_id, created_at) WHERE topic_id IS NOT NULL;
+
+INSERT INTO forum_topics (forum_id, title, author_identifier, created_at, last_reply_at)
+SELECT f.forum_id, 'General', u.user_identifier, MIN(m.created_at), MAX(m.created_at)
+FROM forums f
+JOIN messages m ON m.in_table = 'F' AND m.in_table_id = f.forum_id AND m.topic_id IS NULL
+LEFT JOIN users u ON u.user_identifier = f.created_by_identifier
+GROUP BY f.forum_id, u.user_identifier;
+
+UPDATE messages m SET topic_id = t.topic_id
+FROM forum_topics t
+WHERE m.in_table = 'F' AND m.in_table_id = t.forum_id AND m.topic_id IS NULL AND t.title = 'General';
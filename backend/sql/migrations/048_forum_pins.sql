@@ -0,0 +1,20 @@
+-- pinned messages and announcements for databases created before them
+CREATE TABLE IF NOT EXISTS forum_pins (
+    message_id UUID REFERENCES messages (message_id) ON DELETE CASCADE PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    pinned_by_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS forum_announcements (
+    announcement_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    author_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    content VARCHAR(2000) NOT NULL,
+    emailed BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_forum_id_forum_pins ON forum_pins (forum_id);
+
+CREATE INDEX IF NOT EXISTS idx_forum_id_forum_announcements ON forum_announcements (forum_id, created_at DESC);
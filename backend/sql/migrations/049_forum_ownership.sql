@@ -0,0 +1,6 @@
+-- ownership offers and scheduled deletion for forums created before them
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS pending_owner_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL;
+
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS delete_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_delete_at_forums ON forums (delete_at) WHERE delete_at IS NOT NULL;
@@ -0,0 +1,14 @@
+-- directory sections for databases created before them, existing forums
+-- start without a section
+CREATE TABLE IF NOT EXISTS forum_sections (
+    section_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    section_name VARCHAR(64) NOT NULL UNIQUE,
+    description VARCHAR(2000) NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0,
+    staff_only BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE forums ADD COLUMN IF NOT EXISTS section_id UUID REFERENCES forum_sections (section_id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_section_id_forums ON forums (section_id);
@@ -1,3 +1,15 @@
+-- media library, files live in storage and are stored once per checksum
+CREATE TABLE IF NOT EXISTS media (
+    media_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    checksum CHAR(64) NOT NULL UNIQUE,
+    storage_key VARCHAR(256) NOT NULL,
+    content_type VARCHAR(128) NOT NULL,
+    size BIGINT NOT NULL,
+    filename VARCHAR(256) NOT NULL,
+    uploaded_by_identifier UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- user table
 CREATE TABLE IF NOT EXISTS users (
     user_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
@@ -6,11 +18,21 @@ CREATE TABLE IF NOT EXISTS users (
     fullname VARCHAR(64) NOT NULL,
     role CHAR CHECK (role IN ('A', 'S')) NOT NULL DEFAULT 'S',
     email VARCHAR(128) NOT NULL UNIQUE,
-    profile_image BYTEA,
+    profile_media_id UUID REFERENCES media (media_id) ON DELETE SET NULL,
     joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     password_hash VARCHAR(96) NOT NULL
 );
 
+-- whose library a media file is in, a file uploaded by several users is
+-- stored once and linked to each of them
+CREATE TABLE IF NOT EXISTS user_media (
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    media_id UUID REFERENCES media (media_id) ON DELETE CASCADE,
+    filename VARCHAR(256) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_identifier, media_id)
+);
+
 -- article category table
 CREATE TABLE IF NOT EXISTS categories (
     category_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
@@ -22,35 +44,209 @@ CREATE TABLE IF NOT EXISTS articles (
     author_identifier UUID NOT NULL,
     author VARCHAR(64) NOT NULL,
     category_id UUID,
-    title VARCHAR(256) NOT NULL UNIQUE,
+    title VARCHAR(256) NOT NULL,
+    slug VARCHAR(256) NOT NULL UNIQUE,
     content TEXT NOT NULL,
+    -- draft, published or unpublished
+    status CHAR CHECK (status IN ('D', 'P', 'U')) NOT NULL DEFAULT 'D',
+    -- a draft with publish_at is scheduled, the scheduler flips it to 'P'
+    publish_at TIMESTAMP,
+    unpublish_at TIMESTAMP,
+    published_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- set when trashed, the row is hard deleted once the retention period passed
+    deleted_at TIMESTAMP,
     article_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    -- full text search, title matches rank above content matches
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', content), 'B')
+    ) STORED,
     FOREIGN KEY (category_id) REFERENCES categories (category_id) ON DELETE SET NULL
 );
 
+-- tag table
+CREATE TABLE IF NOT EXISTS tags (
+    tag_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    tag_name VARCHAR(64) NOT NULL,
+    -- normalized form of tag_name, used in urls and to dedupe tags
+    tag_slug VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- article_tags | many to many
+CREATE TABLE IF NOT EXISTS article_tags (
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    tag_id UUID REFERENCES tags (tag_id) ON DELETE CASCADE,
+    PRIMARY KEY (article_id, tag_id)
+);
+
+-- article_authors | many to many, bylines and per article roles
+CREATE TABLE IF NOT EXISTS article_authors (
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    -- owner, editor or viewer of drafts
+    role CHAR CHECK (role IN ('O', 'E', 'V')) NOT NULL DEFAULT 'E',
+    -- byline order of owners and editors
+    position SMALLINT NOT NULL DEFAULT 0,
+    -- invitations stay false until the invited user accepts
+    accepted BOOLEAN NOT NULL DEFAULT FALSE,
+    invited_by_identifier UUID,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (article_id, user_identifier)
+);
+
+-- bylines read usernames from users, the copied articles.author follows renames
+CREATE OR REPLACE FUNCTION sync_article_author () RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE articles SET author = NEW.username WHERE author_identifier = NEW.user_identifier;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER trg_username_articles
+AFTER UPDATE OF username ON users
+FOR EACH ROW WHEN (OLD.username IS DISTINCT FROM NEW.username)
+EXECUTE FUNCTION sync_article_author ();
+
+-- series of ordered articles, like multi part tutorials
+CREATE TABLE IF NOT EXISTS series (
+    series_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    title VARCHAR(256) NOT NULL,
+    series_slug VARCHAR(256) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    created_by_identifier UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- series_articles | an article is part of one series at most
+CREATE TABLE IF NOT EXISTS series_articles (
+    series_id UUID REFERENCES series (series_id) ON DELETE CASCADE,
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE UNIQUE,
+    position INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (series_id, article_id)
+);
+
+-- series_reads | articles a user has read, for series progress
+CREATE TABLE IF NOT EXISTS series_reads (
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    read_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_identifier, article_id)
+);
+
+-- article_reactions | one of each emoji per user and article
+CREATE TABLE IF NOT EXISTS article_reactions (
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    emoji VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (article_id, user_identifier, emoji)
+);
+
+-- bookmarks | private, saved articles of a user
+CREATE TABLE IF NOT EXISTS bookmarks (
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_identifier, article_id)
+);
+
+-- reaction and bookmark counts reconciled from the redis counters,
+-- reaction is an emoji or 'bookmarks'
+CREATE TABLE IF NOT EXISTS article_reaction_counts (
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    reaction VARCHAR(16) NOT NULL,
+    count BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (article_id, reaction)
+);
+
+-- article_views | daily unique visitors and views per article, flushed
+-- from the redis counters once the day is over
+CREATE TABLE IF NOT EXISTS article_views (
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    views BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (article_id, day)
+);
+
+-- article_referrers | daily views per referring site, 'direct' without one
+CREATE TABLE IF NOT EXISTS article_referrers (
+    article_id UUID REFERENCES articles (article_id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    referrer VARCHAR(128) NOT NULL,
+    views BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (article_id, day, referrer)
+);
+
+-- imports | what the importer created from a WXR export or markdown folder,
+-- article, message or user, so running it again skips them
+CREATE TABLE IF NOT EXISTS imports (
+    kind CHAR CHECK (kind IN ('A', 'M', 'U')) NOT NULL,
+    source_key VARCHAR(1024) NOT NULL,
+    target_id UUID NOT NULL,
+    imported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (kind, source_key)
+);
+
 -- message or comment
 CREATE TABLE IF NOT EXISTS messages (
     author VARCHAR(64) NOT NULL,
     author_identifier UUID NOT NULL,
     message_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
     reply_to_identifier UUID,
+    -- replies point to the message they answer and the top level message of their thread
+    parent_id UUID REFERENCES messages (message_id) ON DELETE CASCADE,
+    root_id UUID,
+    depth SMALLINT NOT NULL DEFAULT 0,
     content TEXT NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- trashing a message trashes its replies with the same time
+    deleted_at TIMESTAMP,
     -- this is for forum, article, and poll
     in_table CHAR CHECK (in_table IN ('F', 'A', 'P')) NOT NULL,
     -- this is for forum_id, article_id, and poll_id
-    in_table_id UUID NOT NULL
+    in_table_id UUID NOT NULL,
+    -- forum messages belong to a topic of the forum, NULL for articles and polls
+    topic_id UUID,
+    search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', content)) STORED
+);
+
+-- forum section table, groups forums in the directory
+CREATE TABLE IF NOT EXISTS forum_sections (
+    section_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    section_name VARCHAR(64) NOT NULL UNIQUE,
+    description VARCHAR(2000) NOT NULL DEFAULT '',
+    -- sections are listed by position, then name
+    position INTEGER NOT NULL DEFAULT 0,
+    -- only site admins may create forums in the section
+    staff_only BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 -- forum table
 CREATE TABLE IF NOT EXISTS forums (
     forum_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
     forum_name VARCHAR(128) NOT NULL UNIQUE,
-    forum_image BYTEA,
+    forum_slug VARCHAR(128) NOT NULL UNIQUE,
+    forum_media_id UUID REFERENCES media (media_id) ON DELETE SET NULL,
+    description VARCHAR(2000) NOT NULL DEFAULT '',
+    rules VARCHAR(10000) NOT NULL DEFAULT '',
+    -- minimum seconds between two messages of a member, 0 is off
+    slow_mode_seconds INTEGER NOT NULL DEFAULT 0 CHECK (slow_mode_seconds >= 0),
     public BOOLEAN NOT NULL DEFAULT TRUE,
+    section_id UUID REFERENCES forum_sections (section_id) ON DELETE SET NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    created_by_identifier UUID NOT NULL
+    created_by_identifier UUID NOT NULL,
+    -- offered ownership, becomes created_by_identifier once they accept
+    pending_owner_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    -- scheduled deletion, the forum goes to the trash then unless cancelled
+    delete_at TIMESTAMP,
+    deleted_at TIMESTAMP,
+    search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', forum_name)) STORED
 );
 
 -- forum_users | many to many
@@ -74,12 +270,119 @@ CREATE TABLE IF NOT EXISTS forum_mods (
     PRIMARY KEY (user_identifier, forum_id)
 );
 
+-- forum_invites | pending invitations, by lower cased email so people
+-- without an account can be invited too, usernames are invited by their email
+CREATE TABLE IF NOT EXISTS forum_invites (
+    invite_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    email VARCHAR(128) NOT NULL,
+    invited_by_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (forum_id, email)
+);
+
+-- forum_invite_links | shareable links, without expires_at or max_uses they
+-- work until revoked
+CREATE TABLE IF NOT EXISTS forum_invite_links (
+    code VARCHAR(32) PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    created_by_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    expires_at TIMESTAMP,
+    max_uses INTEGER CHECK (max_uses > 0),
+    uses INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- forum_join_requests | waiting for a forum admin or mod to approve or deny
+CREATE TABLE IF NOT EXISTS forum_join_requests (
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    message VARCHAR(512) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (forum_id, user_identifier)
+);
+
+-- forum_sanctions | bans keep a user out of a forum, mutes only keep them
+-- quiet, without expires_at a ban lasts until lifted
+CREATE TABLE IF NOT EXISTS forum_sanctions (
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    kind CHAR CHECK (kind IN ('B', 'M')) NOT NULL,
+    reason VARCHAR(512) NOT NULL,
+    moderator_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (forum_id, user_identifier, kind)
+);
+
+-- forum_topics | titled threads of a forum, the first message is the
+-- starter and last_reply_at orders the topic list
+CREATE TABLE IF NOT EXISTS forum_topics (
+    topic_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    title VARCHAR(256) NOT NULL,
+    author_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    locked BOOLEAN NOT NULL DEFAULT FALSE,
+    pinned BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_reply_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- forum_topic_reads | when a user last opened a topic, newer replies are unread
+CREATE TABLE IF NOT EXISTS forum_topic_reads (
+    topic_id UUID REFERENCES forum_topics (topic_id) ON DELETE CASCADE,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    read_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (topic_id, user_identifier)
+);
+
+-- forum_pins | messages moderators keep in the pinned panel of a forum, the
+-- number of pins per forum is limited
+CREATE TABLE IF NOT EXISTS forum_pins (
+    message_id UUID REFERENCES messages (message_id) ON DELETE CASCADE PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    pinned_by_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- forum_announcements | notices staff pushes to everyone in a forum
+CREATE TABLE IF NOT EXISTS forum_announcements (
+    announcement_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    forum_id UUID REFERENCES forums (forum_id) ON DELETE CASCADE,
+    author_identifier UUID REFERENCES users (user_identifier) ON DELETE SET NULL,
+    content VARCHAR(2000) NOT NULL,
+    emailed BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- notifications | in-app notices, read_at is set once the user saw them
+CREATE TABLE IF NOT EXISTS notifications (
+    notification_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
+    user_identifier UUID REFERENCES users (user_identifier) ON DELETE CASCADE,
+    content VARCHAR(512) NOT NULL,
+    link VARCHAR(512) NOT NULL DEFAULT '',
+    read_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- old slugs of renamed forums and articles, kept for 301 redirects
+CREATE TABLE IF NOT EXISTS slug_redirects (
+    -- this is for forum and article
+    in_table CHAR CHECK (in_table IN ('F', 'A')) NOT NULL,
+    old_slug VARCHAR(256) NOT NULL,
+    -- this is for forum_id and article_id
+    in_table_id UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (in_table, old_slug)
+);
+
 -- poll table
 CREATE TABLE IF NOT EXISTS polls (
     poll_id UUID DEFAULT gen_random_uuid () PRIMARY KEY,
     poll_title VARCHAR(256) NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    created_by_identifier UUID NOT NULL
+    created_by_identifier UUID NOT NULL,
+    deleted_at TIMESTAMP
 );
 
 -- poll options
@@ -101,6 +404,10 @@ CREATE TABLE IF NOT EXISTS poll_votes (
 );
 
 -- index
+CREATE INDEX IF NOT EXISTS idx_uploaded_by_identifier_media ON media (uploaded_by_identifier, created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_user_identifier_user_media ON user_media (user_identifier, created_at DESC);
+
 CREATE INDEX IF NOT EXISTS idx_username_users ON users (username);
 
 CREATE INDEX IF NOT EXISTS idx_user_identifier_users ON users (user_identifier);
@@ -111,6 +418,24 @@ CREATE INDEX IF NOT EXISTS idx_title_articles ON articles (title);
 
 CREATE INDEX IF NOT EXISTS idx_author_identifier_articles ON articles (author_identifier);
 
+CREATE INDEX IF NOT EXISTS idx_published_at_articles ON articles (published_at) WHERE status = 'P';
+
+CREATE INDEX IF NOT EXISTS idx_publish_at_articles ON articles (publish_at) WHERE status = 'D';
+
+CREATE INDEX IF NOT EXISTS idx_unpublish_at_articles ON articles (unpublish_at) WHERE status = 'P';
+
+CREATE INDEX IF NOT EXISTS idx_search_vector_articles ON articles USING GIN (search_vector);
+
+CREATE INDEX IF NOT EXISTS idx_tag_slug_pattern_tags ON tags (tag_slug text_pattern_ops);
+
+CREATE INDEX IF NOT EXISTS idx_tag_id_article_tags ON article_tags (tag_id);
+
+CREATE INDEX IF NOT EXISTS idx_user_identifier_article_authors ON article_authors (user_identifier);
+
+CREATE INDEX IF NOT EXISTS idx_series_id_position_series_articles ON series_articles (series_id, position);
+
+CREATE INDEX IF NOT EXISTS idx_article_id_bookmarks ON bookmarks (article_id);
+
 CREATE INDEX IF NOT EXISTS idx_author_identifier_messages ON messages (author_identifier);
 
 CREATE INDEX IF NOT EXISTS idx_reply_to_identifier_messages ON messages (reply_to_identifier);
@@ -121,6 +446,12 @@ CREATE INDEX IF NOT EXISTS idx_in_table_id_messages ON messages (in_table_id);
 
 CREATE INDEX IF NOT EXISTS idx_forum_name_forums ON forums (forum_name);
 
+CREATE INDEX IF NOT EXISTS idx_search_vector_messages ON messages USING GIN (search_vector);
+
+CREATE INDEX IF NOT EXISTS idx_search_vector_forums ON forums USING GIN (search_vector);
+
+CREATE INDEX IF NOT EXISTS idx_in_table_id_slug_redirects ON slug_redirects (in_table_id);
+
 CREATE INDEX IF NOT EXISTS idx_forum_id_users_forums ON forum_users (forum_id);
 
 CREATE INDEX IF NOT EXISTS idx_forum_id_admins_forums ON forum_admins (forum_id);
@@ -131,4 +462,36 @@ CREATE INDEX IF NOT EXISTS idx_poll_id_polls ON polls (poll_id);
 
 CREATE INDEX IF NOT EXISTS idx_poll_id_options ON poll_options (poll_id);
 
-CREATE INDEX IF NOT EXISTS idx_poll_id_votes ON poll_votes (poll_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_poll_id_votes ON poll_votes (poll_id);
+
+CREATE INDEX IF NOT EXISTS idx_parent_id_messages ON messages (parent_id);
+
+CREATE INDEX IF NOT EXISTS idx_root_id_messages ON messages (root_id);
+
+CREATE INDEX IF NOT EXISTS idx_roots_messages ON messages (in_table_id, created_at) WHERE parent_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_articles ON articles (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_messages ON messages (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_forums ON forums (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_deleted_at_polls ON polls (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_email_forum_invites ON forum_invites (email);
+
+CREATE INDEX IF NOT EXISTS idx_forum_id_forum_invite_links ON forum_invite_links (forum_id);
+
+CREATE INDEX IF NOT EXISTS idx_user_identifier_notifications ON notifications (user_identifier, created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_forum_id_forum_topics ON forum_topics (forum_id, pinned DESC, last_reply_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_topic_id_messages ON messages (topic_id, created_at) WHERE topic_id IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_forum_id_forum_pins ON forum_pins (forum_id);
+
+CREATE INDEX IF NOT EXISTS idx_forum_id_forum_announcements ON forum_announcements (forum_id, created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_delete_at_forums ON forums (delete_at) WHERE delete_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_section_id_forums ON forums (section_id);
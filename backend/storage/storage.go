@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Storage keeps uploaded media files, keys look like "ab/cd/abcd...png"
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var ErrNotFound = errors.New("storage: object not found")
+
+var Media Storage
+
+// MediaInit picks the backend from STORAGE_DRIVER, "local" (default) or "s3"
+func MediaInit() error {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		dir := os.Getenv("MEDIA_DIR")
+		if dir == "" {
+			dir = "../media"
+		}
+		local, err := NewLocal(dir)
+		if err != nil {
+			return fmt.Errorf("unable to use media dir: %v", err)
+		}
+		Media = local
+		log.Println("Storing media in", dir)
+	case "s3":
+		s3, err := NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to use s3 storage: %v", err)
+		}
+		Media = s3
+		log.Println("Storing media in bucket", os.Getenv("S3_BUCKET"))
+	default:
+		return fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+	return nil
+}
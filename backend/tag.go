@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sameer-gits/CMS/database"
+)
+
+type Tag struct {
+	ID        uuid.UUID `json:"tag_id"`
+	Name      string    `json:"tag_name"`
+	Slug      string    `json:"tag_slug"`
+	Count     int       `json:"count"`
+	Weight    int       `json:"-"`
+	CreatedAt time.Time `json:"-"`
+}
+
+type TagPage struct {
+	Tag      Tag
+	Filter   ArticleFilter
+	Articles []Article
+	IsAdmin  bool
+}
+
+const maxArticleTags = 10
+
+// normalizeTag turns "  Go  Lang_" and "go-lang" into the same slug
+func normalizeTag(name string) string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		// spelled out so "c", "c++" and "c#" get slugs of their own
+		case r == '+':
+			flush()
+			words = append(words, "plus")
+		case r == '#':
+			flush()
+			words = append(words, "sharp")
+		case unicode.IsSpace(r) || r == '-' || r == '_' || r == '.':
+			flush()
+		}
+	}
+	flush()
+	return strings.Join(words, "-")
+}
+
+func cleanTagName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// validateTagName keeps tag names to letters, numbers, spaces and a few
+// signs such as in "c++" or "c#"
+func validateTagName(name string) error {
+	if normalizeTag(name) == "" {
+		return errors.New("tag name should contain letters or numbers")
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && !strings.ContainsRune("-_.+#", r) {
+			return errors.New("tag name can only have letters, numbers, spaces and - _ . + #")
+		}
+	}
+	if countCharacters(name) > 64 {
+		return errors.New("tag name should be less than 64 characters")
+	}
+	return nil
+}
+
+func tagCloudHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var tags []Tag
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, tags, errs, "tags.html")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tags, err := listTags(ctx)
+	if err != nil {
+		errs = append(errs, errors.New("error getting tags, try again"))
+		return
+	}
+}
+
+func viewTagHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var page TagPage
+
+	defer func() {
+		if len(errs) > 0 {
+			http.Redirect(w, r, "/404", notFound)
+		} else if len(errs) == 0 {
+			renderHtml(w, r, page, errs, "tag.html")
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := getTagBySlug(ctx, r.PathValue("slug"))
+	if err != nil {
+		errs = append(errs, errors.New("tag not found"))
+		return
+	}
+
+	// other ?tag= values narrow or widen the list together with this tag
+	page.Filter = articleFilterFromRequest(r)
+	page.Filter.Tags = append([]string{tag.Slug}, page.Filter.Tags...)
+
+	page.Articles, err = listArticles(ctx, page.Filter)
+	if err != nil {
+		errs = append(errs, errors.New("error getting articles, try again"))
+		return
+	}
+
+	// admin controls are only shown, the POST handlers check again
+	user, err := userInfoMiddleware(r)
+	page.IsAdmin = err == nil && user.Role == 'A'
+	page.Tag = tag
+}
+
+func tagAutocompleteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	prefix := normalizeTag(r.URL.Query().Get("q"))
+	if prefix == "" {
+		renderJson(w, statusOK, []Tag{})
+		return
+	}
+
+	tags, err := searchTags(ctx, prefix, 10)
+	if err != nil {
+		renderJson(w, serverCode, map[string]string{"error": "error searching tags"})
+		return
+	}
+
+	renderJson(w, statusOK, tags)
+}
+
+func setArticleTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var article Article
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, article, errs, "article.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, articleURL(article.Slug), http.StatusFound)
+		}
+	}()
+
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	article, err = getArticle(ctx, Id)
+	if err != nil {
+		errs = append(errs, errors.New("article not found"))
+		return
+	}
+
+	if !user.canEditArticle(article) {
+		errs = append(errs, errors.New("you are not allowed to tag this article"))
+		return
+	}
+
+	var names []string
+	for _, n := range strings.Split(r.FormValue("tags"), ",") {
+		n = cleanTagName(n)
+		if n == "" {
+			continue
+		}
+		if err := validateTagName(n); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		names = append(names, n)
+	}
+
+	if len(names) > maxArticleTags {
+		errs = append(errs, errors.New("an article can have at most 10 tags"))
+		return
+	}
+
+	article.Tags, err = setArticleTags(ctx, article.ID, names)
+	if err != nil {
+		errs = append(errs, errors.New("error saving tags, try again"))
+		return
+	}
+}
+
+func renameTagHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var tag Tag
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, TagPage{Tag: tag, IsAdmin: user.Role == 'A'}, errs, "tag.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, "/tag/"+tag.Slug, http.StatusFound)
+		}
+	}()
+
+	if user.Role != 'A' {
+		errs = append(errs, errors.New("only admins can rename tags"))
+		return
+	}
+
+	tag, err = getTagBySlug(ctx, r.PathValue("slug"))
+	if err != nil {
+		errs = append(errs, errors.New("tag not found"))
+		return
+	}
+
+	name := cleanTagName(r.FormValue("name"))
+	if err := validateTagName(name); err != nil {
+		errs = append(errs, err)
+		return
+	}
+
+	renamed, err := tag.rename(ctx, name)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			errs = append(errs, errors.New("tag with this name already exists, merge them instead"))
+			return
+		}
+		errs = append(errs, errors.New("error renaming tag, try again"))
+		return
+	}
+	tag = renamed
+}
+
+func mergeTagHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var tag, into Tag
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+			renderHtml(w, r, TagPage{Tag: tag, IsAdmin: user.Role == 'A'}, errs, "tag.html")
+		} else if len(errs) == 0 {
+			http.Redirect(w, r, "/tag/"+into.Slug, http.StatusFound)
+		}
+	}()
+
+	if user.Role != 'A' {
+		errs = append(errs, errors.New("only admins can merge tags"))
+		return
+	}
+
+	tag, err = getTagBySlug(ctx, r.PathValue("slug"))
+	if err != nil {
+		errs = append(errs, errors.New("tag not found"))
+		return
+	}
+
+	into, err = getTagBySlug(ctx, normalizeTag(r.FormValue("into")))
+	if err != nil {
+		errs = append(errs, errors.New("tag to merge into not found"))
+		return
+	}
+
+	if into.ID == tag.ID {
+		errs = append(errs, errors.New("can not merge a tag into itself"))
+		return
+	}
+
+	err = tag.mergeInto(ctx, into)
+	if err != nil {
+		errs = append(errs, errors.New("error merging tags, try again"))
+		return
+	}
+}
+
+func getTagBySlug(ctx context.Context, slug string) (Tag, error) {
+	var tag Tag
+
+	getBySlug := `
+	SELECT t.tag_id, t.tag_name, t.tag_slug, t.created_at,
+	       (SELECT COUNT(*) FROM article_tags at JOIN articles a ON a.article_id = at.article_id
+	        WHERE at.tag_id = t.tag_id AND a.status = 'P' AND a.deleted_at IS NULL)
+	FROM tags t WHERE t.tag_slug = $1;
+	`
+	err := database.Dbpool.QueryRow(ctx, getBySlug, slug).Scan(
+		&tag.ID, &tag.Name, &tag.Slug, &tag.CreatedAt, &tag.Count)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	return tag, nil
+}
+
+func getArticleTags(ctx context.Context, articleID uuid.UUID) ([]Tag, error) {
+	get := `
+	SELECT t.tag_id, t.tag_name, t.tag_slug, t.created_at
+	FROM tags t JOIN article_tags at ON at.tag_id = t.tag_id
+	WHERE at.article_id = $1
+	ORDER BY t.tag_slug;
+	`
+	rows, err := database.Dbpool.Query(ctx, get, articleID)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Tag, error) {
+		var t Tag
+		err := row.Scan(&t.ID, &t.Name, &t.Slug, &t.CreatedAt)
+		return t, err
+	})
+}
+
+// listTags returns every tag of a published article with a 1 to 5 weight
+// for the cloud, counts match what the tag pages list
+func listTags(ctx context.Context) ([]Tag, error) {
+	list := `
+	SELECT t.tag_id, t.tag_name, t.tag_slug, t.created_at, COUNT(at.article_id) AS uses
+	FROM tags t JOIN article_tags at ON at.tag_id = t.tag_id
+	JOIN articles a ON a.article_id = at.article_id AND a.status = 'P' AND a.deleted_at IS NULL
+	GROUP BY t.tag_id
+	ORDER BY t.tag_slug;
+	`
+	rows, err := database.Dbpool.Query(ctx, list)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Tag, error) {
+		var t Tag
+		err := row.Scan(&t.ID, &t.Name, &t.Slug, &t.CreatedAt, &t.Count)
+		return t, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	maxCount := 1
+	for _, t := range tags {
+		maxCount = max(maxCount, t.Count)
+	}
+	for i := range tags {
+		tags[i].Weight = 1
+		if maxCount > 1 {
+			// log scale so one huge tag does not flatten the rest
+			tags[i].Weight += int(math.Round(4 * math.Log(float64(tags[i].Count)) / math.Log(float64(maxCount))))
+		}
+	}
+
+	return tags, nil
+}
+
+func searchTags(ctx context.Context, prefix string, limit int) ([]Tag, error) {
+	search := `
+	SELECT t.tag_id, t.tag_name, t.tag_slug, COUNT(at.article_id) AS uses
+	FROM tags t LEFT JOIN (article_tags at JOIN articles a ON a.article_id = at.article_id AND a.status = 'P' AND a.deleted_at IS NULL)
+	     ON at.tag_id = t.tag_id
+	WHERE t.tag_slug LIKE $1 || '%'
+	GROUP BY t.tag_id
+	ORDER BY uses DESC, t.tag_slug
+	LIMIT $2;
+	`
+	rows, err := database.Dbpool.Query(ctx, search, prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Tag, error) {
+		var t Tag
+		err := row.Scan(&t.ID, &t.Name, &t.Slug, &t.Count)
+		return t, err
+	})
+}
+
+// setArticleTags replaces all tags of an article, creating missing tags
+func setArticleTags(ctx context.Context, articleID uuid.UUID, names []string) ([]Tag, error) {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM article_tags WHERE article_id = $1`, articleID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addArticleTags(ctx, tx, articleID, names)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return getArticleTags(ctx, articleID)
+}
+
+// addArticleTags links names to an article inside tx, creating missing tags
+func addArticleTags(ctx context.Context, tx pgx.Tx, articleID uuid.UUID, names []string) error {
+	// an existing tag keeps its display name, only the slug has to match
+	upsertTag := `INSERT INTO tags (tag_name, tag_slug) VALUES ($1, $2)
+                  ON CONFLICT (tag_slug) DO UPDATE SET tag_slug = EXCLUDED.tag_slug
+                  RETURNING tag_id`
+	insertArticleTag := `INSERT INTO article_tags (article_id, tag_id) VALUES ($1, $2)
+                         ON CONFLICT DO NOTHING`
+	for _, n := range names {
+		var tagID uuid.UUID
+		err := tx.QueryRow(ctx, upsertTag, n, normalizeTag(n)).Scan(&tagID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, insertArticleTag, articleID, tagID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tag Tag) rename(ctx context.Context, name string) (Tag, error) {
+	var result Tag
+
+	update := `UPDATE tags SET tag_name = $1, tag_slug = $2 WHERE tag_id = $3
+               RETURNING tag_id, tag_name, tag_slug, created_at`
+	err := database.Dbpool.QueryRow(ctx, update, name, normalizeTag(name), tag.ID).Scan(
+		&result.ID, &result.Name, &result.Slug, &result.CreatedAt)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	return result, nil
+}
+
+// mergeInto moves every article of tag over to into and removes tag
+func (tag Tag) mergeInto(ctx context.Context, into Tag) error {
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	moveArticles := `INSERT INTO article_tags (article_id, tag_id)
+                     SELECT article_id, $2 FROM article_tags WHERE tag_id = $1
+                     ON CONFLICT DO NOTHING`
+	_, err = tx.Exec(ctx, moveArticles, tag.ID, into.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM tags WHERE tag_id = $1`, tag.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
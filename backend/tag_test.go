@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Go", "go"},
+		{"  Go  Lang_", "go-lang"},
+		{"go-lang", "go-lang"},
+		{"go.lang", "go-lang"},
+		{"c", "c"},
+		{"C++", "c-plus-plus"},
+		{"c#", "c-sharp"},
+		{"F# ", "f-sharp"},
+		{"Node.js 20", "node-js-20"},
+		{"Ёлка", "ёлка"},
+		{"--", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeTag(tt.name); got != tt.want {
+			t.Errorf("normalizeTag(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeTagDistinct(t *testing.T) {
+	seen := map[string]string{}
+	for _, name := range []string{"c", "c++", "c#"} {
+		slug := normalizeTag(name)
+		if other, ok := seen[slug]; ok {
+			t.Errorf("%q and %q share the slug %q", name, other, slug)
+		}
+		seen[slug] = name
+	}
+}
+
+func TestValidateTagName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"go", true},
+		{"c++", true},
+		{"c#", true},
+		{"machine learning", true},
+		{"node.js", true},
+		{"日本語", true},
+		{"", false},
+		{"-_.", false},
+		{"go/lang", false},
+		{"<script>", false},
+		{"a@b", false},
+		{"abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghijklm", false},
+	}
+	for _, tt := range tests {
+		err := validateTagName(tt.name)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateTagName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
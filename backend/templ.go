@@ -1,34 +1,65 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"path/filepath"
 	"text/template"
 )
 
-func renderHtml(w http.ResponseWriter, data interface{}, errs []error, htmlFilename ...string) {
+func renderHtml(w http.ResponseWriter, r *http.Request, data interface{}, errs []error, htmlFilename ...string) {
+	err := executeHtml(w, siteURL(r), data, errs, htmlFilename...)
+	if err != nil {
+		http.Error(w, err.Error(), serverCode)
+	}
+}
+
+// executeHtml renders the views into any writer, the static export uses it
+// so exported pages look exactly like served ones. base makes the meta links
+// absolute.
+func executeHtml(w io.Writer, base string, data interface{}, errs []error, htmlFilename ...string) error {
 	var htmlFilenames []string
-	for _, n := range htmlFilename {
+	// meta.html is shared by every page through {{template "meta" .}}
+	for _, n := range append(htmlFilename, "meta.html") {
 		htmlFilenames = append(htmlFilenames, filepath.Join("../frontend/views/", n))
 	}
 
 	tmpl, err := template.ParseFiles(htmlFilenames...)
 	if err != nil {
-		http.Error(w, "Error parsing template: "+err.Error(), serverCode)
-		return
+		return fmt.Errorf("Error parsing template: %v", err)
+	}
+
+	var meta PageMeta
+	if m, ok := data.(pageMetaer); ok {
+		meta = m.pageMeta().withBase(base)
 	}
 
 	templateData := struct {
 		Data   interface{}
 		Errors []error
+		Meta   PageMeta
 	}{
 		Data:   data,
 		Errors: errs,
+		Meta:   meta,
 	}
 
 	err = tmpl.Execute(w, templateData)
 	if err != nil {
-		http.Error(w, "Error executing template: "+err.Error(), serverCode)
-		return
+		return fmt.Errorf("Error executing template: %v", err)
+	}
+	return nil
+}
+
+func renderJson(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Println("error encoding json:", err)
 	}
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TestTemplates executes every view with the data type its handlers pass to
+// renderHtml, once empty and once filled so range and if bodies run too
+func TestTemplates(t *testing.T) {
+	now := time.Now()
+	later := now.Add(24 * time.Hour)
+	uses := 5
+
+	user := DbUser{Identifier: uuid.New(), Username: "ada", Fullname: "Ada", Role: 'A', JoinedAt: now}
+	forum := Forum{
+		ID:                     uuid.New(),
+		Name:                   "Gophers",
+		Slug:                   "gophers",
+		ForumMediaID:           uuid.NullUUID{UUID: uuid.New(), Valid: true},
+		Description:            "all things go",
+		Rules:                  "be nice",
+		SlowModeSeconds:        30,
+		SectionID:              uuid.NullUUID{UUID: uuid.New(), Valid: true},
+		CreatedAt:              now,
+		CreatedByIdentifier:    user.Identifier,
+		PendingOwnerIdentifier: uuid.NullUUID{UUID: user.Identifier, Valid: true},
+		DeleteAt:               &later,
+	}
+	auth := ForumAuth{
+		Role:    forumAdmin,
+		Member:  true,
+		CanRead: true,
+		Owner:   true,
+		Ban:     &ForumSanction{Kind: 'B', ExpiresAt: &later},
+		Mute:    &ForumSanction{Kind: 'M', ExpiresAt: &later},
+	}
+	section := ForumSection{ID: forum.SectionID.UUID, Name: "Languages", Description: "code", CreatedAt: now}
+	listing := ForumListing{Forum: forum, Members: 3, LastActivity: now}
+	topic := ForumTopic{ID: uuid.New(), ForumID: forum.ID, Title: "hello", AuthorUsername: "ada", Locked: true, Pinned: true, Posts: 2, CreatedAt: now, LastReplyAt: now, Unread: true}
+	message := Message{
+		AuthorUsername:   "ada",
+		AuthorIdentifier: user.Identifier,
+		MessageId:        uuid.New(),
+		Content:          "hi",
+		CreatedAt:        now,
+		InTable:          'F',
+		InTableId:        forum.ID,
+		TopicId:          uuid.NullUUID{UUID: topic.ID, Valid: true},
+		ReplyCount:       1,
+	}
+	message.Replies = []Message{message}
+	pin := ForumPin{MessageId: message.MessageId, TopicID: topic.ID, TopicTitle: topic.Title, AuthorUsername: "ada", Content: "pinned", PinnedBy: "ada", PinnedAt: now}
+	announcement := ForumAnnouncement{ID: uuid.New(), AuthorUsername: "ada", Content: "news", Emailed: true, CreatedAt: now}
+	tag := Tag{ID: uuid.New(), Name: "Go", Slug: "go", Count: 2, Weight: 3, CreatedAt: now}
+	author := ArticleAuthor{Identifier: user.Identifier, Username: "ada", Fullname: "Ada", Role: 'O', Accepted: true, CreatedAt: now}
+	series := Series{ID: uuid.New(), Title: "Go basics", Slug: "go-basics", Description: "start here", CreatedByIdentifier: user.Identifier, CreatedAt: now, UpdatedAt: now}
+	entry := SeriesEntry{ArticleID: uuid.New(), Title: "Part one", Slug: "part-one", Status: 'P', Position: 1, Read: true, Editable: true}
+	article := Article{
+		ID:               uuid.New(),
+		AuthorIdentifier: user.Identifier,
+		Author:           "ada",
+		Title:            "Hello",
+		Slug:             "hello",
+		Content:          "![cat](/media/" + uuid.NewString() + ") <b>hi</b>",
+		Status:           'P',
+		PublishAt:        &later,
+		UnpublishAt:      &later,
+		PublishedAt:      &now,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		Tags:             []Tag{tag},
+		Authors:          []ArticleAuthor{author, {Username: "bob", Role: 'E'}},
+		Series:           &SeriesNav{Series: series, Position: 2, Total: 3, Prev: &entry, Next: &entry},
+		Reactions:        Reactions{Counts: []ReactionCount{{}}, Bookmarks: 1, Bookmarked: true},
+	}
+	filter := ArticleFilter{Tags: []string{"go"}, MatchAll: true, Author: "ada", Category: "news"}
+	formUser := FormUser{Username: "ada", Fullname: "Ada", Email: "ada@example.com", Message: "check your mail"}
+	views := ArticleViews{ArticleID: article.ID, Title: article.Title, Slug: article.Slug, Visitors: 2, Views: 3}
+
+	tests := []struct {
+		view   string
+		empty  interface{}
+		filled interface{}
+	}{
+		{"index.html", nil, nil},
+		{"notFound.html", nil, nil},
+		{"login.html", FormUser{}, formUser},
+		{"verify.html", FormUser{}, formUser},
+		{"user.html", UserPage{}, UserPage{
+			User:      user,
+			Bookmarks: []Bookmark{{ArticleID: article.ID, Title: "Hello", Slug: "hello", Author: "ada", CreatedAt: now}},
+			Unread:    2,
+			Sections:  []ForumSection{section},
+		}},
+		{"articles.html", ArticlesPage{}, ArticlesPage{Filter: filter, Articles: []Article{article}}},
+		{"article.html", Article{}, article},
+		{"articleEdit.html", Article{}, article},
+		{"articleAuthors.html", ArticleAuthorsPage{}, ArticleAuthorsPage{Article: article, CanManage: true, Invite: &author}},
+		{"articleInvitations.html", []ArticleInvitation(nil), []ArticleInvitation{{ArticleID: article.ID, Title: "Hello", Slug: "hello", Role: 'E', InvitedBy: "ada", CreatedAt: now}}},
+		{"analytics.html", AnalyticsPage{}, AnalyticsPage{
+			Days:      30,
+			Ranges:    analyticsRanges,
+			Article:   &views,
+			Series:    []ViewDay{{Day: now, Visitors: 1, Views: 2}, {Day: later, Visitors: 2, Views: 4}},
+			Articles:  []ArticleViews{views},
+			Referrers: []Referrer{{Host: "example.com", Views: 2}},
+			Visitors:  2,
+			Views:     3,
+		}},
+		{"tags.html", []Tag(nil), []Tag{tag}},
+		{"tag.html", TagPage{}, TagPage{Tag: tag, Filter: filter, Articles: []Article{article}, IsAdmin: true}},
+		{"series.html", SeriesPage{}, SeriesPage{Series: series, Entries: []SeriesEntry{entry, {Title: "Draft", Status: 'D'}}, CanEdit: true}},
+		{"seriesEdit.html", Series{}, series},
+		{"search.html", SearchPage{}, SearchPage{
+			Query:   SearchQuery{Query: "go", Type: "article", Author: "ada", From: "2026-01-01", To: "2026-12-31", Page: 2},
+			Results: []SearchResult{{Type: "article", ID: article.ID, Title: "Hello", URL: "/articles/hello", Author: "ada", Snippet: "<mark>go</mark>", CreatedAt: now}},
+			HasMore: true,
+		}},
+		{"notifications.html", NotificationsPage{}, NotificationsPage{
+			Notifications: []Notification{{ID: uuid.New(), Content: "hi", Link: "/user", CreatedAt: now}, {ID: uuid.New(), Content: "read", ReadAt: &now, CreatedAt: now}},
+			Unread:        1,
+		}},
+		{"trash.html", TrashPage{}, TrashPage{User: user, Items: []TrashItem{{Kind: "article", ID: article.ID, Title: "Hello", Where: "articles", DeletedAt: now}}, RetentionDays: 30}},
+		{"forums.html", ForumsPage{}, ForumsPage{
+			Query:       "go",
+			Sort:        "active",
+			Sorts:       []string{"active", "new"},
+			Section:     "languages",
+			SectionName: "Languages",
+			Cursor:      "a",
+			NextCursor:  "b",
+			Forums:      []ForumListing{listing},
+			Groups:      []ForumSectionGroup{{ForumSection: section, Key: "languages", Forums: []ForumListing{listing}, NextCursor: "b"}},
+			Mine:        []ForumListing{listing},
+			User:        user,
+		}},
+		{"forum.html", ForumPage{}, ForumPage{
+			ForumAuth:     auth,
+			Forum:         forum,
+			Topics:        []ForumTopic{topic},
+			Pins:          []ForumPin{pin},
+			Announcements: []ForumAnnouncement{announcement},
+			User:          user,
+			Requested:     true,
+		}},
+		{"topic.html", TopicPage{}, TopicPage{
+			ForumAuth:     auth,
+			Forum:         forum,
+			Topic:         topic,
+			Messages:      []Message{message},
+			Pins:          []ForumPin{pin},
+			Announcements: []ForumAnnouncement{announcement},
+			User:          user,
+		}},
+		{"forumSettings.html", ForumSettingsPage{}, ForumSettingsPage{ForumAuth: auth, Forum: forum, User: user, Sections: []ForumSection{section}}},
+		{"forumSections.html", ForumSectionsPage{}, ForumSectionsPage{Sections: []ForumSection{section}, User: user}},
+		{"forumMembers.html", ForumMembersPage{}, ForumMembersPage{
+			ForumAuth: auth,
+			Forum:     forum,
+			User:      user,
+			Base:      "https://example.com",
+			Requests:  []ForumJoinRequest{{Identifier: uuid.New(), Username: "bob", Message: "let me in", CreatedAt: now}},
+			Invites:   []ForumInvite{{ID: uuid.New(), ForumID: forum.ID, Email: "bob@example.com", InvitedBy: "ada", CreatedAt: now}},
+			Links:     []ForumInviteLink{{Code: "abc", ExpiresAt: &later, MaxUses: &uses, Uses: 1, CreatedAt: now}, {Code: "open", CreatedAt: now}},
+			Members:   []ForumMember{{Identifier: user.Identifier, Username: "ada", Role: 'A'}, {Identifier: uuid.New(), Username: "bob", Role: 'M'}},
+			Sanctions: []ForumSanction{{Identifier: uuid.New(), Username: "eve", Kind: 'B', Reason: "spam", Moderator: "ada", ExpiresAt: &later, CreatedAt: now}},
+		}},
+		{"forumInvitations.html", []ForumInvite(nil), []ForumInvite{{ID: uuid.New(), ForumID: forum.ID, ForumName: "Gophers", ForumSlug: "gophers", InvitedBy: "ada", CreatedAt: now}}},
+		{"forumInvite.html", ForumInvitePage{}, ForumInvitePage{Forum: forum, Link: ForumInviteLink{Code: "abc", ExpiresAt: &later, MaxUses: &uses, CreatedAt: now}, Member: true}},
+	}
+
+	errs := []error{errors.New("something went wrong")}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := executeHtml(&b, "https://example.com", tt.empty, nil, tt.view); err != nil {
+			t.Errorf("%s with empty %T: %v", tt.view, tt.empty, err)
+		}
+		b.Reset()
+		if err := executeHtml(&b, "https://example.com", tt.filled, errs, tt.view); err != nil {
+			t.Errorf("%s with filled %T: %v", tt.view, tt.filled, err)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/sameer-gits/CMS/database"
+)
+
+// trashed content is hard deleted after this many days, TRASH_RETENTION_DAYS overrides it
+const defaultTrashRetentionDays = 30
+
+// TrashItem is trashed content the user may restore, Where is the forum
+// or article a message was posted in
+type TrashItem struct {
+	Kind      string
+	ID        uuid.UUID
+	Title     string
+	Where     string
+	DeletedAt time.Time
+}
+
+type TrashPage struct {
+	User          DbUser
+	Items         []TrashItem
+	RetentionDays int
+}
+
+// trashTarget is the row a trash or restore works on, found whether it is
+// trashed or not
+type trashTarget struct {
+	deletedAt *time.Time
+	allowed   bool
+	// page the content was shown on
+	back string
+	// room told about trashed messages
+	room RoomKey
+}
+
+func trashRetentionDays() int {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days < 1 {
+		return defaultTrashRetentionDays
+	}
+	return days
+}
+
+// PurgeAt is when the retention job deletes the item for good
+func (t TrashItem) PurgeAt() time.Time {
+	return t.DeletedAt.AddDate(0, 0, trashRetentionDays())
+}
+
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	var errs []error
+	var page TrashPage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	defer func() {
+		if len(errs) > 0 {
+			w.WriteHeader(badCode)
+		}
+		renderHtml(w, r, page, errs, "trash.html")
+	}()
+
+	page = TrashPage{User: user, RetentionDays: trashRetentionDays()}
+	page.Items, err = listTrash(ctx, user)
+	if err != nil {
+		errs = append(errs, errors.New("error getting trash, try again"))
+		return
+	}
+}
+
+// trashContentHandler moves an article, forum, message or poll to the trash,
+// article owners, forum admins, authors of a message and site admins may
+func trashContentHandler(w http.ResponseWriter, r *http.Request) {
+	trashAction(w, r, func(ctx context.Context, kind string, Id uuid.UUID, target trashTarget) (string, error) {
+		if target.deletedAt != nil {
+			return "", errors.New("already in the trash")
+		}
+		if kind == "forum" {
+			return "", errors.New("forums are deleted from their settings page after a cool-off")
+		}
+
+		err := trashContent(ctx, kind, Id)
+		if err != nil {
+			return "", errors.New("error moving to trash, try again")
+		}
+
+		if kind == "message" {
+			publishMessage(target.room, "message_deleted", Message{MessageId: Id, InTableId: target.room.id})
+		}
+		return target.back, nil
+	})
+}
+
+func restoreContentHandler(w http.ResponseWriter, r *http.Request) {
+	trashAction(w, r, func(ctx context.Context, kind string, Id uuid.UUID, target trashTarget) (string, error) {
+		if target.deletedAt == nil {
+			return "", errors.New("not in the trash")
+		}
+
+		err := restoreContent(ctx, kind, Id)
+		if errors.Is(err, errParentTrashed) {
+			return "", err
+		} else if err != nil {
+			return "", errors.New("error restoring, try again")
+		}
+		return "/trash", nil
+	})
+}
+
+// trashAction loads the content of a trash form and checks the user may
+// trash it, action returns where to go next
+func trashAction(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, kind string, Id uuid.UUID, target trashTarget) (string, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := userInfoMiddleware(r)
+	if err != nil {
+		http.Redirect(w, r, "/logout", badCode)
+		return
+	}
+
+	kind := r.PathValue("kind")
+	Id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	target, err := getTrashTarget(ctx, kind, Id, user)
+	if err != nil {
+		http.Redirect(w, r, "/404", notFound)
+		return
+	}
+
+	var errs []error
+	next := ""
+	if !target.allowed && user.Role != 'A' {
+		errs = append(errs, fmt.Errorf("you are not allowed to trash this %s", kind))
+	} else {
+		next, err = action(ctx, kind, Id, target)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		page := TrashPage{User: user, RetentionDays: trashRetentionDays()}
+		page.Items, err = listTrash(ctx, user)
+		if err != nil {
+			errs = append(errs, errors.New("error getting trash, try again"))
+		}
+		w.WriteHeader(badCode)
+		renderHtml(w, r, page, errs, "trash.html")
+		return
+	}
+
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// getTrashTarget finds the content and whether user owns it, messages of a
+// forum are also open to those the forum lets delete others' messages. Site
+// admins are checked by the caller.
+func getTrashTarget(ctx context.Context, kind string, Id uuid.UUID, user DbUser) (trashTarget, error) {
+	var target trashTarget
+	var get string
+
+	switch kind {
+	case "article":
+		get = `
+		SELECT a.deleted_at, '/a/' || a.slug, EXISTS (
+		    SELECT 1 FROM article_authors aa
+		    WHERE aa.article_id = a.article_id AND aa.user_identifier = $2 AND aa.accepted AND aa.role = 'O')
+		FROM articles a WHERE a.article_id = $1`
+	case "forum":
+		get = `
+		SELECT f.deleted_at, '/f/' || f.forum_slug, EXISTS (
+		    SELECT 1 FROM forum_admins fa WHERE fa.forum_id = f.forum_id AND fa.user_identifier = $2)
+		FROM forums f WHERE f.forum_id = $1`
+	case "poll":
+		get = `SELECT deleted_at, '/trash', created_by_identifier = $2 FROM polls WHERE poll_id = $1`
+	case "message":
+		var table string
+		var topicId uuid.NullUUID
+		get = `
+		SELECT m.deleted_at, COALESCE('/f/' || f.forum_slug || COALESCE('/t/' || m.topic_id, ''), '/a/' || a.slug, '/trash'),
+		       m.author_identifier = $2 OR EXISTS (
+		           SELECT 1 FROM forum_admins fa WHERE fa.forum_id = f.forum_id AND fa.user_identifier = $2)
+		       OR EXISTS (
+		           SELECT 1 FROM article_authors aa
+		           WHERE aa.article_id = a.article_id AND aa.user_identifier = $2 AND aa.accepted AND aa.role = 'O'),
+		       m.in_table, m.in_table_id, m.topic_id
+		FROM messages m
+		LEFT JOIN forums f ON m.in_table = 'F' AND f.forum_id = m.in_table_id
+		LEFT JOIN articles a ON m.in_table = 'A' AND a.article_id = m.in_table_id
+		WHERE m.message_id = $1`
+		err := database.Dbpool.QueryRow(ctx, get, Id, user.Identifier).Scan(
+			&target.deletedAt, &target.back, &target.allowed, &table, &target.room.id, &topicId)
+		if err != nil {
+			return trashTarget{}, err
+		}
+		switch firstRune(table) {
+		case 'F':
+			forumID := target.room.id
+			target.room.roomtype = "forum"
+			// topic messages go out to the topic room
+			if topicId.Valid {
+				target.room = RoomKey{id: topicId.UUID, roomtype: "topic"}
+			}
+			if target.allowed {
+				break
+			}
+			// messages of a trashed forum are left to its admins, checked above
+			forum, err := getForum(ctx, forumID)
+			if errors.Is(err, pgx.ErrNoRows) {
+				break
+			} else if err != nil {
+				return trashTarget{}, err
+			}
+			auth, err := authorizeForum(ctx, forum, user)
+			if err != nil {
+				return trashTarget{}, err
+			}
+			target.allowed = auth.Can(permDeleteOthers)
+		case 'A':
+			target.room.roomtype = "article"
+		case 'P':
+			target.room.roomtype = "poll"
+		}
+		return target, nil
+	default:
+		return trashTarget{}, pgx.ErrNoRows
+	}
+
+	err := database.Dbpool.QueryRow(ctx, get, Id, user.Identifier).Scan(&target.deletedAt, &target.back, &target.allowed)
+	if err != nil {
+		return trashTarget{}, err
+	}
+	return target, nil
+}
+
+// a reply can not come back while the message it answers is trashed
+var errParentTrashed = errors.New("restore the message this one replies to first")
+
+// trashContent sets deleted_at, a message takes its replies along with the
+// same time so restoring it brings back exactly those
+func trashContent(ctx context.Context, kind string, Id uuid.UUID) error {
+	if kind == "message" {
+		trash := `
+		WITH RECURSIVE thread AS (
+		    SELECT message_id FROM messages WHERE message_id = $1
+		    UNION ALL
+		    SELECT m.message_id FROM messages m JOIN thread t ON m.parent_id = t.message_id
+		)
+		UPDATE messages SET deleted_at = CURRENT_TIMESTAMP
+		WHERE message_id IN (SELECT message_id FROM thread) AND deleted_at IS NULL`
+		_, err := database.Dbpool.Exec(ctx, trash, Id)
+		return err
+	}
+
+	table, idColumn := trashTable(kind)
+	trash := fmt.Sprintf(`UPDATE %s SET deleted_at = CURRENT_TIMESTAMP WHERE %s = $1 AND deleted_at IS NULL`, table, idColumn)
+	_, err := database.Dbpool.Exec(ctx, trash, Id)
+	return err
+}
+
+func restoreContent(ctx context.Context, kind string, Id uuid.UUID) error {
+	if kind == "message" {
+		parentTrashed := `
+		SELECT EXISTS (
+		    SELECT 1 FROM messages m JOIN messages p ON p.message_id = m.parent_id
+		    WHERE m.message_id = $1 AND p.deleted_at IS NOT NULL)`
+		trashed, err := rowExists(ctx, parentTrashed, Id)
+		if err != nil {
+			return err
+		}
+		if trashed {
+			return errParentTrashed
+		}
+
+		restore := `
+		WITH RECURSIVE thread AS (
+		    SELECT message_id FROM messages WHERE message_id = $1
+		    UNION ALL
+		    SELECT m.message_id FROM messages m JOIN thread t ON m.parent_id = t.message_id
+		)
+		UPDATE messages SET deleted_at = NULL
+		WHERE message_id IN (SELECT message_id FROM thread)
+		  AND deleted_at = (SELECT deleted_at FROM messages WHERE message_id = $1)`
+		_, err = database.Dbpool.Exec(ctx, restore, Id)
+		return err
+	}
+
+	table, idColumn := trashTable(kind)
+	restore := fmt.Sprintf(`UPDATE %s SET deleted_at = NULL WHERE %s = $1`, table, idColumn)
+	_, err := database.Dbpool.Exec(ctx, restore, Id)
+	return err
+}
+
+func trashTable(kind string) (table, idColumn string) {
+	switch kind {
+	case "article":
+		return "articles", "article_id"
+	case "forum":
+		return "forums", "forum_id"
+	case "poll":
+		return "polls", "poll_id"
+	default:
+		return "messages", "message_id"
+	}
+}
+
+// listTrash returns what user may restore, everything for site admins.
+// Replies trashed along with their message are restored with it and not listed.
+func listTrash(ctx context.Context, user DbUser) ([]TrashItem, error) {
+	list := `
+	SELECT kind, id, title, place, deleted_at FROM (
+	    SELECT 'article' AS kind, a.article_id AS id, a.title, '' AS place, a.deleted_at
+	    FROM articles a
+	    WHERE a.deleted_at IS NOT NULL
+	      AND ($2 OR EXISTS (
+	          SELECT 1 FROM article_authors aa
+	          WHERE aa.article_id = a.article_id AND aa.user_identifier = $1 AND aa.accepted AND aa.role = 'O'))
+
+	    UNION ALL
+
+	    SELECT 'forum', f.forum_id, f.forum_name, '', f.deleted_at
+	    FROM forums f
+	    WHERE f.deleted_at IS NOT NULL
+	      AND ($2 OR EXISTS (
+	          SELECT 1 FROM forum_admins fa WHERE fa.forum_id = f.forum_id AND fa.user_identifier = $1))
+
+	    UNION ALL
+
+	    SELECT 'message', m.message_id, m.content, COALESCE(f.forum_name, a.title, ''), m.deleted_at
+	    FROM messages m
+	    LEFT JOIN messages p ON p.message_id = m.parent_id
+	    LEFT JOIN forums f ON m.in_table = 'F' AND f.forum_id = m.in_table_id
+	    LEFT JOIN articles a ON m.in_table = 'A' AND a.article_id = m.in_table_id
+	    WHERE m.deleted_at IS NOT NULL
+	      AND p.deleted_at IS DISTINCT FROM m.deleted_at
+	      AND ($2 OR m.author_identifier = $1
+	        OR EXISTS (SELECT 1 FROM forum_admins fa WHERE fa.forum_id = f.forum_id AND fa.user_identifier = $1)
+	        OR EXISTS (SELECT 1 FROM forum_mods fm WHERE fm.forum_id = f.forum_id AND fm.user_identifier = $1)
+	        OR EXISTS (
+	            SELECT 1 FROM article_authors aa
+	            WHERE aa.article_id = a.article_id AND aa.user_identifier = $1 AND aa.accepted AND aa.role = 'O'))
+
+	    UNION ALL
+
+	    SELECT 'poll', p.poll_id, p.poll_title, '', p.deleted_at
+	    FROM polls p
+	    WHERE p.deleted_at IS NOT NULL AND ($2 OR p.created_by_identifier = $1)
+	) trashed
+	ORDER BY deleted_at DESC
+	LIMIT 200;
+	`
+	rows, err := database.Dbpool.Query(ctx, list, user.Identifier, user.Role == 'A')
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (TrashItem, error) {
+		var t TrashItem
+		err := row.Scan(&t.Kind, &t.ID, &t.Title, &t.Where, &t.DeletedAt)
+		t.Title = summarize(t.Title, 80)
+		return t, err
+	})
+}
+
+// purgeTrash hard deletes everything trashed longer than the retention
+// period. Messages have no foreign key to what they were posted in, so
+// they are deleted along with their forum, article or poll.
+func purgeTrash(ctx context.Context) error {
+	days := trashRetentionDays()
+
+	tx, err := database.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// replies go with their message through parent_id
+	purgeMessages := `DELETE FROM messages WHERE deleted_at < CURRENT_TIMESTAMP - make_interval(days => $1)`
+	_, err = tx.Exec(ctx, purgeMessages, days)
+	if err != nil {
+		return err
+	}
+
+	containers := []struct {
+		kind    string
+		inTable rune
+	}{{"article", 'A'}, {"forum", 'F'}, {"poll", 'P'}}
+	for _, c := range containers {
+		table, idColumn := trashTable(c.kind)
+		purge := fmt.Sprintf(`
+		WITH purged AS (
+		    DELETE FROM %[1]s WHERE deleted_at < CURRENT_TIMESTAMP - make_interval(days => $1)
+		    RETURNING %[2]s
+		), redirects AS (
+		    DELETE FROM slug_redirects WHERE in_table = $2 AND in_table_id IN (SELECT %[2]s FROM purged)
+		)
+		DELETE FROM messages WHERE in_table = $2 AND in_table_id IN (SELECT %[2]s FROM purged)`, table, idColumn)
+		_, err = tx.Exec(ctx, purge, days, string(c.inTable))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"log"
@@ -14,22 +13,22 @@ import (
 	"unicode/utf8"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 	"github.com/sameer-gits/CMS/database"
 )
 
 type DbUser struct {
-	UserID       uuid.UUID `form:"user_id" json:"user_id" redis:"user_id"`
-	Identifier   uuid.UUID `form:"identifier" json:"identifier" redis:"identifier"`
-	Username     string    `form:"username" json:"username" redis:"username"`
-	Fullname     string    `form:"fullname" json:"fullname" redis:"fullname"`
-	Role         rune      `form:"role" json:"role" redis:"role"`
-	JoinedAt     time.Time `form:"joined_at" json:"joined_at" redis:"joined_at"`
-	Email        string    `form:"email" json:"email" redis:"email"`
-	Password     string    `form:"password" json:"password" redis:"password"`
-	ProfileImage []byte    `form:"profile_image,omitempty" json:"profile_image,omitempty" redis:"profile_image"`
+	UserID       uuid.UUID     `form:"user_id" json:"user_id" redis:"user_id"`
+	Identifier   uuid.UUID     `form:"identifier" json:"identifier" redis:"identifier"`
+	Username     string        `form:"username" json:"username" redis:"username"`
+	Fullname     string        `form:"fullname" json:"fullname" redis:"fullname"`
+	Role         rune          `form:"role" json:"role" redis:"role"`
+	JoinedAt     time.Time     `form:"joined_at" json:"joined_at" redis:"joined_at"`
+	Email        string        `form:"email" json:"email" redis:"email"`
+	Password     string        `form:"password" json:"password" redis:"password"`
+	ProfileMedia uuid.NullUUID `form:"profile_media_id,omitempty" json:"profile_media_id,omitempty" redis:"profile_media_id"`
 }
 
 type FormUser struct {
@@ -216,32 +215,38 @@ func userInfoMiddleware(r *http.Request) (DbUser, error) {
 
 	// Check if user exists in main DB
 	getUser := `
-	SELECT username, user_identifier, fullname, role, joined_at, email, profile_image
+	SELECT username, user_identifier, fullname, role, joined_at, email, profile_media_id
 	FROM users WHERE user_id = $1;
 	`
+	var role string
 	err = database.Dbpool.QueryRow(ctx, getUser, userID).Scan(
 		&user.Username,
 		&user.Identifier,
 		&user.Fullname,
-		&user.Role,
+		&role,
 		&user.JoinedAt,
 		&user.Email,
-		&user.ProfileImage,
+		&user.ProfileMedia,
 	)
 
 	if err != nil {
 		return DbUser{}, err
 	}
+	user.Role = firstRune(role)
 
 	// add user details in Redis 1 for future
 	tx := database.RedisAllClients.Client1.TxPipeline()
 	tmpUser := map[string]interface{}{
-		"username":      user.Username,
-		"fullname":      user.Fullname,
-		"role":          user.Role,
-		"joined_at":     user.JoinedAt,
-		"email":         user.Email,
-		"profile_image": user.ProfileImage,
+		"identifier": user.Identifier.String(),
+		"username":   user.Username,
+		"fullname":   user.Fullname,
+		"role":       user.Role,
+		"joined_at":  user.JoinedAt,
+		"email":      user.Email,
+	}
+	// a null uuid can't be scanned back from redis, so it is left out
+	if user.ProfileMedia.Valid {
+		tmpUser["profile_media_id"] = user.ProfileMedia.UUID.String()
 	}
 
 	tx.HSet(ctx, userID.String(), tmpUser).Err()
@@ -265,7 +270,7 @@ func getUserIdentifier(ctx context.Context, userIdentifier uuid.UUID) (bool, err
 	`
 	err := database.Dbpool.QueryRow(ctx, getUser, userIdentifier).Scan(&uIdentifier)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return false, nil
 		}
 		return false, err
@@ -274,23 +279,27 @@ func getUserIdentifier(ctx context.Context, userIdentifier uuid.UUID) (bool, err
 }
 
 func getInTableId(ctx context.Context, inTableID uuid.UUID, tableType string) (bool, error) {
-	var tableID uuid.UUID
-	inTableType := pq.QuoteIdentifier(tableType)
-	get := fmt.Sprintf(`
-	SELECT %s_id
-	FROM %ss WHERE %s_id = $1;
-	`, inTableType, inTableType, inTableType)
-
-	err := database.Dbpool.QueryRow(ctx, get, inTableID).Scan(&tableID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
-		return false, err
+	var table, idColumn string
+	switch tableType {
+	case "forum":
+		table, idColumn = "forums", "forum_id"
+	case "article":
+		table, idColumn = "articles", "article_id"
+	case "poll":
+		table, idColumn = "polls", "poll_id"
+	default:
+		return false, nil
 	}
-	return true, nil
+
+	return rowExists(ctx, fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE %s = $1 AND deleted_at IS NULL)`, table, idColumn), inTableID)
 }
 
 func countCharacters(s string) int {
 	return utf8.RuneCountInString(s)
 }
+
+// firstRune is used for CHAR columns, pgx can not scan them into a rune
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
+}
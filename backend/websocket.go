@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lesismal/nbio/nbhttp/websocket"
@@ -19,9 +21,11 @@ type RoomKey struct {
 	roomtype string
 }
 
+// Subscriber is one open page, user is the zero DbUser for visitors
 type Subscriber struct {
 	conn    *websocket.Conn
 	roomKey RoomKey
+	user    DbUser
 }
 
 type RoomManager struct {
@@ -63,6 +67,12 @@ func (rm *RoomManager) subscribeHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	user, ok := canSubscribe(r, Id, rmType)
+	if !ok {
+		w.WriteHeader(forbidden)
+		return
+	}
+
 	u := websocket.NewUpgrader()
 	conn, err := u.Upgrade(w, r, nil)
 	if err != nil {
@@ -73,10 +83,10 @@ func (rm *RoomManager) subscribeHandler(w http.ResponseWriter, r *http.Request)
 		id:       Id,
 		roomtype: rmType,
 	}
-	rm.subscribe(key, conn)
+	rm.subscribe(key, conn, user)
 }
 
-func (rm *RoomManager) subscribe(key RoomKey, conn *websocket.Conn) {
+func (rm *RoomManager) subscribe(key RoomKey, conn *websocket.Conn, user DbUser) {
 	rm.mu.Lock()
 	room, exists := rm.rooms[key]
 	if !exists {
@@ -92,6 +102,7 @@ func (rm *RoomManager) subscribe(key RoomKey, conn *websocket.Conn) {
 	subscriber := &Subscriber{
 		conn:    conn,
 		roomKey: key,
+		user:    user,
 	}
 	room.subscribers[subscriber] = true
 	log.Println("room:", room)
@@ -105,3 +116,75 @@ func (rm *RoomManager) subscribe(key RoomKey, conn *websocket.Conn) {
 		delete(room.subscribers, subscriber)
 	})
 }
+
+// closeSubscribers sends a close frame to the subscribers of key drop picks,
+// their pages reconnect or show reason. The room lock is not held while
+// drop runs so it may query the database.
+func (rm *RoomManager) closeSubscribers(key RoomKey, reason string, drop func(user DbUser) bool) {
+	rm.mu.RLock()
+	room, exists := rm.rooms[key]
+	rm.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	room.mu.RLock()
+	subscribers := make([]*Subscriber, 0, len(room.subscribers))
+	for s := range room.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	room.mu.RUnlock()
+
+	for _, s := range subscribers {
+		if !drop(s.user) {
+			continue
+		}
+		err := s.conn.WriteClose(1008, reason)
+		if err != nil {
+			log.Println(s, err)
+		}
+		s.conn.Close()
+	}
+}
+
+// canSubscribe keeps non-members out of the forum and topic rooms of private
+// forums and everyone but the user out of a user's notification room, it
+// returns who subscribes
+func canSubscribe(r *http.Request, Id uuid.UUID, rmType string) (DbUser, bool) {
+	user, _ := userInfoMiddleware(r)
+	if rmType != "forum" && rmType != "topic" && rmType != "user" && rmType != "article" {
+		return user, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if rmType == "user" {
+		return user, user.Identifier != uuid.Nil && user.Identifier == Id
+	}
+
+	// comments of drafts are for the people who may read the draft
+	if rmType == "article" {
+		article, err := getArticle(ctx, Id)
+		if err != nil {
+			return user, false
+		}
+		return user, user.canViewArticle(article)
+	}
+
+	if rmType == "topic" {
+		topic, err := getTopic(ctx, Id)
+		if err != nil {
+			return user, false
+		}
+		Id = topic.ForumID
+	}
+
+	forum, err := getForum(ctx, Id)
+	if err != nil {
+		return user, false
+	}
+
+	auth, err := authorizeForum(ctx, forum, user)
+	return user, err == nil && auth.CanRead
+}